@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	forgejo "codeberg.org/mvdkleijn/forgejo-sdk/forgejo/v2"
+	"github.com/google/go-github/v34/github"
+	bitbucket "github.com/ktrysmt/go-bitbucket"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// anonymousConfig backs up the public repositories of the listed users and
+// organizations without credentials. The APIs allow fewer requests without
+// a token, the rate limits are waited for as with a token.
+type anonymousConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Owners are the users and organizations, GitLab groups or Bitbucket
+	// workspaces whose public repositories are backed up
+	Owners []string `yaml:"owners,omitempty"`
+}
+
+// validateAnonymousConfig returns the problems found in the anonymous
+// settings of a target
+func validateAnonymousConfig(a anonymousConfig, service string, githubOwners githubOwnersConfig, gitlabGroups gitlabGroupsConfig) []string {
+	if !a.Enabled {
+		return nil
+	}
+	var errors []string
+	owners := len(a.Owners)
+	switch service {
+	case "github":
+		owners += len(githubOwners.Orgs) + len(githubOwners.Users)
+		if owners == 0 {
+			errors = append(errors, "anonymous requires anonymous.owners, github.orgs or github.users")
+		}
+	case "gitlab":
+		owners += len(gitlabGroups.Groups)
+		if owners == 0 {
+			errors = append(errors, "anonymous requires anonymous.owners or gitlab.groups")
+		}
+	default:
+		if owners == 0 {
+			errors = append(errors, "anonymous requires anonymous.owners")
+		}
+	}
+	return errors
+}
+
+// newAnonymousClient creates a client for service which sends no credentials
+func newAnonymousClient(service string, gitHostURLParsed *url.URL, transport http.RoundTripper) (interface{}, error) {
+	switch service {
+	case "github":
+		client := github.NewClient(&http.Client{Transport: instrumentTransport("github", transport)})
+		if gitHostURLParsed != nil {
+			client.BaseURL = gitHostURLParsed
+		}
+		return client, nil
+	case "gitlab":
+		var baseUrlOption gitlab.ClientOptionFunc
+		if gitHostURLParsed != nil {
+			baseUrlOption = gitlab.WithBaseURL(gitHostURLParsed.String())
+		}
+		httpClient := &http.Client{Transport: instrumentTransport("gitlab", noEmptyTokenTransport{transport})}
+		client, err := gitlab.NewClient("", baseUrlOption, gitlab.WithHTTPClient(httpClient))
+		if err != nil {
+			return nil, fmt.Errorf("error creating gitlab client: %v", err)
+		}
+		return client, nil
+	case "bitbucket":
+		// Without a username and password no Authorization header is sent
+		client, err := bitbucket.NewBasicAuth("", "")
+		if err != nil {
+			return nil, fmt.Errorf("error creating Bitbucket client: %v", err)
+		}
+		if transport != nil {
+			client.HttpClient.Transport = transport
+		}
+		client.HttpClient.Transport = instrumentTransport("bitbucket", client.HttpClient.Transport)
+		if gitHostURLParsed != nil {
+			client.SetApiBaseURL(*gitHostURLParsed)
+		}
+		return client, nil
+	case "forgejo":
+		forgejoURL := "https://" + knownServices["forgejo"]
+		if gitHostURLParsed != nil {
+			forgejoURL = gitHostURLParsed.String()
+		}
+		httpClient := &http.Client{Transport: instrumentTransport("forgejo", transport)}
+		client, err := forgejo.NewClient(forgejoURL, forgejo.SetForgejoVersion(""), forgejo.SetHTTPClient(httpClient))
+		if err != nil {
+			return nil, fmt.Errorf("error creating forgejo client: %v", err)
+		}
+		return client, nil
+	}
+	return nil, nil
+}
+
+// noEmptyTokenTransport removes the empty PRIVATE-TOKEN header the GitLab
+// client sends without a token
+type noEmptyTokenTransport struct {
+	next http.RoundTripper
+}
+
+func (t noEmptyTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := req.Header["Private-Token"]; ok && req.Header.Get("Private-Token") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Del("Private-Token")
+	}
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(req)
+}
+
+// getAnonymousRepositories lists the public repositories of the owners of
+// the anonymous settings of c
+func getAnonymousRepositories(client interface{}, c *appConfig) ([]*Repository, error) {
+	if client == nil {
+		return nil, fmt.Errorf("couldn't acquire a client to talk to %s", c.service)
+	}
+	log.Printf("Listing the public repositories of %s anonymously, the API allows fewer requests without a token\n", c.service)
+
+	var repositories []*Repository
+	var err error
+	switch c.service {
+	case "github":
+		// The repositories of organizations are also listed as those of a user
+		owners := c.githubOwners
+		for _, owner := range c.anonymous.Owners {
+			owners.Users = append(owners.Users, githubOwnerConfig{Name: owner})
+		}
+		repositories, err = getGithubRepositories(client.(*github.Client), "none", nil, owners, c.ignoreFork)
+	case "gitlab":
+		repositories, err = getAnonymousGitlabRepositories(client.(*gitlab.Client), c.anonymous.Owners, c.gitlabGroups, c.filter, c.ignoreFork)
+	case "bitbucket":
+		repositories, err = getAnonymousBitbucketRepositories(client.(*bitbucket.Client), c.anonymous.Owners, c.ignoreFork)
+	case "forgejo":
+		repositories, err = getAnonymousForgejoRepositories(client.(*forgejo.Client), c.anonymous.Owners, c.filter, c.ignoreFork)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Private repositories are not listed without credentials, unless the
+	// host is misconfigured, and could not be cloned anyway
+	public := repositories[:0]
+	for _, repo := range repositories {
+		if !repo.Private {
+			public = append(public, repo)
+		}
+	}
+	return public, nil
+}
+
+// getAnonymousGitlabRepositories lists the public projects of groups and of
+// owners, which may be groups or users
+func getAnonymousGitlabRepositories(
+	client *gitlab.Client, owners []string, gitlabGroups gitlabGroupsConfig, filter filterConfig, ignoreFork bool,
+) ([]*Repository, error) {
+	var groups, users []string
+	for _, owner := range owners {
+		_, resp, err := client.Groups.GetGroup(owner, &gitlab.GetGroupOptions{WithProjects: gitlab.Bool(false)})
+		switch {
+		case err == nil:
+			groups = append(groups, owner)
+		case resp != nil && resp.StatusCode == http.StatusNotFound:
+			users = append(users, owner)
+		default:
+			return nil, fmt.Errorf("error looking up %s: %v", owner, err)
+		}
+	}
+	gitlabGroups.Groups = append(append([]string{}, gitlabGroups.Groups...), groups...)
+
+	repositories, err := getGitlabRepositories(client, "public", "none", gitlabGroups, filter, ignoreFork)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, repo := range repositories {
+		seen[repositoryKey(repo)] = true
+	}
+	visibility := gitlab.PublicVisibility
+	for _, user := range users {
+		options := gitlab.ListProjectsOptions{Visibility: &visibility}
+		for {
+			projects, resp, err := client.Projects.ListUserProjects(user, &options)
+			if err != nil {
+				return nil, fmt.Errorf("error listing the projects of %s: %v", user, err)
+			}
+			for _, project := range projects {
+				if project.ForkedFromProject != nil && ignoreFork {
+					continue
+				}
+				repo, err := newGitlabRepository(client, project, filter)
+				if err != nil {
+					return nil, err
+				}
+				repositories = appendNewRepositories(repositories, seen, []*Repository{repo})
+			}
+			if resp.NextPage == 0 {
+				break
+			}
+			options.ListOptions.Page = resp.NextPage
+		}
+	}
+	return repositories, nil
+}
+
+// getAnonymousBitbucketRepositories lists the public repositories of the
+// workspaces in owners
+func getAnonymousBitbucketRepositories(client *bitbucket.Client, owners []string, ignoreFork bool) ([]*Repository, error) {
+	var repositories []*Repository
+	for _, owner := range owners {
+		resp, err := client.Repositories.ListForAccount(&bitbucket.RepositoriesOptions{Owner: owner})
+		if err != nil {
+			return nil, fmt.Errorf("error listing the repositories of %s: %v", owner, err)
+		}
+		for _, repo := range resp.Items {
+			if repo.Parent != nil && ignoreFork {
+				continue
+			}
+			httpsURL, sshURL := extractBitbucketCloneURLs(repo.Links)
+			repositories = append(repositories, &Repository{
+				ID:        repo.Uuid,
+				CloneURL:  getCloneURL(httpsURL, sshURL),
+				Name:      repo.Slug,
+				Namespace: strings.Split(repo.Full_name, "/")[0],
+				Private:   repo.Is_private,
+				Fork:      repo.Parent != nil,
+				Language:  repo.Language,
+				PushedAt:  bitbucketUpdatedOn(repo),
+			})
+		}
+	}
+	return repositories, nil
+}
+
+// getAnonymousForgejoRepositories lists the public repositories of the
+// users and organizations in owners
+func getAnonymousForgejoRepositories(client *forgejo.Client, owners []string, filter filterConfig, ignoreFork bool) ([]*Repository, error) {
+	var repositories []*Repository
+	for _, owner := range owners {
+		repos, err := paginateForgejoRepositories(func(page int) ([]*forgejo.Repository, *forgejo.Response, error) {
+			return client.ListUserRepos(owner, forgejo.ListReposOptions{
+				ListOptions: forgejo.ListOptions{Page: page},
+			})
+		}, ignoreFork)
+		if err != nil {
+			return nil, fmt.Errorf("fetching the repositories of %s from forgejo: %v", owner, err)
+		}
+		repositories = append(repositories, repos...)
+	}
+	return repositories, addForgejoMetadata(client, repositories, filter)
+}
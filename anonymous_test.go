@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnonymousRepositories(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Header["Authorization"]; ok {
+			t.Errorf("Expected no Authorization header for %s", r.URL.Path)
+		}
+		if _, ok := r.Header["Private-Token"]; ok {
+			t.Errorf("Expected no PRIVATE-TOKEN header for %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		// GitHub
+		case "/users/golang/repos":
+			fmt.Fprint(w, `[
+				{"full_name": "golang/go", "id": 1, "clone_url": "https://github.com/golang/go.git", "name": "go", "private": false, "fork": false},
+				{"full_name": "golang/secret", "id": 2, "clone_url": "https://github.com/golang/secret.git", "name": "secret", "private": true, "fork": false}
+			]`)
+		// GitLab
+		case "/api/v4/groups/gitlab-org":
+			fmt.Fprint(w, `{"id": 9970, "full_path": "gitlab-org"}`)
+		case "/api/v4/groups/gitlab-org/projects":
+			fmt.Fprint(w, `[{"id": 1, "path_with_namespace": "gitlab-org/gitlab", "name": "gitlab", "web_url": "https://gitlab.com/gitlab-org/gitlab", "visibility": "public"}]`)
+		case "/api/v4/groups/jdoe":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "404 Group Not Found"}`)
+		case "/api/v4/users/jdoe/projects":
+			if r.URL.Query().Get("visibility") != "public" {
+				t.Errorf("Expected public projects to be listed, got: %v", r.URL.RawQuery)
+			}
+			fmt.Fprint(w, `[{"id": 2, "path_with_namespace": "jdoe/dotfiles", "name": "dotfiles", "web_url": "https://gitlab.com/jdoe/dotfiles", "visibility": "public"}]`)
+		// Bitbucket
+		case "/repositories/atlassian":
+			fmt.Fprint(w, `{"pagelen": 10, "page": 1, "size": 1, "values": [{"full_name": "atlassian/python-bitbucket", "slug": "python-bitbucket", "is_private": false, "links": {"clone": [{"name": "https", "href": "https://bitbucket.org/atlassian/python-bitbucket.git"}]}}]}`)
+		// Forgejo
+		case "/api/v1/users/forgejo/repos":
+			fmt.Fprint(w, `[{"clone_url": "https://codeberg.org/forgejo/forgejo.git", "name": "forgejo", "owner": {"login": "forgejo"}, "private": false}]`)
+		default:
+			t.Errorf("Unexpected request: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	t.Cleanup(func() { useHTTPSClone = nil })
+
+	tests := []struct {
+		service    string
+		gitHostURL string
+		owners     []string
+		want       []*Repository
+	}{
+		{"github", ts.URL + "/", []string{"golang"}, []*Repository{
+			{ID: "1", Namespace: "golang", CloneURL: "https://github.com/golang/go.git", Name: "go"},
+		}},
+		{"gitlab", ts.URL, []string{"gitlab-org", "jdoe"}, []*Repository{
+			{ID: "1", Namespace: "gitlab-org", CloneURL: "https://gitlab.com/gitlab-org/gitlab", Name: "gitlab"},
+			{ID: "2", Namespace: "jdoe", CloneURL: "https://gitlab.com/jdoe/dotfiles", Name: "dotfiles"},
+		}},
+		{"bitbucket", ts.URL, []string{"atlassian"}, []*Repository{
+			{Namespace: "atlassian", CloneURL: "https://bitbucket.org/atlassian/python-bitbucket.git", Name: "python-bitbucket"},
+		}},
+		{"forgejo", ts.URL, []string{"forgejo"}, []*Repository{
+			{Namespace: "forgejo", CloneURL: "https://codeberg.org/forgejo/forgejo.git", Name: "forgejo"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			// Credentials in the environment must not be used
+			t.Setenv("GITHUB_TOKEN", "ghtoken")
+			t.Setenv("GITLAB_TOKEN", "gltoken")
+			c := &appConfig{
+				service:    tt.service,
+				gitHostURL: tt.gitHostURL,
+				anonymous:  anonymousConfig{Enabled: true, Owners: tt.owners},
+				// The default of the flag
+				gitlabProjectMembershipType: "all",
+			}
+			if err := validateConfig(c); err != nil {
+				t.Fatalf("Expected a valid config, got: %v", err)
+			}
+			client, err := newClient(c)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if warnings, err := checkToken(client, c); err != nil || len(warnings) > 0 {
+				t.Errorf("Expected the token check to be skipped, got: %v %v", warnings, err)
+			}
+			opts, repos, err := listGitRepositories(client, c)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if !reflect.DeepEqual(repos, tt.want) {
+				t.Errorf("Expected %+v, got %+v", tt.want, repos)
+			}
+			if !opts.useHTTPS || opts.token != "" {
+				t.Errorf("Expected anonymous HTTPS clones, got: %+v", opts)
+			}
+		})
+	}
+}
+
+func TestValidateAnonymousConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       *appConfig
+		wantErr string
+	}{
+		{"no owners", &appConfig{service: "forgejo", anonymous: anonymousConfig{Enabled: true}}, "anonymous requires anonymous.owners"},
+		{
+			"github orgs",
+			&appConfig{service: "github", anonymous: anonymousConfig{Enabled: true}, githubOwners: githubOwnersConfig{Orgs: []githubOwnerConfig{{Name: "golang"}}}},
+			"",
+		},
+		{"gitlab groups", &appConfig{service: "gitlab", anonymous: anonymousConfig{Enabled: true}, gitlabGroups: gitlabGroupsConfig{Groups: []string{"gitlab-org"}}}, ""},
+		{
+			"migration",
+			&appConfig{service: "github", anonymous: anonymousConfig{Enabled: true, Owners: []string{"golang"}}, githubCreateUserMigration: true},
+			"GitHub migrations require a token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.c.gitlabProjectMembershipType = "all"
+			err := validateConfig(tt.c)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Expected an error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
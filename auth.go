@@ -0,0 +1,594 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/99designs/keyring"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/oauth2"
+	"golang.org/x/term"
+)
+
+var keyringServiceName = "gitbackup-cli"
+var gitbackupClientID = "7b56a77c7dfba0800524"
+
+// legacyGitHubKeyringKey is the key tokens for github.com were stored under
+// before credentials were stored per host
+const legacyGitHubKeyringKey = "GITHUB_TOKEN"
+
+// openKeyring opens the keyring credentials are stored in, overridden in tests
+var openKeyring = func() (keyring.Keyring, error) {
+	return openConfiguredKeyring(keyringSettings)
+}
+
+// promptInput is where tokens and usernames are read from by auth login,
+// overridden in tests
+var promptInput io.Reader = os.Stdin
+
+// storedCredential is the credential of a service on a host, stored in the
+// keyring as JSON
+type storedCredential struct {
+	Token    string `json:"token"`
+	Username string `json:"username,omitempty"`
+	URL      string `json:"url,omitempty"`
+
+	// Set for tokens obtained with the device flow which expire
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+	ClientID     string    `json:"client_id,omitempty"`
+	TokenURL     string    `json:"token_url,omitempty"`
+}
+
+// deviceFlow describes the OAuth device flow endpoints of a service
+type deviceFlow struct {
+	codeURL  string
+	tokenURL string
+	scopes   []string
+}
+
+// defaultTokenEnvVars are the environment variables a service's token is
+// read from when it is not set in the configuration
+var defaultTokenEnvVars = map[string][]string{
+	"github":    {"GITHUB_TOKEN"},
+	"gitlab":    {"GITLAB_TOKEN"},
+	"bitbucket": {"BITBUCKET_TOKEN", "BITBUCKET_PASSWORD"},
+	"forgejo":   {"FORGEJO_TOKEN"},
+}
+
+// authFlags returns the CLI flags of the auth subcommands
+func authFlags(login bool) []cli.Flag {
+	flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "service",
+			Usage: "Git Hosted Service Name (github/gitlab/bitbucket/forgejo)",
+		},
+		&cli.StringFlag{
+			Name:        "host",
+			Usage:       "Host name or URL of the Git host",
+			DefaultText: "the public host of the service",
+		},
+	}
+	if login {
+		flags = append(flags,
+			&cli.StringFlag{
+				Name:  "username",
+				Usage: "Username to store with the token (required for bitbucket)",
+			},
+			&cli.BoolFlag{
+				Name:  "with-token",
+				Usage: "Read the token from standard input instead of using the OAuth device flow",
+			},
+			&cli.StringFlag{
+				Name:  "oauth.clientID",
+				Usage: "Client ID of the OAuth application used for the device flow",
+			},
+		)
+	}
+	return append(flags, keyringFlags()...)
+}
+
+// authCommand returns the auth command and its subcommands
+func authCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "auth",
+		Usage: "Manage the credentials stored in the keyring",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "login",
+				Usage: "Log in to a Git host and store the credentials in the keyring",
+				Flags: authFlags(true),
+				Action: func(cCtx *cli.Context) error {
+					if err := configureKeyring(cCtx); err != nil {
+						return err
+					}
+					return handleAuthLogin(
+						cCtx.String("service"), cCtx.String("host"), cCtx.String("username"),
+						cCtx.Bool("with-token"), cCtx.String("oauth.clientID"),
+					)
+				},
+			},
+			{
+				Name:  "logout",
+				Usage: "Remove the credentials of a Git host from the keyring",
+				Flags: authFlags(false),
+				Action: func(cCtx *cli.Context) error {
+					if err := configureKeyring(cCtx); err != nil {
+						return err
+					}
+					return handleAuthLogout(cCtx.String("service"), cCtx.String("host"))
+				},
+			},
+			{
+				Name:  "status",
+				Usage: "Show and verify the credentials stored in the keyring",
+				Flags: authFlags(false),
+				Action: func(cCtx *cli.Context) error {
+					if err := configureKeyring(cCtx); err != nil {
+						return err
+					}
+					return handleAuthStatus(os.Stdout, cCtx.String("service"), cCtx.String("host"))
+				},
+			},
+		},
+	}
+}
+
+// keyringKey returns the keyring key of the credential of a service on a host
+func keyringKey(service, host string) string {
+	return service + ":" + host
+}
+
+// parseAuthHost returns the URL of the host given to the auth commands,
+// which defaults to the public host of the service
+func parseAuthHost(service, host string) (*url.URL, error) {
+	if _, ok := knownServices[service]; !ok {
+		return nil, fmt.Errorf("please specify the git service type: github, gitlab, bitbucket, forgejo")
+	}
+	if host == "" {
+		host = knownServices[service]
+	}
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid host: %s", host)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+// credentialHost returns the host a credential for gitHostURL is stored for
+func credentialHost(service, gitHostURL string) string {
+	if gitHostURL == "" {
+		return knownServices[service]
+	}
+	u, err := url.Parse(gitHostURL)
+	if err != nil || u.Host == "" {
+		return gitHostURL
+	}
+	return u.Host
+}
+
+// authGitHostURL returns the git host URL to create a client for the
+// host given to the auth commands
+func authGitHostURL(service string, hostURL *url.URL) string {
+	if hostURL.Host == knownServices[service] && hostURL.Path == "" {
+		return ""
+	}
+	if service == "github" {
+		// GitHub Enterprise serves the API below /api/v3/
+		return hostURL.String() + "/api/v3/"
+	}
+	return hostURL.String()
+}
+
+// deviceFlowFor returns the OAuth device flow endpoints of a service, if
+// the service has one
+func deviceFlowFor(service string, hostURL *url.URL) (deviceFlow, bool) {
+	switch service {
+	case "github":
+		return deviceFlow{
+			codeURL:  hostURL.String() + "/login/device/code",
+			tokenURL: hostURL.String() + "/login/oauth/access_token",
+			scopes:   []string{"repo", "user", "admin:org"},
+		}, true
+	case "gitlab":
+		return deviceFlow{
+			codeURL:  hostURL.String() + "/oauth/authorize_device",
+			tokenURL: hostURL.String() + "/oauth/token",
+			scopes:   []string{"api"},
+		}, true
+	}
+	return deviceFlow{}, false
+}
+
+// startDeviceFlow obtains a token with the OAuth device flow, asking the
+// user to authorize gitbackup in their browser
+func startDeviceFlow(flow deviceFlow, clientID string) (*storedCredential, error) {
+	conf := &oauth2.Config{
+		ClientID: clientID,
+		Scopes:   flow.scopes,
+		Endpoint: oauth2.Endpoint{DeviceAuthURL: flow.codeURL, TokenURL: flow.tokenURL},
+	}
+	ctx := context.Background()
+	da, err := conf.DeviceAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error starting the device flow: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Copy code: %s\n", da.UserCode)
+	fmt.Fprintf(os.Stderr, "then open: %s\n", da.VerificationURI)
+
+	token, err := conf.DeviceAccessToken(ctx, da)
+	if err != nil {
+		return nil, fmt.Errorf("error completing the device flow: %v", err)
+	}
+	cred := &storedCredential{Token: token.AccessToken}
+	if token.RefreshToken != "" && !token.Expiry.IsZero() {
+		cred.RefreshToken = token.RefreshToken
+		cred.Expiry = token.Expiry
+		cred.ClientID = clientID
+		cred.TokenURL = flow.tokenURL
+	}
+	return cred, nil
+}
+
+// promptLine prints prompt and reads a line from promptInput. Input from a
+// terminal is not echoed if secret is set.
+func promptLine(prompt string, secret bool) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if f, ok := promptInput.(*os.File); ok && secret && term.IsTerminal(int(f.Fd())) {
+		data, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return strings.TrimSpace(string(data)), err
+	}
+
+	// Read a byte at a time so that nothing after the line is consumed
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := promptInput.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
+// handleAuthLogin obtains a credential for a service on a host, verifies it
+// and stores it in the keyring
+func handleAuthLogin(service, host, username string, withToken bool, clientID string) error {
+	hostURL, err := parseAuthHost(service, host)
+	if err != nil {
+		return err
+	}
+	if clientID == "" && service == "github" && hostURL.Host == knownServices["github"] {
+		clientID = gitbackupClientID
+	}
+
+	var cred *storedCredential
+	flow, ok := deviceFlowFor(service, hostURL)
+	if ok && !withToken && clientID != "" {
+		cred, err = startDeviceFlow(flow, clientID)
+		if err != nil {
+			return err
+		}
+	} else {
+		if service == "bitbucket" && username == "" {
+			username, err = promptLine("Bitbucket username: ", false)
+			if err != nil {
+				return fmt.Errorf("error reading username: %v", err)
+			}
+		}
+		prompt := fmt.Sprintf("Token for %s: ", hostURL.Host)
+		if service == "bitbucket" {
+			prompt = fmt.Sprintf("API token or app password for %s: ", hostURL.Host)
+		}
+		token, err := promptLine(prompt, true)
+		if err != nil {
+			return fmt.Errorf("error reading token: %v", err)
+		}
+		cred = &storedCredential{Token: token}
+	}
+	if cred.Token == "" {
+		return errors.New("no token given")
+	}
+	cred.Username = username
+	cred.URL = hostURL.String()
+
+	login, err := verifyCredential(service, hostURL, cred)
+	if err != nil {
+		return fmt.Errorf("error verifying the credentials for %s: %v", hostURL.Host, err)
+	}
+	if err := storeCredential(service, hostURL.Host, cred); err != nil {
+		return fmt.Errorf("error saving the credentials to the keyring: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Logged in to %s as %s\n", hostURL.Host, login)
+	return nil
+}
+
+// handleAuthLogout removes the credential of a service on a host from the
+// keyring
+func handleAuthLogout(service, host string) error {
+	hostURL, err := parseAuthHost(service, host)
+	if err != nil {
+		return err
+	}
+	ring, err := openKeyring()
+	if err != nil {
+		return fmt.Errorf("error opening the keyring: %v", err)
+	}
+
+	removed := false
+	keys := []string{keyringKey(service, hostURL.Host)}
+	if service == "github" && hostURL.Host == knownServices["github"] {
+		keys = append(keys, legacyGitHubKeyringKey)
+	}
+	for _, key := range keys {
+		if _, err := ring.Get(key); isKeyNotFound(err) {
+			continue
+		}
+		if err := ring.Remove(key); err != nil {
+			return fmt.Errorf("error removing the credentials from the keyring: %v", err)
+		}
+		removed = true
+	}
+	if !removed {
+		return fmt.Errorf("not logged in to %s", hostURL.Host)
+	}
+	fmt.Fprintf(os.Stderr, "Logged out of %s\n", hostURL.Host)
+	return nil
+}
+
+// handleAuthStatus verifies the credentials stored in the keyring,
+// optionally only those of a service or host, and writes their status to w
+func handleAuthStatus(w io.Writer, service, host string) error {
+	if host != "" {
+		hostURL, err := parseAuthHost(service, host)
+		if err != nil {
+			return err
+		}
+		host = hostURL.Host
+	}
+
+	ring, err := openKeyring()
+	if err != nil {
+		return fmt.Errorf("error opening the keyring: %v", err)
+	}
+	keys, err := ring.Keys()
+	if err != nil {
+		return fmt.Errorf("error reading the keyring: %v", err)
+	}
+	sort.Strings(keys)
+
+	found := false
+	for _, key := range keys {
+		keyService, keyHost := parseKeyringKey(key)
+		if keyService == "" || (service != "" && keyService != service) || (host != "" && keyHost != host) {
+			continue
+		}
+		found = true
+
+		login, err := verifyStoredCredential(keyService, keyHost)
+		if err != nil {
+			fmt.Fprintf(w, "%s (%s): invalid credentials: %v\n", keyHost, keyService, err)
+		} else {
+			fmt.Fprintf(w, "%s (%s): logged in as %s\n", keyHost, keyService, login)
+		}
+		for _, envVar := range defaultTokenEnvVars[keyService] {
+			if os.Getenv(envVar) != "" {
+				fmt.Fprintf(w, "  %s is set and takes precedence\n", envVar)
+				break
+			}
+		}
+	}
+
+	if !found {
+		if host != "" {
+			return fmt.Errorf("not logged in to %s", host)
+		}
+		fmt.Fprintln(w, "No credentials stored in the keyring")
+	}
+	return nil
+}
+
+// parseKeyringKey returns the service and host of a keyring key, or empty
+// strings if the key is not a credential
+func parseKeyringKey(key string) (string, string) {
+	if key == legacyGitHubKeyringKey {
+		return "github", knownServices["github"]
+	}
+	service, host, ok := strings.Cut(key, ":")
+	if _, known := knownServices[service]; !ok || !known {
+		return "", ""
+	}
+	return service, host
+}
+
+// verifyStoredCredential checks the credential of a service on a host
+// stored in the keyring
+func verifyStoredCredential(service, host string) (string, error) {
+	cred, err := loadCredential(service, host)
+	if err != nil {
+		return "", err
+	}
+	if cred == nil {
+		return "", fmt.Errorf("not logged in to %s", host)
+	}
+	if cred.URL != "" {
+		host = cred.URL
+	}
+	hostURL, err := parseAuthHost(service, host)
+	if err != nil {
+		return "", err
+	}
+	return verifyCredential(service, hostURL, cred)
+}
+
+// verifyCredential checks a credential by retrieving the username it
+// belongs to
+func verifyCredential(service string, hostURL *url.URL, cred *storedCredential) (string, error) {
+	c := &appConfig{
+		service:     service,
+		gitHostURL:  authGitHostURL(service, hostURL),
+		credentials: credentialsConfig{Token: cred.Token, Username: cred.Username},
+	}
+	client, err := newClient(c)
+	if err != nil {
+		return "", err
+	}
+	return getUsername(client, service)
+}
+
+func isKeyNotFound(err error) bool {
+	return errors.Is(err, keyring.ErrKeyNotFound)
+}
+
+// storeCredential stores the credential of a service on a host in the keyring
+func storeCredential(service, host string, cred *storedCredential) error {
+	ring, err := openKeyring()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+	return ring.Set(keyring.Item{
+		Key:   keyringKey(service, host),
+		Data:  data,
+		Label: fmt.Sprintf("gitbackup %s credentials for %s", service, host),
+	})
+}
+
+// loadCredential returns the credential of a service on a host stored in
+// the keyring, or nil if there is none. Tokens which have expired are
+// refreshed.
+func loadCredential(service, host string) (*storedCredential, error) {
+	ring, err := openKeyring()
+	if err != nil {
+		return nil, err
+	}
+
+	cred := &storedCredential{}
+	item, err := ring.Get(keyringKey(service, host))
+	if isKeyNotFound(err) && service == "github" && host == knownServices["github"] {
+		item, err = ring.Get(legacyGitHubKeyringKey)
+		if err == nil {
+			// Move the token to the key of the host
+			cred.Token = string(item.Data)
+			if err := storeCredential(service, host, cred); err != nil {
+				return nil, err
+			}
+			return cred, ring.Remove(legacyGitHubKeyringKey)
+		}
+	}
+	if isKeyNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(item.Data, cred); err != nil {
+		return nil, fmt.Errorf("invalid credentials stored for %s: %v", host, err)
+	}
+
+	if cred.RefreshToken != "" && time.Now().Add(time.Minute).After(cred.Expiry) {
+		if err := refreshCredential(cred); err != nil {
+			return nil, fmt.Errorf("error refreshing the token for %s: %v", host, err)
+		}
+		if err := storeCredential(service, host, cred); err != nil {
+			return nil, err
+		}
+	}
+	return cred, nil
+}
+
+// refreshCredential replaces the expired token of cred using its refresh
+// token
+func refreshCredential(cred *storedCredential) error {
+	conf := &oauth2.Config{
+		ClientID: cred.ClientID,
+		Endpoint: oauth2.Endpoint{TokenURL: cred.TokenURL},
+	}
+	token, err := conf.TokenSource(context.Background(), &oauth2.Token{
+		AccessToken:  cred.Token,
+		RefreshToken: cred.RefreshToken,
+		Expiry:       cred.Expiry,
+	}).Token()
+	if err != nil {
+		return err
+	}
+	cred.Token = token.AccessToken
+	cred.Expiry = token.Expiry
+	if token.RefreshToken != "" {
+		cred.RefreshToken = token.RefreshToken
+	}
+	return nil
+}
+
+// needsStoredCredential returns true if no token for service was given in
+// the configuration or the environment
+func needsStoredCredential(service string, creds credentialsConfig) bool {
+	envVars, ok := defaultTokenEnvVars[service]
+	if !ok || creds.Token != "" || creds.TokenEnv != "" {
+		return false
+	}
+	for _, envVar := range envVars {
+		if os.Getenv(envVar) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// hasStoredCredential reports whether a credential for the service on the
+// host of gitHostURL is stored in the keyring. Unlike loadCredential, it
+// neither refreshes the token nor moves the legacy GitHub token, so that
+// validating the config does not write to the keyring or use the network.
+func hasStoredCredential(service, gitHostURL string) bool {
+	ring, err := openKeyring()
+	if err != nil {
+		return false
+	}
+	host := credentialHost(service, gitHostURL)
+	_, err = ring.Get(keyringKey(service, host))
+	if isKeyNotFound(err) && service == "github" && host == knownServices["github"] {
+		_, err = ring.Get(legacyGitHubKeyringKey)
+	}
+	return err == nil
+}
+
+// withStoredCredential returns creds with the token, and username if none
+// was given, stored in the keyring for the service on the host of
+// gitHostURL. The returned boolean is false if there was none.
+func withStoredCredential(service, gitHostURL string, creds credentialsConfig) (credentialsConfig, bool, error) {
+	cred, err := loadCredential(service, credentialHost(service, gitHostURL))
+	if err != nil || cred == nil {
+		return creds, false, err
+	}
+	creds.Token = cred.Token
+	if creds.Username == "" && creds.UsernameEnv == "" && os.Getenv("BITBUCKET_USERNAME") == "" {
+		creds.Username = cred.Username
+	}
+	return creds, true, nil
+}
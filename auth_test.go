@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/99designs/keyring"
+)
+
+// useTestKeyring replaces the keyring with an in-memory keyring for the
+// duration of the test
+func useTestKeyring(t *testing.T) keyring.Keyring {
+	t.Helper()
+	ring := keyring.NewArrayKeyring(nil)
+	saved := openKeyring
+	openKeyring = func() (keyring.Keyring, error) { return ring, nil }
+	t.Cleanup(func() { openKeyring = saved })
+	return ring
+}
+
+func TestParseAuthHost(t *testing.T) {
+	tests := []struct {
+		service, host string
+		want          string
+		wantErr       bool
+	}{
+		{"github", "", "https://github.com", false},
+		{"gitlab", "gitlab.example.com", "https://gitlab.example.com", false},
+		{"forgejo", "http://localhost:3000/", "http://localhost:3000", false},
+		{"unknown", "", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseAuthHost(tt.service, tt.host)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAuthHost(%q, %q) error = %v", tt.service, tt.host, err)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("parseAuthHost(%q, %q) = %v, want %v", tt.service, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestCredentialHost(t *testing.T) {
+	tests := []struct {
+		service, gitHostURL, want string
+	}{
+		{"github", "", "github.com"},
+		{"bitbucket", "", "bitbucket.org"},
+		{"github", "https://ghe.example.com/api/v3/", "ghe.example.com"},
+		{"gitlab", "https://gitlab.example.com:8443", "gitlab.example.com:8443"},
+	}
+	for _, tt := range tests {
+		if got := credentialHost(tt.service, tt.gitHostURL); got != tt.want {
+			t.Errorf("credentialHost(%q, %q) = %v, want %v", tt.service, tt.gitHostURL, got, tt.want)
+		}
+	}
+}
+
+func TestAuthLoginWithToken(t *testing.T) {
+	ring := useTestKeyring(t)
+	t.Setenv("GITLAB_TOKEN", "")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/user" || r.Header.Get("Private-Token") != "gltoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"username": "gluser"}`)
+	}))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	savedInput := promptInput
+	defer func() { promptInput = savedInput }()
+
+	promptInput = strings.NewReader("wrongtoken\n")
+	if err := handleAuthLogin("gitlab", ts.URL, "", true, ""); err == nil {
+		t.Fatal("Expected an error for an invalid token")
+	}
+	if keys, _ := ring.Keys(); len(keys) != 0 {
+		t.Fatalf("Expected an invalid token not to be stored, got: %v", keys)
+	}
+
+	promptInput = strings.NewReader("gltoken\n")
+	if err := handleAuthLogin("gitlab", ts.URL, "", true, ""); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, err := ring.Get("gitlab:" + host); err != nil {
+		t.Fatalf("Expected the credentials to be stored for the host, got: %v", err)
+	}
+
+	// The stored token is used by newClient
+	c := &appConfig{service: "gitlab", gitHostURL: ts.URL}
+	if _, err := newClient(c); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if c.token != "gltoken" {
+		t.Errorf("Expected the stored token to be used, got: %v", c.token)
+	}
+
+	var out bytes.Buffer
+	if err := handleAuthStatus(&out, "", ""); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if want := fmt.Sprintf("%s (gitlab): logged in as gluser\n", host); out.String() != want {
+		t.Errorf("Expected status %q, got: %q", want, out.String())
+	}
+
+	if err := handleAuthLogout("gitlab", ts.URL); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := handleAuthLogout("gitlab", ts.URL); err == nil {
+		t.Error("Expected an error logging out twice")
+	}
+	if _, err := newClient(&appConfig{service: "gitlab", gitHostURL: ts.URL}); err == nil || !strings.Contains(err.Error(), "gitbackup auth login") {
+		t.Errorf("Expected an error suggesting auth login, got: %v", err)
+	}
+}
+
+func TestAuthLoginBitbucketUsername(t *testing.T) {
+	ring := useTestKeyring(t)
+
+	savedInput := promptInput
+	defer func() { promptInput = savedInput }()
+	promptInput = strings.NewReader("bbuser\nbbtoken\n")
+
+	// Verification fails without a Bitbucket server, but both lines are read
+	handleAuthLogin("bitbucket", "http://127.0.0.1:1", "", true, "")
+	if rest, _ := promptLine("", false); rest != "" {
+		t.Errorf("Expected the username and token to be read, left: %q", rest)
+	}
+	if keys, _ := ring.Keys(); len(keys) != 0 {
+		t.Errorf("Expected unverified credentials not to be stored, got: %v", keys)
+	}
+}
+
+func TestAuthLoginDeviceFlow(t *testing.T) {
+	ring := useTestKeyring(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/device/code", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_id") != "myclientid" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"device_code": "dc", "user_code": "ABCD-1234", "verification_uri": "https://example.com/device", "interval": 1, "expires_in": 60}`)
+	})
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Form.Get("device_code") != "dc" {
+			fmt.Fprint(w, `{"error": "access_denied"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "ghtoken", "token_type": "bearer"}`)
+	})
+	mux.HandleFunc("/api/v3/user", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"login": "ghuser"}`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	if err := handleAuthLogin("github", ts.URL, "", false, "myclientid"); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	cred, err := loadCredential("github", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil || cred == nil || cred.Token != "ghtoken" {
+		t.Fatalf("Expected the device flow token to be stored, got: %+v, %v", cred, err)
+	}
+	if keys, _ := ring.Keys(); len(keys) != 1 {
+		t.Errorf("Expected one stored credential, got: %v", keys)
+	}
+}
+
+func TestLoadCredentialLegacyGitHubKey(t *testing.T) {
+	ring := useTestKeyring(t)
+	ring.Set(keyring.Item{Key: legacyGitHubKeyringKey, Data: []byte("oldtoken")})
+
+	cred, err := loadCredential("github", "github.com")
+	if err != nil || cred == nil || cred.Token != "oldtoken" {
+		t.Fatalf("Expected the legacy token, got: %+v, %v", cred, err)
+	}
+	keys, _ := ring.Keys()
+	if len(keys) != 1 || keys[0] != "github:github.com" {
+		t.Errorf("Expected the legacy token to be moved, got keys: %v", keys)
+	}
+
+	if cred, err := loadCredential("gitlab", "gitlab.com"); err != nil || cred != nil {
+		t.Errorf("Expected no credential, got: %+v, %v", cred, err)
+	}
+}
+
+func TestLoadCredentialRefresh(t *testing.T) {
+	useTestKeyring(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh1" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "token2", "refresh_token": "refresh2", "token_type": "bearer", "expires_in": 7200}`)
+	}))
+	defer ts.Close()
+
+	expired := &storedCredential{
+		Token:        "token1",
+		RefreshToken: "refresh1",
+		Expiry:       time.Now().Add(-time.Hour),
+		ClientID:     "myclientid",
+		TokenURL:     ts.URL,
+	}
+	if err := storeCredential("gitlab", "gitlab.com", expired); err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := loadCredential("gitlab", "gitlab.com")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if cred.Token != "token2" || cred.RefreshToken != "refresh2" || !cred.Expiry.After(time.Now()) {
+		t.Errorf("Expected the token to be refreshed, got: %+v", cred)
+	}
+
+	// The refreshed token is stored
+	ring, _ := openKeyring()
+	item, _ := ring.Get("gitlab:gitlab.com")
+	stored := &storedCredential{}
+	json.Unmarshal(item.Data, stored)
+	if stored.Token != "token2" {
+		t.Errorf("Expected the refreshed token to be stored, got: %+v", stored)
+	}
+}
+
+func TestHasStoredCredential(t *testing.T) {
+	ring := useTestKeyring(t)
+	ring.Set(keyring.Item{Key: legacyGitHubKeyringKey, Data: []byte("oldtoken")})
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+	expired := &storedCredential{
+		Token:        "token1",
+		RefreshToken: "refresh1",
+		Expiry:       time.Now().Add(-time.Hour),
+		TokenURL:     ts.URL,
+	}
+	if err := storeCredential("gitlab", "gitlab.com", expired); err != nil {
+		t.Fatal(err)
+	}
+
+	if !hasStoredCredential("github", "") || !hasStoredCredential("gitlab", "") {
+		t.Error("Expected the stored credentials to be found")
+	}
+	if hasStoredCredential("forgejo", "") || hasStoredCredential("github", "https://github.example.com") {
+		t.Error("Expected no credential to be found")
+	}
+
+	// Neither the legacy token is moved, nor the expired token refreshed
+	keys, _ := ring.Keys()
+	if len(keys) != 2 || !contains(keys, legacyGitHubKeyringKey) {
+		t.Errorf("Expected the keyring to be left alone, got keys: %v", keys)
+	}
+	if requests != 0 {
+		t.Errorf("Expected no token refresh, got %d requests", requests)
+	}
+}
+
+func TestAuthGitHostURL(t *testing.T) {
+	ghe, _ := url.Parse("https://ghe.example.com")
+	if got := authGitHostURL("github", ghe); got != "https://ghe.example.com/api/v3/" {
+		t.Errorf("Unexpected GitHub Enterprise URL: %v", got)
+	}
+	public, _ := url.Parse("https://gitlab.com")
+	if got := authGitHostURL("gitlab", public); got != "" {
+		t.Errorf("Expected the default URL for the public host, got: %v", got)
+	}
+}
+
+func TestHandleValidateConfigStoredCredential(t *testing.T) {
+	useTestKeyring(t)
+	t.Setenv("GITLAB_TOKEN", "")
+
+	configPath := t.TempDir() + "/gitbackup.yml"
+	writeFile := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("service: gitlab\ngithost_url: https://gitlab.example.com\ngitlab:\n  project_visibility: private\n  project_membership_type: all\n")
+	if err := handleValidateConfig(configPath); err == nil {
+		t.Fatal("Expected an error without a token")
+	}
+
+	storeCredential("gitlab", "gitlab.example.com", &storedCredential{Token: "gltoken"})
+	if err := handleValidateConfig(configPath); err != nil {
+		t.Errorf("Expected the stored credential to be accepted, got: %v", err)
+	}
+
+	// A token environment variable set in the config must be set
+	writeFile("service: gitlab\ngithost_url: https://gitlab.example.com\ngitlab:\n  project_visibility: private\n  project_membership_type: all\ncredentials:\n  token_env: WORK_GITLAB_TOKEN\n")
+	if err := handleValidateConfig(configPath); err == nil {
+		t.Error("Expected an error when token_env is not set")
+	}
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
-	"sync"
 	"testing"
 
+	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/afero"
 )
 
@@ -37,7 +38,6 @@ func fakeRemoteUpdateCommand(command string, args ...string) (cmd *exec.Cmd) {
 }
 
 func TestBackup(t *testing.T) {
-	var wg sync.WaitGroup
 	repo := Repository{Name: "testrepo", CloneURL: "git://foo.com/foo"}
 	backupDir := "/tmp/backupdir"
 
@@ -47,13 +47,11 @@ func TestBackup(t *testing.T) {
 
 	defer func() {
 		execCommand = exec.Command
-		wg.Wait()
 	}()
 
 	// Test clone
 	execCommand = fakeCloneCommand
-	wg.Add(1)
-	stdoutStderr, err := backUp(backupDir, &repo, false, &wg)
+	_, stdoutStderr, err := backUp(backupDir, &repo, false, nil)
 	if err != nil {
 		t.Errorf("%s", stdoutStderr)
 	}
@@ -62,15 +60,13 @@ func TestBackup(t *testing.T) {
 	repoDir := path.Join(backupDir, repo.Name)
 	appFS.MkdirAll(repoDir, 0771)
 	execCommand = fakePullCommand
-	wg.Add(1)
-	stdoutStderr, err = backUp(backupDir, &repo, false, &wg)
+	_, stdoutStderr, err = backUp(backupDir, &repo, false, nil)
 	if err != nil {
 		t.Errorf("%s", stdoutStderr)
 	}
 }
 
 func TestBareBackup(t *testing.T) {
-	var wg sync.WaitGroup
 	repo := Repository{Name: "testrepo", CloneURL: "git://foo.com/foo"}
 	backupDir := "/tmp/backupdir"
 
@@ -80,13 +76,11 @@ func TestBareBackup(t *testing.T) {
 
 	defer func() {
 		execCommand = exec.Command
-		wg.Wait()
 	}()
 
 	// Test clone
 	execCommand = fakeCloneCommand
-	wg.Add(1)
-	stdoutStderr, err := backUp(backupDir, &repo, true, &wg)
+	_, stdoutStderr, err := backUp(backupDir, &repo, true, nil)
 	if err != nil {
 		t.Errorf("%s", stdoutStderr)
 	}
@@ -95,8 +89,7 @@ func TestBareBackup(t *testing.T) {
 	repoDir := path.Join(backupDir, repo.Name+".git")
 	appFS.MkdirAll(repoDir, 0771)
 	execCommand = fakeRemoteUpdateCommand
-	wg.Add(1)
-	stdoutStderr, err = backUp(backupDir, &repo, true, &wg)
+	_, stdoutStderr, err = backUp(backupDir, &repo, true, nil)
 	if err != nil {
 		t.Errorf("%s", stdoutStderr)
 	}
@@ -234,15 +227,35 @@ func TestSetupBackupDir(t *testing.T) {
 	}
 
 	for _, tc := range testConfigs {
-		backupdir := setupBackupDir(&tc.backupRootDir, &tc.gitService, &tc.gitServiceUrl)
+		backupdir, err := getBackupDir(tc.backupRootDir, tc.gitService, tc.gitServiceUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
 		if backupdir != tc.wantBackupPath {
 			t.Errorf("Expected %s, Got %s", tc.wantBackupPath, backupdir)
 		}
-		_, err := appFS.Stat(backupdir)
+		if err := setupBackupDir(&appConfig{backupDir: backupdir}); err != nil {
+			t.Fatal(err)
+		}
+		_, err = appFS.Stat(backupdir)
 		if err != nil {
 			t.Error(err)
 		}
 	}
+
+	if _, err := getBackupDir(backupRoot, "gitlab", "https://gitlab.example.com:port"); err == nil {
+		t.Error("Expected an error for an invalid githost URL")
+	}
+	gethomeDir = func() (string, error) {
+		return "", errors.New("no home directory")
+	}
+	defer func() { gethomeDir = homedir.Dir }()
+	if _, err := getBackupDir("", "github", ""); err == nil {
+		t.Error("Expected an error without a home directory or backup directory")
+	}
+	if _, err := getBackupDir(backupRoot, "github", ""); err != nil {
+		t.Errorf("Expected the backup directory to be used, got: %v", err)
+	}
 }
 
 func TestCheckGitAvailability(t *testing.T) {
@@ -279,3 +292,21 @@ func TestCheckGitAvailability(t *testing.T) {
 		}
 	})
 }
+
+func TestRepoUpdateChanged(t *testing.T) {
+	tests := []struct {
+		output string
+		bare   bool
+		want   bool
+	}{
+		{"Already up to date.\n", false, false},
+		{"Updating 1a2b3c4..5d6e7f8\nFast-forward\n README.md | 1 +\n", false, true},
+		{"Fetching origin\n", true, false},
+		{"Fetching origin\n   1a2b3c4..5d6e7f8  main       -> main\n", true, true},
+	}
+	for _, tt := range tests {
+		if got := repoUpdateChanged([]byte(tt.output), tt.bare); got != tt.want {
+			t.Errorf("repoUpdateChanged(%q, %v) = %v, want %v", tt.output, tt.bare, got, tt.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"strings"
+	"time"
 
 	bitbucket "github.com/ktrysmt/go-bitbucket"
 )
@@ -36,10 +37,14 @@ func getBitbucketRepositories(
 			cloneURL := getCloneURL(httpsURL, sshURL)
 
 			repositories = append(repositories, &Repository{
+				ID:        repo.Uuid,
 				CloneURL:  cloneURL,
 				Name:      repo.Slug,
 				Namespace: namespace,
 				Private:   repo.Is_private,
+				Fork:      repo.Parent != nil,
+				Language:  repo.Language,
+				PushedAt:  bitbucketUpdatedOn(repo),
 			})
 		}
 	}
@@ -68,3 +73,12 @@ func extractBitbucketCloneURLs(links map[string]interface{}) (httpsURL, sshURL s
 	}
 	return httpsURL, sshURL
 }
+
+// bitbucketUpdatedOn returns when repo was last updated, as Bitbucket does
+// not report when it was last pushed to
+func bitbucketUpdatedOn(repo bitbucket.Repository) time.Time {
+	if repo.UpdatedOnTime != nil {
+		return *repo.UpdatedOnTime
+	}
+	return time.Time{}
+}
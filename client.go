@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,193 +15,235 @@ import (
 	"github.com/google/go-github/v34/github"
 	bitbucket "github.com/ktrysmt/go-bitbucket"
 	gitlab "github.com/xanzy/go-gitlab"
-
-	"github.com/99designs/keyring"
-	"github.com/cli/oauth/device"
 )
 
-var keyringServiceName = "gitbackup-cli"
-var gitbackupClientID = "7b56a77c7dfba0800524"
-
-func startOAuthFlow() string {
-	clientID := gitbackupClientID
-	scopes := []string{"repo", "user", "admin:org"}
-	httpClient := http.DefaultClient
-
-	code, err := device.RequestCode(httpClient, "https://github.com/login/device/code", clientID, scopes)
+// newClient creates a client for the service of the given configuration.
+// The token, token source and HTTP transport used by the client are stored
+// in c so that they can be used for clones and downloads.
+func newClient(c *appConfig) (interface{}, error) {
+	gitHostURLParsed, err := parseGitHostURL(c.gitHostURL, c.service)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	fmt.Printf("Copy code: %s\n", code.UserCode)
-	fmt.Printf("then open: %s\n", code.VerificationURI)
-
-	accessToken, err := device.PollToken(httpClient, "https://github.com/login/oauth/access_token", clientID, code)
+	transport, err := newHTTPTransport(c.http)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid HTTP configuration: %v", err)
 	}
 
-	return accessToken.Token
-}
-
-func saveToken(service string, token string) error {
-	ring, err := keyring.Open(keyring.Config{
-		ServiceName: keyringServiceName,
-	})
-	if err != nil {
-		return err
+	// Use the credentials stored by gitbackup auth login if none were given
+	creds := c.credentials
+	stored := false
+	if !c.githubApp.configured() && !c.anonymous.Enabled && needsStoredCredential(c.service, creds) {
+		creds, stored, err = withStoredCredential(c.service, c.gitHostURL, creds)
+		if err != nil {
+			log.Printf("Error reading credentials from the keyring, continuing without them: %v", err)
+		}
 	}
 
-	err = ring.Set(keyring.Item{
-		Key:  service + "_TOKEN",
-		Data: []byte(token),
-	})
-	return err
-}
-
-func getToken(service string) (string, error) {
-	ring, err := keyring.Open(keyring.Config{
-		ServiceName: keyringServiceName,
-	})
-	if err != nil {
-		return "", err
+	// The API clients wait for rate limits and retry server errors
+	rateLimit := newRateLimitTransport(c.service, transport, c.api)
+
+	var client interface{}
+	var token string
+	var ts oauth2.TokenSource
+	switch {
+	case c.anonymous.Enabled:
+		client, err = newAnonymousClient(c.service, gitHostURLParsed, rateLimit)
+	case c.service == "github":
+		if c.githubApp.configured() {
+			client, token, ts, err = newGitHubAppClient(gitHostURLParsed, c.githubApp, rateLimit)
+		} else {
+			client, token, err = newGitHubClient(gitHostURLParsed, creds, rateLimit)
+		}
+	case c.service == "gitlab":
+		client, token, err = newGitLabClient(gitHostURLParsed, creds, rateLimit)
+	case c.service == "bitbucket":
+		client, token, err = newBitbucketClient(gitHostURLParsed, creds, rateLimit)
+	case c.service == "forgejo":
+		client, token, err = newForgejoClient(gitHostURLParsed, creds, rateLimit)
+	default:
+		return nil, nil
 	}
-	i, err := ring.Get(service + "_TOKEN")
 	if err != nil {
-		return "", err
-	}
-	return string(i.Data), nil
-}
-
-func newClient(service string, gitHostURL string) interface{} {
-	gitHostURLParsed := parseGitHostURL(gitHostURL, service)
-
-	switch service {
-	case "github":
-		return newGitHubClient(gitHostURLParsed)
-	case "gitlab":
-		return newGitLabClient(gitHostURLParsed)
-	case "bitbucket":
-		return newBitbucketClient(gitHostURLParsed)
-	case "forgejo":
-		return newForgejoClient(gitHostURLParsed)
-	default:
-		return nil
+		if !stored && needsStoredCredential(c.service, creds) {
+			return nil, fmt.Errorf("%v, or log in with: gitbackup auth login --service %s", err, c.service)
+		}
+		return nil, err
 	}
+	registerSecret(token)
+	c.token = token
+	c.transport = transport
+	c.tokenSource = ts
+	c.rateLimit = rateLimit
+	return client, nil
 }
 
 // parseGitHostURL parses the git host URL if provided
-func parseGitHostURL(gitHostURL string, service string) *url.URL {
+func parseGitHostURL(gitHostURL string, service string) (*url.URL, error) {
 	if len(gitHostURL) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	gitHostURLParsed, err := url.Parse(gitHostURL)
 	if err != nil {
-		log.Fatalf("Invalid git host URL: %s", gitHostURL)
+		return nil, fmt.Errorf("invalid git host URL: %s", gitHostURL)
 	}
 
 	// Only GitLab requires /api/v4/ to be appended
 	if service == "gitlab" {
 		api, _ := url.Parse("api/v4/")
-		return gitHostURLParsed.ResolveReference(api)
+		return gitHostURLParsed.ResolveReference(api), nil
+	}
+	return gitHostURLParsed, nil
+}
+
+// getCredential returns value if it was set in the config file, otherwise
+// the value of the environment variable envVar if set, otherwise the value
+// of defaultEnvVar. The name of the environment variable read is returned
+// for error messages.
+func getCredential(value, envVar, defaultEnvVar string) (string, string) {
+	if value != "" {
+		return value, ""
+	}
+	if envVar != "" {
+		return os.Getenv(envVar), envVar
 	}
-	return gitHostURLParsed
+	return os.Getenv(defaultEnvVar), defaultEnvVar
 }
 
 // newGitHubClient creates a new GitHub client
-func newGitHubClient(gitHostURLParsed *url.URL) *github.Client {
-	githubToken := getOrCreateGitHubToken()
-	gitHostToken = githubToken
+func newGitHubClient(gitHostURLParsed *url.URL, creds credentialsConfig, transport http.RoundTripper) (*github.Client, string, error) {
+	var githubToken string
+	if creds.Token != "" {
+		githubToken = creds.Token
+	} else if creds.TokenEnv != "" {
+		githubToken = os.Getenv(creds.TokenEnv)
+		if githubToken == "" {
+			return nil, "", fmt.Errorf("%s environment variable not set", creds.TokenEnv)
+		}
+	} else {
+		var err error
+		githubToken, err = getOrCreateGitHubToken(gitHostURLParsed)
+		if err != nil {
+			return nil, "", err
+		}
+	}
 
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: githubToken},
 	)
-	tc := oauth2.NewClient(context.Background(), ts)
+	ctx := context.Background()
+	if transport != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+	}
+	tc := oauth2.NewClient(ctx, ts)
+	tc.Transport = instrumentTransport("github", tc.Transport)
 	client := github.NewClient(tc)
 
 	if gitHostURLParsed != nil {
 		client.BaseURL = gitHostURLParsed
 	}
-	return client
+	return client, githubToken, nil
 }
 
-// getOrCreateGitHubToken retrieves or creates a GitHub token
-func getOrCreateGitHubToken() string {
+// getOrCreateGitHubToken returns the token in the GITHUB_TOKEN environment
+// variable. Without one, the token for github.com is obtained with the device
+// flow and stored in the keyring.
+func getOrCreateGitHubToken(gitHostURLParsed *url.URL) (string, error) {
 	githubToken := os.Getenv("GITHUB_TOKEN")
 	if githubToken != "" {
-		return githubToken
+		return githubToken, nil
+	}
+	if gitHostURLParsed != nil {
+		return "", errors.New("GITHUB_TOKEN environment variable not set")
 	}
 
-	githubToken, err := getToken("GITHUB")
+	hostURL, _ := parseAuthHost("github", "")
+	flow, _ := deviceFlowFor("github", hostURL)
+	cred, err := startDeviceFlow(flow, gitbackupClientID)
 	if err != nil {
-		githubToken = startOAuthFlow()
+		return "", err
 	}
-
-	if githubToken == "" {
-		log.Fatal("GitHub token not available")
+	if cred.Token == "" {
+		return "", errors.New("GitHub token not available")
 	}
 
-	err = saveToken("GITHUB", githubToken)
+	// The token can still be used if it cannot be stored
+	err = storeCredential("github", hostURL.Host, cred)
 	if err != nil {
-		log.Fatal("Error saving token")
+		log.Printf("Could not save the token to the keyring, you will need to authorize gitbackup again next time: %v", err)
+		log.Printf("Set GITHUB_TOKEN or select a keyring backend with --keyring.backend to avoid this")
 	}
 
-	return githubToken
+	return cred.Token, nil
 }
 
 // newGitLabClient creates a new GitLab client
-func newGitLabClient(gitHostURLParsed *url.URL) *gitlab.Client {
-	gitlabToken := os.Getenv("GITLAB_TOKEN")
+func newGitLabClient(gitHostURLParsed *url.URL, creds credentialsConfig, transport http.RoundTripper) (*gitlab.Client, string, error) {
+	gitlabToken, envVar := getCredential(creds.Token, creds.TokenEnv, "GITLAB_TOKEN")
 	if gitlabToken == "" {
-		log.Fatal("GITLAB_TOKEN environment variable not set")
+		return nil, "", fmt.Errorf("%s environment variable not set", envVar)
 	}
-	gitHostToken = gitlabToken
 
 	var baseUrlOption gitlab.ClientOptionFunc
 	if gitHostURLParsed != nil {
 		baseUrlOption = gitlab.WithBaseURL(gitHostURLParsed.String())
 	}
 
-	client, err := gitlab.NewClient(gitlabToken, baseUrlOption)
+	httpClient := &http.Client{Transport: instrumentTransport("gitlab", transport)}
+	client, err := gitlab.NewClient(gitlabToken, baseUrlOption, gitlab.WithHTTPClient(httpClient))
 	if err != nil {
-		log.Fatalf("Error creating gitlab client: %v", err)
+		return nil, "", fmt.Errorf("error creating gitlab client: %v", err)
 	}
-	return client
+	return client, gitlabToken, nil
 }
 
 // newBitbucketClient creates a new Bitbucket client
-func newBitbucketClient(gitHostURLParsed *url.URL) *bitbucket.Client {
-	bitbucketUsername := os.Getenv("BITBUCKET_USERNAME")
+func newBitbucketClient(gitHostURLParsed *url.URL, creds credentialsConfig, transport http.RoundTripper) (*bitbucket.Client, string, error) {
+	bitbucketUsername, envVar := getCredential(creds.Username, creds.UsernameEnv, "BITBUCKET_USERNAME")
 	if bitbucketUsername == "" {
-		log.Fatal("BITBUCKET_USERNAME environment variable not set")
+		return nil, "", fmt.Errorf("%s environment variable not set", envVar)
 	}
 
-	bitbucketPasswordOrToken := os.Getenv("BITBUCKET_TOKEN")
-	if bitbucketPasswordOrToken == "" {
-		bitbucketPasswordOrToken = os.Getenv("BITBUCKET_PASSWORD")
-	}
-	if bitbucketPasswordOrToken == "" {
-		log.Fatal("BITBUCKET_TOKEN or BITBUCKET_PASSWORD environment variable not set")
+	var bitbucketPasswordOrToken string
+	if creds.Token != "" {
+		bitbucketPasswordOrToken = creds.Token
+	} else if creds.TokenEnv != "" {
+		bitbucketPasswordOrToken = os.Getenv(creds.TokenEnv)
+		if bitbucketPasswordOrToken == "" {
+			return nil, "", fmt.Errorf("%s environment variable not set", creds.TokenEnv)
+		}
+	} else {
+		bitbucketPasswordOrToken = os.Getenv("BITBUCKET_TOKEN")
+		if bitbucketPasswordOrToken == "" {
+			bitbucketPasswordOrToken = os.Getenv("BITBUCKET_PASSWORD")
+		}
+		if bitbucketPasswordOrToken == "" {
+			return nil, "", errors.New("BITBUCKET_TOKEN or BITBUCKET_PASSWORD environment variable not set")
+		}
 	}
 
-	gitHostToken = bitbucketPasswordOrToken
 	client, err := bitbucket.NewBasicAuth(bitbucketUsername, bitbucketPasswordOrToken)
 	if err != nil {
-		log.Fatalf("Error creating Bitbucket client: %v", err)
+		return nil, "", fmt.Errorf("error creating Bitbucket client: %v", err)
+	}
+	if transport != nil {
+		client.HttpClient.Transport = transport
 	}
+	client.HttpClient.Transport = instrumentTransport("bitbucket", client.HttpClient.Transport)
 
 	if gitHostURLParsed != nil {
 		client.SetApiBaseURL(*gitHostURLParsed)
 	}
-	return client
+	return client, bitbucketPasswordOrToken, nil
 }
 
 // newForgejoClient creates a new Forgejo client.
-func newForgejoClient(gitHostURLParsed *url.URL) *forgejo.Client {
-	forgejoToken := os.Getenv("FORGEJO_TOKEN")
+func newForgejoClient(gitHostURLParsed *url.URL, creds credentialsConfig, transport http.RoundTripper) (*forgejo.Client, string, error) {
+	forgejoToken, envVar := getCredential(creds.Token, creds.TokenEnv, "FORGEJO_TOKEN")
 	if forgejoToken == "" {
-		log.Fatal("FORGEJO_TOKEN environment variable not set")
+		return nil, "", fmt.Errorf("%s environment variable not set", envVar)
 	}
 
 	url := "https://" + knownServices["forgejo"]
@@ -208,13 +251,12 @@ func newForgejoClient(gitHostURLParsed *url.URL) *forgejo.Client {
 		url = gitHostURLParsed.String()
 	}
 
-	gitHostToken = forgejoToken
-
 	log.Println("Creating forgejo client", url)
-	client, err := forgejo.NewClient(url, forgejo.SetToken(forgejoToken), forgejo.SetForgejoVersion(""))
+	httpClient := &http.Client{Transport: instrumentTransport("forgejo", transport)}
+	client, err := forgejo.NewClient(url, forgejo.SetToken(forgejoToken), forgejo.SetForgejoVersion(""), forgejo.SetHTTPClient(httpClient))
 	if err != nil {
-		log.Fatalf("Error creating forgejo client: %v", err)
+		return nil, "", fmt.Errorf("error creating forgejo client: %v", err)
 	}
 
-	return client
+	return client, forgejoToken, nil
 }
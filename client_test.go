@@ -21,47 +21,80 @@ func TestNewClient(t *testing.T) {
 	expectedGitLabBaseURL := customGitHost.ResolveReference(api)
 
 	// Client for github.com
-	client := newClient("github", "")
+	client := mustNewClient(t, "github", "")
 	client = client.(*github.Client)
 
 	// Client for Enterprise Github - should use the URL as-is, not append /api/v4/
-	client = newClient("github", customGitHost.String())
+	client = mustNewClient(t, "github", customGitHost.String())
 	gotBaseURL := client.(*github.Client).BaseURL
 	if gotBaseURL.String() != customGitHost.String() {
 		t.Errorf("Expected BaseURL to be: %v, Got: %v\n", customGitHost, gotBaseURL)
 	}
 
 	// Client for gitlab.com
-	client = newClient("gitlab", "")
+	client = mustNewClient(t, "gitlab", "")
 	client = client.(*gitlab.Client)
 
 	// Client for custom gitlab installation - should append /api/v4/
-	client = newClient("gitlab", customGitHost.String())
+	client = mustNewClient(t, "gitlab", customGitHost.String())
 	gotBaseURL = client.(*gitlab.Client).BaseURL()
 	if gotBaseURL.String() != expectedGitLabBaseURL.String() {
 		t.Errorf("Expected BaseURL to be: %v, Got: %v\n", expectedGitLabBaseURL, gotBaseURL)
 	}
 
 	// Client for bitbucket.com
-	client = newClient("bitbucket", "")
+	client = mustNewClient(t, "bitbucket", "")
 	client = client.(*bitbucket.Client)
 
 	// Client for codeberg
-	client = newClient("forgejo", "")
+	client = mustNewClient(t, "forgejo", "")
 	client = client.(*forgejo.Client)
 
 	// Client for forgejo
-	client = newClient("forgejo", customGitHost.String())
+	client = mustNewClient(t, "forgejo", customGitHost.String())
 	client = client.(*forgejo.Client)
 
 	// Not yet supported
-	client = newClient("notyetsupported", "")
+	client = mustNewClient(t, "notyetsupported", "")
 	if client != nil {
 		t.Errorf("Expected nil")
 	}
 
 }
 
+// mustNewClient creates a client for service and fails the test on error
+func mustNewClient(t *testing.T, service, gitHostURL string) interface{} {
+	t.Helper()
+	client, err := newClient(&appConfig{service: service, gitHostURL: gitHostURL})
+	if err != nil {
+		t.Fatalf("Expected no error creating %s client, got: %v", service, err)
+	}
+	return client
+}
+
+func TestNewClientCredentialsEnv(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	os.Setenv("WORK_GITLAB_TOKEN", "worktoken")
+	defer os.Unsetenv("WORK_GITLAB_TOKEN")
+
+	c := &appConfig{service: "gitlab", credentials: credentialsConfig{TokenEnv: "WORK_GITLAB_TOKEN"}}
+	client, err := newClient(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	_ = client.(*gitlab.Client)
+	if c.token != "worktoken" {
+		t.Errorf("Expected token from WORK_GITLAB_TOKEN, got: %v", c.token)
+	}
+
+	c = &appConfig{service: "gitlab", credentials: credentialsConfig{TokenEnv: "UNSET_GITLAB_TOKEN"}}
+	if _, err := newClient(c); err == nil {
+		t.Error("Expected an error when the token environment variable is not set")
+	}
+}
+
 func TestNewBitbucketClientWithToken(t *testing.T) {
 	setupRepositoryTests()
 	defer teardownRepositoryTests()
@@ -71,13 +104,17 @@ func TestNewBitbucketClientWithToken(t *testing.T) {
 	os.Unsetenv("BITBUCKET_PASSWORD")
 	defer os.Unsetenv("BITBUCKET_TOKEN")
 
-	client := newClient("bitbucket", "")
+	c := &appConfig{service: "bitbucket"}
+	client, err := newClient(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
 	if client == nil {
 		t.Fatal("Expected non-nil bitbucket client")
 	}
 	_ = client.(*bitbucket.Client)
 
-	if gitHostToken != "$$$randomtoken" {
-		t.Errorf("Expected gitHostToken to be BITBUCKET_TOKEN value, got: %v", gitHostToken)
+	if c.token != "$$$randomtoken" {
+		t.Errorf("Expected the token of the config to be BITBUCKET_TOKEN value, got: %v", c.token)
 	}
 }
@@ -1,7 +1,16 @@
 package main
 
+import (
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
 // appConfig holds the application configuration
 type appConfig struct {
+	// name identifies the target in logs, metrics and notifications when
+	// several targets are configured
+	name          string
 	service       string
 	gitHostURL    string
 	backupDir     string
@@ -10,9 +19,33 @@ type appConfig struct {
 	useHTTPSClone bool
 	bare          bool
 
+	// starredSubdir is the directory below backupDir which starred
+	// repositories are backed up to, if set
+	starredSubdir string
+
+	// layout is the template of the directories repositories are backed up
+	// to, relative to backupRoot, the backup directory without the host.
+	// The default layout is used when it is empty.
+	layout     string
+	backupRoot string
+
+	// anonymous backs up public repositories without credentials
+	anonymous anonymousConfig
+
+	// filter selects the repositories to back up by their namespace/name,
+	// explain logs which rule selected or skipped each repository
+	filter  filterConfig
+	explain bool
+
+	// dryRun lists the repositories without backing them up, and without
+	// writing anything to the backup directory
+	dryRun bool
+
 	// GitHub specific configuration
 	githubRepoType                    string
 	githubNamespaceWhitelist          []string
+	githubApp                         githubAppConfig
+	githubOwners                      githubOwnersConfig
 	githubCreateUserMigration         bool
 	githubCreateUserMigrationRetry    bool
 	githubCreateUserMigrationRetryMax int
@@ -22,7 +55,42 @@ type appConfig struct {
 	// GitLab specific configuration
 	gitlabProjectVisibility     string
 	gitlabProjectMembershipType string
+	gitlabGroups                gitlabGroupsConfig
 
 	// Forgejo specific configuration
 	forgejoRepoType string
+
+	// credentials overrides the environment variables the token and
+	// username are read from
+	credentials credentialsConfig
+
+	// ssh configures the ssh command used for SSH clones
+	ssh sshConfig
+
+	// http configures the proxy and TLS settings of the connections to the service
+	http httpConfig
+
+	// api configures the retries of rate limited and failed API requests
+	api apiConfig
+
+	// rateLimit tracks the API rate limit of the service, set by newClient
+	rateLimit *rateLimitTransport
+
+	// token is the token used to access the service, set by newClient
+	token string
+
+	// transport is the HTTP transport used to access the service, set by
+	// newClient. It is nil when the default transport is used.
+	transport http.RoundTripper
+
+	// tokenSource provides the current token when it expires during a
+	// run, such as GitHub App installation tokens. Set by newClient.
+	tokenSource oauth2.TokenSource
+
+	// Notifications are only configurable in the config file
+	notifications notificationsConfig
+
+	// hooks are the commands run around the backup of the target and of
+	// each repository, only configurable in the config file
+	hooks hooksConfig
 }
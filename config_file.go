@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -36,56 +37,126 @@ func resolveConfigPath(configPath string) (string, error) {
 // Migration-related flags are intentionally excluded as they
 // are one-off operations better suited to CLI flags.
 type fileConfig struct {
-	Service       string        `yaml:"service"`
-	GitHostURL    string        `yaml:"githost_url"`
-	BackupDir     string        `yaml:"backup_dir"`
-	IgnorePrivate bool          `yaml:"ignore_private"`
-	IgnoreFork    bool          `yaml:"ignore_fork"`
-	UseHTTPSClone bool          `yaml:"use_https_clone"`
-	Bare          bool          `yaml:"bare"`
-	GitHub        githubConfig  `yaml:"github"`
-	GitLab        gitlabConfig  `yaml:"gitlab"`
-	Forgejo       forgejoConfig `yaml:"forgejo"`
+	targetConfig `yaml:",inline"`
+
+	// Targets configures several services or hosts to back up in one run.
+	// When targets are configured, the top-level target settings are ignored.
+	Targets  []targetConfig `yaml:"targets,omitempty"`
+	Parallel bool           `yaml:"parallel,omitempty"`
+
+	// Vault configures the backend of vault: secret references
+	Vault *vaultConfig `yaml:"vault,omitempty"`
+
+	Notifications notificationsConfig `yaml:"notifications,omitempty"`
+}
+
+// targetConfig holds the settings of a single service or host to back up
+type targetConfig struct {
+	Name          string            `yaml:"name,omitempty"`
+	Service       string            `yaml:"service"`
+	GitHostURL    string            `yaml:"githost_url"`
+	BackupDir     string            `yaml:"backup_dir"`
+	IgnorePrivate bool              `yaml:"ignore_private"`
+	IgnoreFork    bool              `yaml:"ignore_fork"`
+	UseHTTPSClone bool              `yaml:"use_https_clone"`
+	Bare          bool              `yaml:"bare"`
+	StarredSubdir string            `yaml:"starred_subdir,omitempty"`
+	Layout        string            `yaml:"layout,omitempty"`
+	Anonymous     anonymousConfig   `yaml:"anonymous,omitempty"`
+	Filter        filterConfig      `yaml:",inline"`
+	GitHub        githubConfig      `yaml:"github"`
+	GitLab        gitlabConfig      `yaml:"gitlab"`
+	Forgejo       forgejoConfig     `yaml:"forgejo"`
+	Credentials   credentialsConfig `yaml:"credentials,omitempty"`
+	SSH           sshConfig         `yaml:"ssh,omitempty"`
+	HTTP          httpConfig        `yaml:"http,omitempty"`
+	API           apiConfig         `yaml:"api,omitempty"`
+	Hooks         hooksConfig       `yaml:"hooks,omitempty"`
+}
+
+// credentialsConfig sets the credentials of a target, or overrides the
+// environment variables which they are read from. Token and Username may
+// be secret references, see resolveSecret.
+type credentialsConfig struct {
+	Token       string `yaml:"token,omitempty"`
+	TokenEnv    string `yaml:"token_env,omitempty"`
+	Username    string `yaml:"username,omitempty"`
+	UsernameEnv string `yaml:"username_env,omitempty"`
+	// ExpiryWarningDays is how many days before the token expires
+	// gitbackup warns about it, 0 disables the warning
+	ExpiryWarningDays *int `yaml:"expiry_warning_days,omitempty"`
+}
+
+func (c credentialsConfig) expiryWarningDays() int {
+	if c.ExpiryWarningDays == nil {
+		return defaultTokenExpiryWarningDays
+	}
+	return *c.ExpiryWarningDays
 }
 
 type githubConfig struct {
-	RepoType           string   `yaml:"repo_type"`
-	NamespaceWhitelist []string `yaml:"namespace_whitelist"`
+	RepoType           repoTypeList    `yaml:"repo_type"`
+	NamespaceWhitelist []string        `yaml:"namespace_whitelist"`
+	App                githubAppConfig `yaml:"app,omitempty"`
+
+	githubOwnersConfig `yaml:",inline"`
 }
 
 type gitlabConfig struct {
-	ProjectVisibility     string `yaml:"project_visibility"`
-	ProjectMembershipType string `yaml:"project_membership_type"`
+	ProjectVisibility     string       `yaml:"project_visibility"`
+	ProjectMembershipType repoTypeList `yaml:"project_membership_type"`
+
+	gitlabGroupsConfig `yaml:",inline"`
 }
 
 type forgejoConfig struct {
-	RepoType string `yaml:"repo_type"`
+	RepoType repoTypeList `yaml:"repo_type"`
 }
 
 // defaultFileConfig returns a fileConfig with the same defaults as the CLI flags
 func defaultFileConfig() fileConfig {
 	return fileConfig{
-		Service:       "github",
-		GitHostURL:    "",
-		BackupDir:     "",
-		IgnorePrivate: false,
-		IgnoreFork:    false,
-		UseHTTPSClone: false,
-		Bare:          false,
-		GitHub: githubConfig{
-			RepoType:           "all",
-			NamespaceWhitelist: []string{},
-		},
-		GitLab: gitlabConfig{
-			ProjectVisibility:     "internal",
-			ProjectMembershipType: "all",
-		},
-		Forgejo: forgejoConfig{
-			RepoType: "user",
+		targetConfig: targetConfig{
+			Service:       "github",
+			GitHostURL:    "",
+			BackupDir:     "",
+			IgnorePrivate: false,
+			IgnoreFork:    false,
+			UseHTTPSClone: false,
+			Bare:          false,
+			GitHub: githubConfig{
+				RepoType:           "all",
+				NamespaceWhitelist: []string{},
+			},
+			GitLab: gitlabConfig{
+				ProjectVisibility:     "internal",
+				ProjectMembershipType: "all",
+			},
+			Forgejo: forgejoConfig{
+				RepoType: "user",
+			},
 		},
 	}
 }
 
+// applyTargetDefaults sets the service-specific settings which are not
+// set in a target to the same defaults as the CLI flags
+func applyTargetDefaults(t *targetConfig) {
+	defaults := defaultFileConfig()
+	if t.GitHub.RepoType == "" {
+		t.GitHub.RepoType = defaults.GitHub.RepoType
+	}
+	if t.GitLab.ProjectVisibility == "" {
+		t.GitLab.ProjectVisibility = defaults.GitLab.ProjectVisibility
+	}
+	if t.GitLab.ProjectMembershipType == "" {
+		t.GitLab.ProjectMembershipType = defaults.GitLab.ProjectMembershipType
+	}
+	if t.Forgejo.RepoType == "" {
+		t.Forgejo.RepoType = defaults.Forgejo.RepoType
+	}
+}
+
 // handleInitConfig creates a default gitbackup.yml at the given path,
 // or at the OS-specific default location if configPath is empty.
 func handleInitConfig(configPath string) error {
@@ -125,19 +196,39 @@ func handleInitConfig(configPath string) error {
 // Migration-related fields are left at their zero values since they
 // are CLI-only flags.
 func fileConfigToAppConfig(fc *fileConfig) *appConfig {
+	return targetConfigToAppConfig(&fc.targetConfig, fc)
+}
+
+// targetConfigToAppConfig converts a target of the config file into an
+// appConfig, including the settings shared by all targets.
+func targetConfigToAppConfig(t *targetConfig, fc *fileConfig) *appConfig {
 	return &appConfig{
-		service:                     fc.Service,
-		gitHostURL:                  fc.GitHostURL,
-		backupDir:                   fc.BackupDir,
-		ignorePrivate:               fc.IgnorePrivate,
-		ignoreFork:                  fc.IgnoreFork,
-		useHTTPSClone:               fc.UseHTTPSClone,
-		bare:                        fc.Bare,
-		githubRepoType:              fc.GitHub.RepoType,
-		githubNamespaceWhitelist:    fc.GitHub.NamespaceWhitelist,
-		gitlabProjectVisibility:     fc.GitLab.ProjectVisibility,
-		gitlabProjectMembershipType: fc.GitLab.ProjectMembershipType,
-		forgejoRepoType:             fc.Forgejo.RepoType,
+		name:                        t.Name,
+		service:                     t.Service,
+		gitHostURL:                  t.GitHostURL,
+		backupDir:                   t.BackupDir,
+		ignorePrivate:               t.IgnorePrivate,
+		ignoreFork:                  t.IgnoreFork,
+		useHTTPSClone:               t.UseHTTPSClone,
+		bare:                        t.Bare,
+		starredSubdir:               t.StarredSubdir,
+		layout:                      t.Layout,
+		anonymous:                   t.Anonymous,
+		filter:                      t.Filter,
+		githubRepoType:              string(t.GitHub.RepoType),
+		githubNamespaceWhitelist:    t.GitHub.NamespaceWhitelist,
+		githubApp:                   t.GitHub.App,
+		githubOwners:                t.GitHub.githubOwnersConfig,
+		gitlabProjectVisibility:     t.GitLab.ProjectVisibility,
+		gitlabProjectMembershipType: string(t.GitLab.ProjectMembershipType),
+		gitlabGroups:                t.GitLab.gitlabGroupsConfig,
+		forgejoRepoType:             string(t.Forgejo.RepoType),
+		credentials:                 t.Credentials,
+		ssh:                         t.SSH,
+		http:                        t.HTTP,
+		api:                         t.API,
+		hooks:                       t.Hooks,
+		notifications:               fc.Notifications,
 	}
 }
 
@@ -154,11 +245,31 @@ func loadConfigFile(configPath string) (*fileConfig, error) {
 		return nil, fmt.Errorf("error reading %s: %v", path, err)
 	}
 
-	var cfg fileConfig
-	err = yaml.Unmarshal(data, &cfg)
+	var root yaml.Node
+	err = yaml.Unmarshal(data, &root)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	err = interpolateEnv(&root)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing %s: %v", path, err)
 	}
+
+	var cfg fileConfig
+	if len(root.Content) > 0 {
+		err = root.Decode(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", path, err)
+		}
+	}
+	for i := range cfg.Targets {
+		applyTargetDefaults(&cfg.Targets[i])
+	}
+
+	err = resolveConfigSecrets(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving secrets in %s: %v", path, err)
+	}
 	return &cfg, nil
 }
 
@@ -175,63 +286,156 @@ func handleValidateConfig(configPath string) error {
 		return err
 	}
 
+	errors := validateFileConfig(cfg)
+	if len(errors) > 0 {
+		fmt.Println("Validation errors:")
+		for _, e := range errors {
+			fmt.Printf("  - %s\n", e)
+		}
+		return fmt.Errorf("config validation failed")
+	}
+
+	fmt.Printf("%s is valid\n", path)
+	return nil
+}
+
+// validateFileConfig returns the problems found in a config file
+func validateFileConfig(cfg *fileConfig) []string {
+	var errors []string
+
+	if len(cfg.Targets) == 0 {
+		errors = append(errors, validateTargetConfig("", &cfg.targetConfig)...)
+	}
+
+	names := map[string]bool{}
+	for i := range cfg.Targets {
+		t := &cfg.Targets[i]
+		prefix := fmt.Sprintf("targets[%d]: ", i)
+		if t.Name == "" {
+			errors = append(errors, prefix+"name is required")
+		} else if names[t.Name] {
+			errors = append(errors, fmt.Sprintf("%sduplicate target name: %q", prefix, t.Name))
+		}
+		names[t.Name] = true
+		errors = append(errors, validateTargetConfig(prefix, t)...)
+	}
+
+	errors = append(errors, validateNotificationsConfig(cfg.Notifications)...)
+	return errors
+}
+
+// validateTargetConfig returns the problems found in the settings of a
+// target, each prefixed with prefix
+func validateTargetConfig(prefix string, t *targetConfig) []string {
 	var errors []string
 
 	// Validate service
-	if _, ok := knownServices[cfg.Service]; !ok {
-		errors = append(errors, fmt.Sprintf("invalid service: %q (must be github, gitlab, bitbucket, or forgejo)", cfg.Service))
+	if _, ok := knownServices[t.Service]; !ok {
+		errors = append(errors, fmt.Sprintf("%sinvalid service: %q (must be github, gitlab, bitbucket, or forgejo)", prefix, t.Service))
 	}
 
 	// Validate service-specific field values
-	switch cfg.Service {
+	switch t.Service {
 	case "github":
-		if !contains([]string{"all", "owner", "member", "starred"}, cfg.GitHub.RepoType) {
-			errors = append(errors, fmt.Sprintf("invalid github.repo_type: %q (must be all, owner, member, or starred)", cfg.GitHub.RepoType))
+		repoType := string(t.GitHub.RepoType)
+		if e := validateRepoTypes("github.repo_type", repoType, githubRepoTypes); e != "" {
+			errors = append(errors, prefix+e)
+		} else if repoType == "none" && !t.Anonymous.Enabled && len(t.GitHub.Orgs) == 0 && len(t.GitHub.Users) == 0 {
+			errors = append(errors, prefix+"github.repo_type none requires github.orgs or github.users")
+		} else {
+			for _, e := range validateGithubAppConfig(t.GitHub.App, repoType) {
+				errors = append(errors, prefix+e)
+			}
+		}
+		for _, e := range validateGithubOwners(t.GitHub.githubOwnersConfig) {
+			errors = append(errors, prefix+e)
 		}
 	case "gitlab":
-		if !contains([]string{"internal", "public", "private"}, cfg.GitLab.ProjectVisibility) {
-			errors = append(errors, fmt.Sprintf("invalid gitlab.project_visibility: %q (must be internal, public, or private)", cfg.GitLab.ProjectVisibility))
+		if !contains([]string{"internal", "public", "private"}, t.GitLab.ProjectVisibility) {
+			errors = append(errors, fmt.Sprintf("%sinvalid gitlab.project_visibility: %q (must be internal, public, or private)", prefix, t.GitLab.ProjectVisibility))
+		}
+		if e := validateRepoTypes("gitlab.project_membership_type", string(t.GitLab.ProjectMembershipType), gitlabMembershipTypes); e != "" {
+			errors = append(errors, prefix+e)
 		}
-		if !validGitlabProjectMembership(cfg.GitLab.ProjectMembershipType) {
-			errors = append(errors, fmt.Sprintf("invalid gitlab.project_membership_type: %q (must be all, owner, member, or starred)", cfg.GitLab.ProjectMembershipType))
+		if t.GitLab.ProjectMembershipType == "none" && len(t.GitLab.Groups) == 0 {
+			errors = append(errors, prefix+"gitlab.project_membership_type none requires gitlab.groups")
 		}
 	case "forgejo":
-		if !contains([]string{"user", "starred"}, cfg.Forgejo.RepoType) {
-			errors = append(errors, fmt.Sprintf("invalid forgejo.repo_type: %q (must be user or starred)", cfg.Forgejo.RepoType))
+		if e := validateRepoTypes("forgejo.repo_type", string(t.Forgejo.RepoType), forgejoRepoTypes); e != "" {
+			errors = append(errors, prefix+e)
 		}
 	}
 
+	if e := validateStarredSubdir(t.StarredSubdir); e != "" {
+		errors = append(errors, prefix+e)
+	}
+	for _, e := range validateLayout(t.Layout, t.StarredSubdir) {
+		errors = append(errors, prefix+e)
+	}
+	for _, e := range validateFilterConfig(t.Filter, t.Service) {
+		errors = append(errors, prefix+e)
+	}
+	for _, e := range validateAnonymousConfig(t.Anonymous, t.Service, t.GitHub.githubOwnersConfig, t.GitLab.gitlabGroupsConfig) {
+		errors = append(errors, prefix+e)
+	}
+	if t.Anonymous.Enabled && t.GitHub.App.configured() {
+		errors = append(errors, prefix+"anonymous cannot be used with github.app")
+	}
+	for _, e := range validateSSHConfig(t.SSH) {
+		errors = append(errors, prefix+e)
+	}
+	for _, e := range validateHTTPConfig(t.HTTP) {
+		errors = append(errors, prefix+e)
+	}
+	for _, e := range validateAPIConfig(t.API) {
+		errors = append(errors, prefix+e)
+	}
+	for _, e := range validateHooksConfig(t.Hooks) {
+		errors = append(errors, prefix+e)
+	}
+	if t.Credentials.expiryWarningDays() < 0 {
+		errors = append(errors, prefix+"credentials.expiry_warning_days must not be negative")
+	}
+
+	// Anonymous targets are backed up without credentials
+	if t.Anonymous.Enabled {
+		return errors
+	}
+
 	// Validate required environment variables
-	switch cfg.Service {
-	case "github":
-		if os.Getenv("GITHUB_TOKEN") == "" {
-			errors = append(errors, "GITHUB_TOKEN environment variable not set")
+	tokenEnv := t.Credentials.TokenEnv
+	switch t.Service {
+	case "github", "gitlab", "forgejo":
+		if t.Credentials.Token != "" || (t.Service == "github" && t.GitHub.App.configured()) {
+			break
 		}
-	case "gitlab":
-		if os.Getenv("GITLAB_TOKEN") == "" {
-			errors = append(errors, "GITLAB_TOKEN environment variable not set")
+		if tokenEnv == "" {
+			tokenEnv = strings.ToUpper(t.Service) + "_TOKEN"
+		}
+		if os.Getenv(tokenEnv) == "" && (t.Credentials.TokenEnv != "" || !hasStoredCredential(t.Service, t.GitHostURL)) {
+			errors = append(errors, fmt.Sprintf("%s%s environment variable not set", prefix, tokenEnv))
 		}
 	case "bitbucket":
-		if os.Getenv("BITBUCKET_USERNAME") == "" {
-			errors = append(errors, "BITBUCKET_USERNAME environment variable not set")
+		if t.Credentials.Token == "" && t.Credentials.TokenEnv == "" && hasStoredCredential(t.Service, t.GitHostURL) {
+			break
 		}
-		if os.Getenv("BITBUCKET_TOKEN") == "" && os.Getenv("BITBUCKET_PASSWORD") == "" {
-			errors = append(errors, "BITBUCKET_TOKEN or BITBUCKET_PASSWORD environment variable must be set")
+		usernameEnv := t.Credentials.UsernameEnv
+		if usernameEnv == "" {
+			usernameEnv = "BITBUCKET_USERNAME"
 		}
-	case "forgejo":
-		if os.Getenv("FORGEJO_TOKEN") == "" {
-			errors = append(errors, "FORGEJO_TOKEN environment variable not set")
+		if t.Credentials.Username == "" && os.Getenv(usernameEnv) == "" {
+			errors = append(errors, fmt.Sprintf("%s%s environment variable not set", prefix, usernameEnv))
 		}
-	}
-
-	if len(errors) > 0 {
-		fmt.Println("Validation errors:")
-		for _, e := range errors {
-			fmt.Printf("  - %s\n", e)
+		if t.Credentials.Token != "" {
+			break
+		}
+		if tokenEnv != "" {
+			if os.Getenv(tokenEnv) == "" {
+				errors = append(errors, fmt.Sprintf("%s%s environment variable not set", prefix, tokenEnv))
+			}
+		} else if os.Getenv("BITBUCKET_TOKEN") == "" && os.Getenv("BITBUCKET_PASSWORD") == "" {
+			errors = append(errors, prefix+"BITBUCKET_TOKEN or BITBUCKET_PASSWORD environment variable must be set")
 		}
-		return fmt.Errorf("config validation failed")
 	}
-
-	fmt.Printf("%s is valid\n", path)
-	return nil
+	return errors
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/urfave/cli/v2"
@@ -143,6 +144,23 @@ func TestHandleValidateConfigMissingEnvVar(t *testing.T) {
 	}
 }
 
+func TestHandleValidateConfigAnonymous(t *testing.T) {
+	ring := useTestKeyring(t)
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+
+	// No token is needed, in the environment or the keyring
+	os.WriteFile(configPath, []byte("service: github\ngithub:\n  repo_type: all\nanonymous:\n  enabled: true\n  owners: [golang]\n"), 0644)
+	os.Unsetenv("GITHUB_TOKEN")
+
+	if err := handleValidateConfig(configPath); err != nil {
+		t.Fatalf("Expected an anonymous target to be valid without credentials, got: %v", err)
+	}
+	if keys, _ := ring.Keys(); len(keys) != 0 {
+		t.Errorf("Expected no credentials to be stored, got: %v", keys)
+	}
+}
+
 func TestInitConfigWithConfigFile(t *testing.T) {
 	tmpDir := t.TempDir()
 	configPath := filepath.Join(tmpDir, defaultConfigFile)
@@ -232,3 +250,266 @@ func TestHandleValidateConfigInvalidRepoType(t *testing.T) {
 		t.Fatal("Expected validation error for invalid repo_type")
 	}
 }
+
+// buildTestConfigs is like buildTestConfig, but returns the configuration
+// of every target produced by buildConfigs.
+func buildTestConfigs(args []string) ([]*appConfig, bool, error) {
+	var result []*appConfig
+	var parallel bool
+	var buildErr error
+
+	app := &cli.App{
+		Name:  "gitbackup",
+		Flags: appFlags(),
+		Action: func(cCtx *cli.Context) error {
+			result, parallel, buildErr = buildConfigs(cCtx)
+			return buildErr
+		},
+	}
+
+	fullArgs := append([]string{"gitbackup"}, args...)
+	if err := app.Run(fullArgs); err != nil {
+		return nil, false, fmt.Errorf("app.Run: %w", err)
+	}
+	return result, parallel, buildErr
+}
+
+func writeTargetsConfig(t *testing.T) string {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+	data := fmt.Sprintf(`parallel: true
+targets:
+  - name: personal
+    service: github
+    backup_dir: %[1]s
+  - name: work
+    service: gitlab
+    githost_url: https://gitlab.example.com
+    backup_dir: %[1]s
+    credentials:
+      token_env: WORK_GITLAB_TOKEN
+`, tmpDir)
+	os.WriteFile(configPath, []byte(data), 0644)
+	return configPath
+}
+
+func TestBuildConfigsTargets(t *testing.T) {
+	configPath := writeTargetsConfig(t)
+
+	configs, parallel, err := buildTestConfigs([]string{"-config", configPath, "-ignore-fork"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !parallel {
+		t.Error("Expected parallel to be true from config file")
+	}
+	if len(configs) != 2 {
+		t.Fatalf("Expected 2 targets, got: %v", len(configs))
+	}
+	if configs[0].name != "personal" || configs[0].service != "github" {
+		t.Errorf("Expected first target personal/github, got: %v/%v", configs[0].name, configs[0].service)
+	}
+	// Unset service-specific settings default to the flag defaults
+	if configs[0].githubRepoType != "all" {
+		t.Errorf("Expected default github repo type 'all', got: %v", configs[0].githubRepoType)
+	}
+	if configs[1].credentials.TokenEnv != "WORK_GITLAB_TOKEN" {
+		t.Errorf("Expected token_env WORK_GITLAB_TOKEN, got: %v", configs[1].credentials.TokenEnv)
+	}
+	if !strings.HasSuffix(configs[1].backupDir, "gitlab.example.com") {
+		t.Errorf("Expected backup dir of the custom host, got: %v", configs[1].backupDir)
+	}
+	// Explicitly set flags override every target
+	for _, c := range configs {
+		if !c.ignoreFork {
+			t.Errorf("Expected ignore-fork to be set for target %s", c.name)
+		}
+	}
+}
+
+func TestBuildConfigsSelectTarget(t *testing.T) {
+	configPath := writeTargetsConfig(t)
+
+	configs, _, err := buildTestConfigs([]string{"-config", configPath, "-target", "work"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(configs) != 1 || configs[0].name != "work" {
+		t.Fatalf("Expected only the work target, got: %v", configs)
+	}
+
+	_, _, err = buildTestConfigs([]string{"-config", configPath, "-target", "missing"})
+	if err == nil {
+		t.Error("Expected an error for an unknown target")
+	}
+
+	_, err = buildTestConfig([]string{"-config", configPath})
+	if err == nil {
+		t.Error("Expected buildConfig to require a single target")
+	}
+}
+
+func TestHandleValidateConfigTargets(t *testing.T) {
+	configPath := writeTargetsConfig(t)
+	os.Setenv("GITHUB_TOKEN", "testtoken")
+	defer os.Unsetenv("GITHUB_TOKEN")
+
+	// WORK_GITLAB_TOKEN is not set
+	if err := handleValidateConfig(configPath); err == nil {
+		t.Fatal("Expected validation error for missing WORK_GITLAB_TOKEN")
+	}
+
+	os.Setenv("WORK_GITLAB_TOKEN", "testtoken")
+	defer os.Unsetenv("WORK_GITLAB_TOKEN")
+	if err := handleValidateConfig(configPath); err != nil {
+		t.Fatalf("Expected no validation error, got: %v", err)
+	}
+
+	os.WriteFile(configPath, []byte("targets:\n  - service: github\n"), 0644)
+	if err := handleValidateConfig(configPath); err == nil {
+		t.Fatal("Expected validation error for a target without a name")
+	}
+}
+
+func TestGitLabGroupsConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`service: gitlab
+backup_dir: %s
+gitlab:
+  project_membership_type: none
+  groups: [platform, infra/tools]
+  include_archived: true
+`, tmpDir)), 0644)
+
+	configs, _, err := buildTestConfigs([]string{"-config", configPath, "-gitlab.includeShared"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	groups := configs[0].gitlabGroups
+	if strings.Join(groups.Groups, ",") != "platform,infra/tools" || !groups.IncludeArchived || !groups.IncludeShared {
+		t.Errorf("Unexpected groups settings: %+v", groups)
+	}
+
+	t.Setenv("GITLAB_TOKEN", "token")
+	os.WriteFile(configPath, []byte("service: gitlab\ngitlab:\n  project_visibility: private\n  project_membership_type: none\n"), 0644)
+	if err := handleValidateConfig(configPath); err == nil {
+		t.Error("Expected an error for the membership type none without groups")
+	}
+}
+
+func TestGitHubOwnersConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`service: github
+backup_dir: %s
+github:
+  repo_type: none
+  orgs:
+    - name: kubernetes
+      types: [sources, public]
+`, tmpDir)), 0644)
+
+	configs, _, err := buildTestConfigs([]string{"-config", configPath, "-github.users", "user1:forks"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	owners := configs[0].githubOwners
+	if len(owners.Orgs) != 1 || owners.Orgs[0].Name != "kubernetes" || strings.Join(owners.Orgs[0].Types, "+") != "sources+public" {
+		t.Errorf("Unexpected orgs: %+v", owners.Orgs)
+	}
+	if len(owners.Users) != 1 || owners.Users[0].Name != "user1" || strings.Join(owners.Users[0].Types, "+") != "forks" {
+		t.Errorf("Unexpected users: %+v", owners.Users)
+	}
+
+	t.Setenv("GITHUB_TOKEN", "token")
+	os.WriteFile(configPath, []byte("service: github\ngithub:\n  repo_type: none\n"), 0644)
+	if err := handleValidateConfig(configPath); err == nil {
+		t.Error("Expected an error for the repo type none without owners")
+	}
+	os.WriteFile(configPath, []byte("service: github\ngithub:\n  orgs:\n    - name: org1\n      types: [archived]\n"), 0644)
+	if err := handleValidateConfig(configPath); err == nil {
+		t.Error("Expected an error for an invalid owner type")
+	}
+}
+
+func TestFilterConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`service: gitlab
+backup_dir: %s
+gitlab:
+  project_visibility: private
+  project_membership_type: all
+include:
+  - "org/**"
+exclude:
+  - "/-archive$/"
+skip_archived: true
+languages: [Go]
+`, tmpDir)), 0644)
+
+	configs, _, err := buildTestConfigs([]string{"-config", configPath, "-exclude", "*/tmp-*", "-explain"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	c := configs[0]
+	if strings.Join(c.filter.Include, ",") != "org/**" || strings.Join(c.filter.Exclude, ",") != "*/tmp-*" || !c.explain ||
+		!c.filter.SkipArchived || strings.Join(c.filter.Languages, ",") != "Go" {
+		t.Errorf("Unexpected filter settings: %+v, explain %v", c.filter, c.explain)
+	}
+
+	t.Setenv("GITLAB_TOKEN", "token")
+	os.WriteFile(configPath, []byte("service: gitlab\ngitlab:\n  project_visibility: private\n  project_membership_type: all\nexclude: [\"/(/\"]\n"), 0644)
+	if err := handleValidateConfig(configPath); err == nil {
+		t.Error("Expected an error for an invalid exclude pattern")
+	}
+}
+
+func TestRepoTypeListConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`service: github
+backup_dir: %s
+starred_subdir: starred
+github:
+  repo_type: [owner, starred]
+`, tmpDir)), 0644)
+
+	configs, _, err := buildTestConfigs([]string{"-config", configPath})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if c := configs[0]; c.githubRepoType != "owner,starred" || c.starredSubdir != "starred" {
+		t.Errorf("Unexpected settings: repo type %q, starred subdir %q", c.githubRepoType, c.starredSubdir)
+	}
+
+	t.Setenv("GITHUB_TOKEN", "token")
+	os.WriteFile(configPath, []byte("service: github\ngithub:\n  repo_type: [none, owner]\n"), 0644)
+	if err := handleValidateConfig(configPath); err == nil {
+		t.Error("Expected an error for none combined with another type")
+	}
+}
+
+func TestLayoutConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`service: github
+backup_dir: %s
+layout: "{host}/{owner}/{name}.git"
+`, tmpDir)), 0644)
+
+	configs, _, err := buildTestConfigs([]string{"-config", configPath})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if c := configs[0]; c.layout != "{host}/{owner}/{name}.git" || c.backupRoot != tmpDir {
+		t.Errorf("Unexpected settings: layout %q, backup root %q", c.layout, c.backupRoot)
+	}
+
+	t.Setenv("GITHUB_TOKEN", "token")
+	os.WriteFile(configPath, []byte("service: github\nlayout: \"{owner}/{repo}\"\n"), 0644)
+	if err := handleValidateConfig(configPath); err == nil {
+		t.Error("Expected an error for an unknown placeholder")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/urfave/cli/v2"
+)
+
+// doctorMinFreeSpace is the free space below which doctor warns about the
+// backup directory
+const doctorMinFreeSpace = 1 << 30
+
+// minGitVersion is the oldest git version which supports GIT_SSH_COMMAND
+var minGitVersion = [2]int{2, 3}
+
+var gitVersionRegexp = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+// doctorStatus is the outcome of a doctor check
+type doctorStatus string
+
+const (
+	doctorPass doctorStatus = "PASS"
+	doctorWarn doctorStatus = "WARN"
+	doctorFail doctorStatus = "FAIL"
+)
+
+// doctorReport prints the outcome of the doctor checks as a checklist
+type doctorReport struct {
+	w      io.Writer
+	indent string
+	counts map[doctorStatus]int
+}
+
+func (d *doctorReport) add(status doctorStatus, name, format string, args ...interface{}) {
+	d.counts[status]++
+	fmt.Fprintf(d.w, "%s[%s] %s: %s\n", d.indent, status, name, fmt.Sprintf(format, args...))
+}
+
+func doctorCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "doctor",
+		Usage: "Check that gitbackup is set up correctly for each target",
+		Action: func(cCtx *cli.Context) error {
+			if err := configureKeyring(cCtx); err != nil {
+				return err
+			}
+			return handleDoctor(cCtx.App.Writer, cCtx)
+		},
+	}
+}
+
+// handleDoctor checks the setup of gitbackup and every selected target and
+// returns an error if any check failed
+func handleDoctor(w io.Writer, cCtx *cli.Context) error {
+	d := &doctorReport{w: w, counts: map[doctorStatus]int{}}
+
+	checkGitVersion(d)
+	configOK := checkConfigFile(d, cCtx.String("config"))
+	checkKeyringAccess(d)
+
+	if configOK {
+		configs, _, err := buildConfigs(cCtx)
+		if err != nil {
+			d.add(doctorFail, "config", "%v", err)
+		}
+		for _, c := range configs {
+			fmt.Fprintf(w, "Target %s (%s):\n", targetName(c), c.service)
+			d.indent = "  "
+			checkTarget(d, c)
+			d.indent = ""
+		}
+	}
+
+	fmt.Fprintf(w, "%d passed, %d warnings, %d failed\n", d.counts[doctorPass], d.counts[doctorWarn], d.counts[doctorFail])
+	if d.counts[doctorFail] > 0 {
+		return fmt.Errorf("%d checks failed", d.counts[doctorFail])
+	}
+	return nil
+}
+
+// checkGitVersion checks that git is installed and recent enough
+func checkGitVersion(d *doctorReport) {
+	if err := checkGitAvailability(); err != nil {
+		d.add(doctorFail, "git", "%v", err)
+		return
+	}
+	out, err := execCommand(gitCommand, "--version").Output()
+	if err != nil {
+		d.add(doctorFail, "git", "error running git --version: %v", err)
+		return
+	}
+	version := strings.TrimSpace(string(out))
+	match := gitVersionRegexp.FindStringSubmatch(version)
+	if match == nil {
+		d.add(doctorWarn, "git", "could not determine the version of %q", version)
+		return
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	if major < minGitVersion[0] || (major == minGitVersion[0] && minor < minGitVersion[1]) {
+		d.add(doctorFail, "git", "%s is too old, git %d.%d or later is required", version, minGitVersion[0], minGitVersion[1])
+		return
+	}
+	d.add(doctorPass, "git", "%s", version)
+}
+
+// checkConfigFile validates the config file if there is one, and reports
+// whether the targets can be built from the configuration
+func checkConfigFile(d *doctorReport, configPath string) bool {
+	path, err := resolveConfigPath(configPath)
+	if err != nil {
+		d.add(doctorFail, "config", "%v", err)
+		return false
+	}
+	if _, err := os.Stat(path); err != nil {
+		if configPath != "" {
+			d.add(doctorFail, "config", "%v", err)
+			return false
+		}
+		d.add(doctorPass, "config", "no config file at %s, using the command line flags", path)
+		return true
+	}
+
+	cfg, err := loadConfigFile(configPath)
+	if err != nil {
+		d.add(doctorFail, "config", "%v", err)
+		return false
+	}
+	if errs := validateFileConfig(cfg); len(errs) > 0 {
+		for _, e := range errs {
+			d.add(doctorFail, "config", "%s", e)
+		}
+		return false
+	}
+	d.add(doctorPass, "config", "%s is valid", path)
+	return true
+}
+
+// checkKeyringAccess checks that the credentials in the keyring can be read
+func checkKeyringAccess(d *doctorReport) {
+	backend := keyringSettings.Backend
+	if backend == "" {
+		backend = "default"
+	}
+	ring, err := openKeyring()
+	if err != nil {
+		d.add(doctorWarn, "keyring", "%v", err)
+		return
+	}
+	keys, err := ring.Keys()
+	if err != nil {
+		d.add(doctorWarn, "keyring", "error listing the %s keyring: %v", backend, err)
+		return
+	}
+	if len(keys) == 0 {
+		d.add(doctorPass, "keyring", "%s keyring opened, no credentials stored", backend)
+		return
+	}
+	// Reading an item checks the passphrase of encrypted keyrings
+	if _, err := ring.Get(keys[0]); err != nil {
+		d.add(doctorWarn, "keyring", "error reading the %s keyring: %v", backend, err)
+		return
+	}
+	d.add(doctorPass, "keyring", "%s keyring opened, %d credentials stored", backend, len(keys))
+}
+
+// checkTarget checks the configuration, API access, token, clone access
+// and backup directory of a target
+func checkTarget(d *doctorReport, c *appConfig) {
+	if err := validateConfig(c); err != nil {
+		d.add(doctorFail, "config", "%v", err)
+		return
+	}
+	if err := setupBackupDir(c); err != nil {
+		d.add(doctorFail, "backup directory", "%v", err)
+	} else {
+		checkBackupDir(d, c.backupDir)
+	}
+
+	// Do not start the GitHub device flow
+	if c.service == "github" && !c.githubApp.configured() && !c.anonymous.Enabled && c.credentials.Token == "" && c.credentials.TokenEnv == "" &&
+		os.Getenv("GITHUB_TOKEN") == "" && !hasStoredCredential(c.service, c.gitHostURL) {
+		d.add(doctorFail, "API", "no token: set GITHUB_TOKEN or log in with: gitbackup auth login --service github")
+		return
+	}
+
+	host, _ := getGitHost(c.service, c.gitHostURL)
+	client, err := newClient(c)
+	if err != nil {
+		d.add(doctorFail, "API", "%v", err)
+		return
+	}
+	if c.anonymous.Enabled {
+		d.add(doctorPass, "API", "accessing %s anonymously, without a token", host)
+		checkCloneAccess(d, client, c)
+		return
+	}
+	username, err := getUsername(client, c.service)
+	if err != nil && !c.githubApp.configured() {
+		d.add(doctorFail, "API", "%s: %v", host, err)
+		return
+	}
+	if username != "" {
+		d.add(doctorPass, "API", "authenticated to %s as %s", host, username)
+	} else {
+		d.add(doctorPass, "API", "authenticated to %s", host)
+	}
+
+	warnings, err := tokenProblems(client, c)
+	switch {
+	case err != nil:
+		d.add(doctorFail, "token", "%v", err)
+		return
+	case len(warnings) > 0:
+		for _, warning := range warnings {
+			d.add(doctorWarn, "token", "%s", warning)
+		}
+	default:
+		d.add(doctorPass, "token", "has the required scopes and does not expire soon")
+	}
+
+	if !c.githubCreateUserMigration {
+		checkCloneAccess(d, client, c)
+	}
+}
+
+// checkBackupDir checks that the backup directory is writable and has
+// enough free space
+func checkBackupDir(d *doctorReport, backupDir string) {
+	f, err := afero.TempFile(appFS, backupDir, ".gitbackup-doctor-")
+	if err != nil {
+		d.add(doctorFail, "backup directory", "%s is not writable: %v", backupDir, err)
+		return
+	}
+	f.Close()
+	appFS.Remove(f.Name())
+
+	free, err := diskFreeSpace(backupDir)
+	switch {
+	case err != nil:
+		d.add(doctorWarn, "backup directory", "%s is writable, could not determine the free space: %v", backupDir, err)
+	case free < doctorMinFreeSpace:
+		d.add(doctorWarn, "backup directory", "%s is writable, only %s free", backupDir, formatBytes(free))
+	default:
+		d.add(doctorPass, "backup directory", "%s is writable, %s free", backupDir, formatBytes(free))
+	}
+}
+
+// checkCloneAccess lists the repositories of the target and checks that
+// the first one can be accessed with git, which checks SSH connectivity,
+// host keys and keys, or HTTPS credentials
+func checkCloneAccess(d *doctorReport, client interface{}, c *appConfig) {
+	opts, repositories, err := listGitRepositories(client, c)
+	if err != nil {
+		d.add(doctorFail, "repositories", "%v", err)
+		return
+	}
+	if len(repositories) == 0 {
+		d.add(doctorWarn, "repositories", "no repositories found")
+		return
+	}
+	d.add(doctorPass, "repositories", "%d repositories found", len(repositories))
+
+	repo := repositories[0]
+	protocol := "SSH"
+	if c.useHTTPSClone {
+		protocol = "HTTPS"
+	} else if opts.sshCommand == "" {
+		// Fail instead of asking to confirm unknown host keys
+		opts.sshCommand = "ssh -o BatchMode=yes"
+	}
+	if err := opts.createKnownHostsDir(); err != nil {
+		d.add(doctorFail, protocol, "%v", err)
+		return
+	}
+	cmd := newGitCommand(opts, repo.CloneURL, "ls-remote", "--heads", repo.CloneURL)
+	cmd.Env = append(cmd.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		d.add(doctorFail, protocol, "cannot access %s: %s", repo.CloneURL, describeGitAccessError(string(out), err))
+		return
+	}
+	d.add(doctorPass, protocol, "accessed %s", repo.CloneURL)
+}
+
+// describeGitAccessError explains why git could not access a repository
+func describeGitAccessError(output string, err error) string {
+	switch {
+	case strings.Contains(output, "REMOTE HOST IDENTIFICATION HAS CHANGED"):
+		return "the host key has changed, check that the host is genuine and update the known hosts file"
+	case strings.Contains(output, "Host key verification failed"):
+		return "the host key is not in the known hosts file, add it with ssh-keyscan or set ssh.trust_on_first_use"
+	case strings.Contains(output, "Permission denied"):
+		return "the SSH key was not accepted, add your public key to your account or set ssh.key_file"
+	case strings.Contains(output, "Authentication failed"), strings.Contains(output, "could not read Username"):
+		return "the HTTPS credentials were not accepted"
+	}
+	lines := strings.Split(strings.TrimSpace(redactSecrets(output)), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return last
+	}
+	return err.Error()
+}
+
+// formatBytes formats a number of bytes for humans
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
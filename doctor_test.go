@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/urfave/cli/v2"
+)
+
+// fakeDoctorGitCommand runs TestHelperDoctorGitProcess, which prints
+// gitVersion for git --version
+func fakeDoctorGitCommand(gitVersion string) func(string, ...string) *exec.Cmd {
+	return func(command string, args ...string) *exec.Cmd {
+		cs := []string{"-test.run=TestHelperDoctorGitProcess", "--", command}
+		cs = append(cs, args...)
+		cmd := exec.Command(os.Args[0], cs...)
+		cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1", "FAKE_GIT_VERSION=" + gitVersion}
+		return cmd
+	}
+}
+
+func TestHelperDoctorGitProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := strings.Join(os.Args[4:], " ")
+	switch {
+	case args == "--version":
+		fmt.Fprintln(os.Stdout, os.Getenv("FAKE_GIT_VERSION"))
+	case strings.Contains(args, "ls-remote") && strings.Contains(args, "denied"):
+		fmt.Fprintln(os.Stderr, "git@example.com: Permission denied (publickey).")
+		fmt.Fprintln(os.Stderr, "fatal: Could not read from remote repository.")
+		os.Exit(128)
+	case strings.Contains(args, "ls-remote"):
+	default:
+		fmt.Fprintf(os.Stdout, "Unexpected git command: %v", args)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// stubLookPath makes git appear to be installed
+func stubLookPath(t *testing.T) {
+	t.Helper()
+	saved := lookPath
+	lookPath = func(file string) (string, error) { return "/usr/bin/" + file, nil }
+	t.Cleanup(func() { lookPath = saved })
+}
+
+func TestCheckGitVersion(t *testing.T) {
+	stubLookPath(t)
+	defer func() { execCommand = exec.Command }()
+
+	tests := []struct {
+		version string
+		want    doctorStatus
+	}{
+		{"git version 2.43.0", doctorPass},
+		{"git version 2.39.3 (Apple Git-145)", doctorPass},
+		{"git version 1.9.5", doctorFail},
+		{"git version 2.2.1", doctorFail},
+		{"unknown", doctorWarn},
+	}
+	for _, tt := range tests {
+		execCommand = fakeDoctorGitCommand(tt.version)
+		var out bytes.Buffer
+		d := &doctorReport{w: &out, counts: map[doctorStatus]int{}}
+		checkGitVersion(d)
+		if d.counts[tt.want] != 1 {
+			t.Errorf("Expected %s for %q, got: %s", tt.want, tt.version, out.String())
+		}
+	}
+
+	lookPath = func(file string) (string, error) { return "", errors.New("not found") }
+	var out bytes.Buffer
+	d := &doctorReport{w: &out, counts: map[doctorStatus]int{}}
+	checkGitVersion(d)
+	if d.counts[doctorFail] != 1 || !strings.Contains(out.String(), "git command not found") {
+		t.Errorf("Expected git to be reported missing, got: %s", out.String())
+	}
+}
+
+// useOsFs makes appFS use the real file system for the duration of the test
+func useOsFs(t *testing.T) {
+	t.Helper()
+	saved := appFS
+	appFS = afero.NewOsFs()
+	t.Cleanup(func() { appFS = saved })
+}
+
+func TestCheckBackupDir(t *testing.T) {
+	useOsFs(t)
+	var out bytes.Buffer
+	d := &doctorReport{w: &out, counts: map[doctorStatus]int{}}
+	dir := t.TempDir()
+	checkBackupDir(d, dir)
+	if d.counts[doctorFail] != 0 || !strings.Contains(out.String(), "is writable") {
+		t.Errorf("Expected the backup directory to be writable, got: %s", out.String())
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected the test file to be removed, got: %v", files)
+	}
+
+	out.Reset()
+	checkBackupDir(d, filepath.Join(dir, "missing"))
+	if d.counts[doctorFail] != 1 {
+		t.Errorf("Expected a missing directory to fail, got: %s", out.String())
+	}
+}
+
+func TestDescribeGitAccessError(t *testing.T) {
+	tests := []struct {
+		output, want string
+	}{
+		{"Host key verification failed.\nfatal: Could not read from remote repository.", "not in the known hosts file"},
+		{"@@@ WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED! @@@\nHost key verification failed.", "host key has changed"},
+		{"git@github.com: Permission denied (publickey).", "SSH key was not accepted"},
+		{"ssh: Could not resolve hostname example.invalid", "Could not resolve hostname"},
+		{"", "exit status 128"},
+	}
+	for _, tt := range tests {
+		if got := describeGitAccessError(tt.output, errors.New("exit status 128")); !strings.Contains(got, tt.want) {
+			t.Errorf("describeGitAccessError(%q) = %q, want it to contain %q", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    uint64
+		want string
+	}{
+		{512, "512 B"},
+		{1536, "1.5 KiB"},
+		{5 << 30, "5.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestHandleDoctor(t *testing.T) {
+	useTestKeyring(t)
+	useOsFs(t)
+	stubLookPath(t)
+	defer func() { execCommand = exec.Command }()
+	execCommand = fakeDoctorGitCommand("git version 2.43.0")
+	// The environment of git is replaced when it is run with GIT_SSH_COMMAND
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	t.Setenv("FAKE_GIT_VERSION", "git version 2.43.0")
+
+	var sshURL string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v4/user":
+			fmt.Fprint(w, `{"username": "gluser"}`)
+		case "/api/v4/personal_access_tokens/self":
+			fmt.Fprint(w, `{"scopes": ["api"], "active": true}`)
+		case "/api/v4/projects":
+			fmt.Fprintf(w, `[{"name": "repo1", "path_with_namespace": "gluser/repo1", "ssh_url_to_repo": %q}]`, sshURL)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	configPath := filepath.Join(t.TempDir(), "gitbackup.yml")
+	config := fmt.Sprintf(`service: gitlab
+githost_url: %s
+backup_dir: %s
+gitlab:
+  project_visibility: private
+  project_membership_type: all
+credentials:
+  token: gltoken
+`, ts.URL, t.TempDir())
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runDoctor := func() (string, error) {
+		var out bytes.Buffer
+		app := &cli.App{Flags: appFlags(), Commands: []*cli.Command{doctorCommand()}, Writer: &out}
+		err := app.Run([]string{"gitbackup", "-config", configPath, "doctor"})
+		return out.String(), err
+	}
+
+	sshURL = "git@example.com:gluser/repo1.git"
+	out, err := runDoctor()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v\n%s", err, out)
+	}
+	for _, expected := range []string{
+		"[PASS] git: git version 2.43.0",
+		"[PASS] config: " + configPath + " is valid",
+		"[PASS] keyring: default keyring opened, no credentials stored",
+		"  [PASS] API: authenticated to 127.0.0.1",
+		"  [PASS] token: has the required scopes",
+		"  [PASS] repositories: 1 repositories found",
+		"  [PASS] SSH: accessed git@example.com:gluser/repo1.git",
+		"0 failed",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in the output, got:\n%s", expected, out)
+		}
+	}
+
+	sshURL = "git@example.com:denied/repo1.git"
+	out, err = runDoctor()
+	if err == nil || !strings.Contains(out, "[FAIL] SSH: cannot access git@example.com:denied/repo1.git: the SSH key was not accepted") {
+		t.Errorf("Expected the SSH check to fail, got: %v\n%s", err, out)
+	}
+}
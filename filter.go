@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// filterConfig selects the repositories to back up by their
+// namespace/name. Patterns are globs, where * and ? do not match a / and
+// ** matches anything, or regular expressions enclosed in slashes, e.g.
+// /-(api|web)$/.
+type filterConfig struct {
+	// Include, if not empty, backs up only the repositories matching any
+	// of the patterns
+	Include []string `yaml:"include,omitempty"`
+	// Exclude skips the repositories matching any of the patterns, even
+	// if they are included
+	Exclude []string `yaml:"exclude,omitempty"`
+
+	// SkipArchived skips archived repositories, and disabled GitHub
+	// repositories
+	SkipArchived bool `yaml:"skip_archived,omitempty"`
+	// MaxSizeMB skips repositories larger than this many megabytes
+	MaxSizeMB int `yaml:"max_size_mb,omitempty"`
+	// PushedWithinDays skips repositories which were not pushed to in
+	// this many days
+	PushedWithinDays int `yaml:"pushed_within_days,omitempty"`
+	// Languages, if not empty, backs up only the repositories whose
+	// primary language is one of them
+	Languages []string `yaml:"languages,omitempty"`
+	// IncludeTopics, if not empty, backs up only the repositories with
+	// one of the topics
+	IncludeTopics []string `yaml:"include_topics,omitempty"`
+	// ExcludeTopics skips the repositories with any of the topics
+	ExcludeTopics []string `yaml:"exclude_topics,omitempty"`
+}
+
+// needsLanguage reports whether the primary language of repositories must
+// be looked up for the filters
+func (f filterConfig) needsLanguage() bool {
+	return len(f.Languages) > 0
+}
+
+// needsTopics reports whether the topics of repositories must be looked up
+// for the filters
+func (f filterConfig) needsTopics() bool {
+	return len(f.IncludeTopics) > 0 || len(f.ExcludeTopics) > 0
+}
+
+// needsSize reports whether the size of repositories must be looked up for
+// the filters
+func (f filterConfig) needsSize() bool {
+	return f.MaxSizeMB > 0
+}
+
+// empty reports whether f selects every repository
+func (f filterConfig) empty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0 && !f.SkipArchived && f.MaxSizeMB == 0 &&
+		f.PushedWithinDays == 0 && !f.needsLanguage() && !f.needsTopics()
+}
+
+// filterRule is a compiled include or exclude pattern
+type filterRule struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// repoFilter applies the include and exclude rules of a filterConfig
+type repoFilter struct {
+	include []filterRule
+	exclude []filterRule
+	config  filterConfig
+	now     time.Time
+}
+
+// compileFilterPattern compiles a glob or /regular expression/
+func compileFilterPattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile(pattern[1 : len(pattern)-1])
+	}
+	return regexp.Compile(globToRegexp(pattern))
+}
+
+// globToRegexp converts a glob matching a whole namespace/name to a
+// regular expression
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			// Character classes are copied, a class which is not closed
+			// matches a literal [
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// newRepoFilter compiles the patterns of f
+func newRepoFilter(f filterConfig) (*repoFilter, error) {
+	compile := func(setting string, patterns []string) ([]filterRule, error) {
+		var rules []filterRule
+		for _, pattern := range patterns {
+			re, err := compileFilterPattern(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s pattern %q: %v", setting, pattern, err)
+			}
+			rules = append(rules, filterRule{pattern: pattern, re: re})
+		}
+		return rules, nil
+	}
+	include, err := compile("include", f.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compile("exclude", f.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	return &repoFilter{include: include, exclude: exclude, config: f, now: time.Now()}, nil
+}
+
+// validateFilterConfig returns the problems found in the filters of a
+// target of service
+func validateFilterConfig(f filterConfig, service string) []string {
+	var errors []string
+	if _, err := newRepoFilter(f); err != nil {
+		errors = append(errors, err.Error())
+	}
+	if f.MaxSizeMB < 0 {
+		errors = append(errors, "max_size_mb must not be negative")
+	}
+	if f.PushedWithinDays < 0 {
+		errors = append(errors, "pushed_within_days must not be negative")
+	}
+	if service == "bitbucket" && f.needsTopics() {
+		errors = append(errors, "Bitbucket repositories have no topics, remove include_topics and exclude_topics")
+	}
+	if service == "bitbucket" && f.MaxSizeMB > 0 {
+		errors = append(errors, "Bitbucket does not report the size of repositories, remove max_size_mb")
+	}
+	return errors
+}
+
+// match reports whether repo is backed up and explains which rule decided it
+func (f *repoFilter) match(repo *Repository) (bool, string) {
+	fullName := repo.Namespace + "/" + repo.Name
+	for _, rule := range f.exclude {
+		if rule.re.MatchString(fullName) {
+			return false, fmt.Sprintf("excluded by exclude rule %q", rule.pattern)
+		}
+	}
+	if ok, reason := f.matchMetadata(repo); !ok {
+		return false, reason
+	}
+	if len(f.include) == 0 {
+		return true, "included, there are no include rules"
+	}
+	for _, rule := range f.include {
+		if rule.re.MatchString(fullName) {
+			return true, fmt.Sprintf("included by include rule %q", rule.pattern)
+		}
+	}
+	return false, "excluded, no include rule matches"
+}
+
+// matchMetadata reports whether repo passes the metadata filters, and
+// explains why not. Sizes and push times the service does not report pass.
+func (f *repoFilter) matchMetadata(repo *Repository) (bool, string) {
+	c := f.config
+	if c.SkipArchived && repo.Archived {
+		return false, "excluded, archived"
+	}
+	if c.MaxSizeMB > 0 && repo.Size > int64(c.MaxSizeMB)<<20 {
+		return false, fmt.Sprintf("excluded, %s is larger than %d MB", formatBytes(uint64(repo.Size)), c.MaxSizeMB)
+	}
+	if c.PushedWithinDays > 0 && !repo.PushedAt.IsZero() && repo.PushedAt.Before(f.now.AddDate(0, 0, -c.PushedWithinDays)) {
+		return false, fmt.Sprintf("excluded, last pushed on %s, more than %d days ago", repo.PushedAt.Format("2006-01-02"), c.PushedWithinDays)
+	}
+	if c.needsLanguage() && !containsFold(c.Languages, repo.Language) {
+		if repo.Language == "" {
+			return false, "excluded, no primary language"
+		}
+		return false, fmt.Sprintf("excluded, primary language %s is not selected", repo.Language)
+	}
+	for _, topic := range repo.Topics {
+		if containsFold(c.ExcludeTopics, topic) {
+			return false, fmt.Sprintf("excluded by topic %q", topic)
+		}
+	}
+	if len(c.IncludeTopics) > 0 {
+		found := false
+		for _, topic := range repo.Topics {
+			if containsFold(c.IncludeTopics, topic) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, "excluded, has none of the included topics"
+		}
+	}
+	return true, ""
+}
+
+// containsFold reports whether values contains s, ignoring case
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRepositories returns the repositories selected by the include and
+// exclude rules of f, logging the decision for each one if explain is set
+func filterRepositories(repositories []*Repository, f filterConfig, explain bool) ([]*Repository, error) {
+	if f.empty() && !explain {
+		return repositories, nil
+	}
+	rf, err := newRepoFilter(f)
+	if err != nil {
+		return nil, err
+	}
+	var selected []*Repository
+	for _, repo := range repositories {
+		ok, reason := rf.match(repo)
+		if explain {
+			log.Printf("%s/%s: %s\n", repo.Namespace, repo.Name, reason)
+		}
+		if ok {
+			selected = append(selected, repo)
+		}
+	}
+	return selected, nil
+}
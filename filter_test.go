@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterPatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"org/*", "org/api", true},
+		{"org/*", "org/team/api", false},
+		{"org/**", "org/team/api", true},
+		{"**/api", "org/team/api", true},
+		{"*/api-?", "org/api-1", true},
+		{"*/api-?", "org/api-10", false},
+		{"*/[ab]*", "org/beta", true},
+		{"*/[!ab]*", "org/beta", false},
+		{"org/a.b", "org/axb", false},
+		{"/-(api|web)$/", "org/team/shop-web", true},
+		{"/^org/", "other/org", false},
+		{"/Archive/", "org/archive", false},
+	}
+	for _, tt := range tests {
+		re, err := compileFilterPattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("compileFilterPattern(%q): %v", tt.pattern, err)
+		}
+		if got := re.MatchString(tt.name); got != tt.want {
+			t.Errorf("%q matching %q = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilterRepositories(t *testing.T) {
+	repos := []*Repository{
+		{Namespace: "org", Name: "api"},
+		{Namespace: "org", Name: "api-archive"},
+		{Namespace: "org/team", Name: "web"},
+		{Namespace: "user", Name: "dotfiles"},
+	}
+
+	tests := []struct {
+		name   string
+		filter filterConfig
+		want   []string
+	}{
+		{"no rules", filterConfig{}, []string{"api", "api-archive", "web", "dotfiles"}},
+		{"include", filterConfig{Include: []string{"org/**"}}, []string{"api", "api-archive", "web"}},
+		{"exclude", filterConfig{Exclude: []string{"/-archive$/"}}, []string{"api", "web", "dotfiles"}},
+		{"exclude wins", filterConfig{Include: []string{"org/*"}, Exclude: []string{"*/*-archive"}}, []string{"api"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := filterRepositories(repos, tt.filter, false)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			var names []string
+			for _, repo := range got {
+				names = append(names, repo.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, names)
+			}
+		})
+	}
+
+	if _, err := filterRepositories(repos, filterConfig{Include: []string{"/(/"}}, false); err == nil {
+		t.Error("Expected an error for an invalid regular expression")
+	}
+}
+
+func TestFilterRepositoriesExplain(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	repos := []*Repository{{Namespace: "org", Name: "api"}, {Namespace: "org", Name: "old"}, {Namespace: "user", Name: "blog"}}
+	_, err := filterRepositories(repos, filterConfig{Include: []string{"org/*"}, Exclude: []string{"*/old"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`org/api: included by include rule "org/*"`,
+		`org/old: excluded by exclude rule "*/old"`,
+		"user/blog: excluded, no include rule matches",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in the output, got:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestFilterRepositoriesMetadata(t *testing.T) {
+	now := time.Now()
+	repos := []*Repository{
+		{Namespace: "org", Name: "old", PushedAt: now.AddDate(-1, 0, 0), Language: "Go"},
+		{Namespace: "org", Name: "archived", Archived: true, Language: "Go"},
+		{Namespace: "org", Name: "huge", Size: 2 << 30, Language: "C"},
+		{Namespace: "org", Name: "tool", PushedAt: now, Language: "Go", Topics: []string{"cli"}},
+		{Namespace: "org", Name: "site", PushedAt: now, Language: "JavaScript", Topics: []string{"web", "deprecated"}},
+		{Namespace: "org", Name: "docs"},
+	}
+
+	tests := []struct {
+		name   string
+		filter filterConfig
+		want   []string
+	}{
+		{"archived", filterConfig{SkipArchived: true}, []string{"old", "huge", "tool", "site", "docs"}},
+		{"size", filterConfig{MaxSizeMB: 1024}, []string{"old", "archived", "tool", "site", "docs"}},
+		// Repositories without a push time are kept
+		{"pushed", filterConfig{PushedWithinDays: 30}, []string{"archived", "huge", "tool", "site", "docs"}},
+		{"language", filterConfig{Languages: []string{"go", "c"}}, []string{"old", "archived", "huge", "tool"}},
+		{"include topics", filterConfig{IncludeTopics: []string{"cli", "web"}}, []string{"tool", "site"}},
+		{"exclude topics", filterConfig{ExcludeTopics: []string{"Deprecated"}}, []string{"old", "archived", "huge", "tool", "docs"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := filterRepositories(repos, tt.filter, false)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			var names []string
+			for _, repo := range got {
+				names = append(names, repo.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, names)
+			}
+		})
+	}
+}
+
+func TestValidateFilterConfig(t *testing.T) {
+	if errs := validateFilterConfig(filterConfig{MaxSizeMB: -1, PushedWithinDays: -1}, "github"); len(errs) != 2 {
+		t.Errorf("Expected errors for negative limits, got: %v", errs)
+	}
+	if errs := validateFilterConfig(filterConfig{IncludeTopics: []string{"cli"}}, "bitbucket"); len(errs) != 1 {
+		t.Errorf("Expected an error for topics on Bitbucket, got: %v", errs)
+	}
+	if errs := validateFilterConfig(filterConfig{MaxSizeMB: 500}, "bitbucket"); len(errs) != 1 {
+		t.Errorf("Expected an error for max_size_mb on Bitbucket, got: %v", errs)
+	}
+	if errs := validateFilterConfig(filterConfig{IncludeTopics: []string{"cli"}}, "forgejo"); len(errs) != 0 {
+		t.Errorf("Expected no errors, got: %v", errs)
+	}
+}
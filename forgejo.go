@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"strconv"
 
 	forgejo "codeberg.org/mvdkleijn/forgejo-sdk/forgejo/v2"
 )
@@ -10,14 +11,29 @@ import (
 func getForgejoRepositories(
 	client *forgejo.Client,
 	forgejoRepoType string,
+	filter filterConfig,
 	ignoreFork bool,
 ) ([]*Repository, error) {
 
+	var repos []*Repository
+	seen := map[string]bool{}
+	for _, repoType := range orderRepoTypes(forgejoRepoType) {
+		list, err := listForgejoRepositories(client, repoType, ignoreFork)
+		if err != nil {
+			return nil, err
+		}
+		repos = appendNewRepositories(repos, seen, list)
+	}
+	return repos, addForgejoMetadata(client, repos, filter)
+}
+
+func listForgejoRepositories(client *forgejo.Client, forgejoRepoType string, ignoreFork bool) ([]*Repository, error) {
+
 	switch forgejoRepoType {
 	case "starred":
 		user, _, err := client.GetMyUserInfo()
 		if err != nil {
-			log.Fatalf("Error fetching user info from forgejo: %v", err)
+			return nil, fmt.Errorf("fetching user info from forgejo: %v", err)
 		}
 
 		log.Printf("Found user %s with ID %d", user.UserName, user.ID)
@@ -31,6 +47,9 @@ func getForgejoRepositories(
 		if err != nil {
 			return nil, fmt.Errorf("fetching starred repositories from forgejo: %v", err)
 		}
+		for _, repo := range repos {
+			repo.Starred = true
+		}
 
 		return repos, nil
 	case "user", "":
@@ -63,11 +82,22 @@ func paginateForgejoRepositories(fetch func(page int) ([]*forgejo.Repository, *f
 			if repo.Fork && ignoreFork {
 				continue
 			}
+			var id string
+			if repo.ID != 0 {
+				id = strconv.FormatInt(repo.ID, 10)
+			}
 			repositories = append(repositories, &Repository{
+				ID:        id,
 				CloneURL:  getCloneURL(repo.CloneURL, repo.SSHURL),
 				Name:      repo.Name,
 				Namespace: repo.Owner.UserName,
 				Private:   repo.Private,
+				Fork:      repo.Fork,
+				Archived:  repo.Archived,
+				// Forgejo reports the size in kilobytes, and not when the
+				// repository was last pushed to
+				Size:     int64(repo.Size) << 10,
+				PushedAt: repo.Updated,
 			})
 		}
 
@@ -80,3 +110,33 @@ func paginateForgejoRepositories(fetch func(page int) ([]*forgejo.Repository, *f
 
 	return repositories, nil
 }
+
+// addForgejoMetadata looks up the primary language and the topics of the
+// repositories when filter needs them, as Forgejo does not list them
+func addForgejoMetadata(client *forgejo.Client, repos []*Repository, filter filterConfig) error {
+	if !filter.needsLanguage() && !filter.needsTopics() {
+		return nil
+	}
+	for _, repo := range repos {
+		if filter.needsLanguage() {
+			languages, _, err := client.GetRepoLanguages(repo.Namespace, repo.Name)
+			if err != nil {
+				return fmt.Errorf("fetching the languages of %s/%s from forgejo: %v", repo.Namespace, repo.Name, err)
+			}
+			var size int64
+			for language, bytes := range languages {
+				if bytes > size || (bytes == size && language < repo.Language) {
+					repo.Language, size = language, bytes
+				}
+			}
+		}
+		if filter.needsTopics() {
+			topics, _, err := client.ListRepoTopics(repo.Namespace, repo.Name, forgejo.ListRepoTopicsOptions{})
+			if err != nil {
+				return fmt.Errorf("fetching the topics of %s/%s from forgejo: %v", repo.Namespace, repo.Name, err)
+			}
+			repo.Topics = topics
+		}
+	}
+	return nil
+}
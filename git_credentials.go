@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+
+	"github.com/spf13/afero"
+)
+
+// Environment variables through which the credentials are handed to the
+// credential helper, so that they never appear in command lines or in
+// the configuration of the backups
+const (
+	gitUsernameEnv = "GITBACKUP_GIT_USERNAME"
+	gitPasswordEnv = "GITBACKUP_GIT_PASSWORD"
+)
+
+// gitCredentialHelper prints the credentials from the environment in the
+// format of the git credential helper protocol
+const gitCredentialHelper = `!f() { test "$1" = get || exit 0; echo "username=$` + gitUsernameEnv + `"; echo "password=$` + gitPasswordEnv + `"; }; f`
+
+// defaultGitUsername is used with tokens when the username of the account
+// is unknown. GitHub, GitLab and Forgejo accept any username with a token.
+const defaultGitUsername = "oauth2"
+
+// remoteURLLine matches the url settings of git configuration files
+var remoteURLLine = regexp.MustCompile(`(?m)^([ \t]*url[ \t]*=[ \t]*)(\S+)[ \t]*$`)
+
+// newGitCommand returns a git command which uses the SSH command and HTTP
+// settings of opts, and authenticates HTTPS requests to the host of cloneURL with the token of
+// opts. The credentials are supplied by an ephemeral credential helper which
+// only lives for the duration of the command, so they are not stored in the
+// repository or in any credential store.
+func newGitCommand(opts *cloneOptions, cloneURL string, args ...string) *exec.Cmd {
+	if opts == nil {
+		return execCommand(gitCommand, args...)
+	}
+
+	env := append([]string{}, opts.httpEnv...)
+	if opts.sshCommand != "" {
+		env = append(env, "GIT_SSH_COMMAND="+opts.sshCommand)
+	}
+
+	u, err := url.Parse(cloneURL)
+	token := opts.currentToken()
+	if opts.useHTTPS && token != "" && err == nil && u.Host != "" {
+		username := opts.username
+		if username == "" {
+			username = defaultGitUsername
+		}
+		args = append([]string{
+			// Reset the configured helpers, so that the token is not saved by them
+			"-c", "credential.helper=",
+			"-c", fmt.Sprintf("credential.%s://%s.helper=%s", u.Scheme, u.Host, gitCredentialHelper),
+		}, args...)
+		env = append(env,
+			gitUsernameEnv+"="+username,
+			gitPasswordEnv+"="+token,
+			"GIT_TERMINAL_PROMPT=0",
+		)
+	}
+
+	cmd := execCommand(gitCommand, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
+}
+
+// stripURLCredentials removes the username and password from rawURL
+func stripURLCredentials(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, hasPassword := u.User.Password(); !hasPassword {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
+
+// scrubRemoteCredentials removes credentials embedded in the remote URLs
+// of a backup, as written by earlier versions of gitbackup
+func scrubRemoteCredentials(repoDir string, bare bool) error {
+	configPath := path.Join(repoDir, ".git", "config")
+	if bare {
+		configPath = path.Join(repoDir, "config")
+	}
+	data, err := afero.ReadFile(appFS, configPath)
+	if err != nil {
+		// Nothing to scrub, git reports on broken repositories
+		return nil
+	}
+
+	config := string(data)
+	scrubbed := remoteURLLine.ReplaceAllStringFunc(config, func(line string) string {
+		m := remoteURLLine.FindStringSubmatch(line)
+		return m[1] + stripURLCredentials(m[2])
+	})
+	if scrubbed == config {
+		return nil
+	}
+	log.Printf("Removing credentials from the remote URL of %s\n", repoDir)
+	info, err := appFS.Stat(configPath)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(appFS, configPath, []byte(scrubbed), info.Mode())
+}
@@ -6,57 +6,105 @@ import (
 	"sync"
 )
 
+// globalSettingsMutex serialises the parts of a run which read or write the
+// global useHTTPSClone setting, or prompt for a login, so that several
+// targets can be backed up in parallel
+var globalSettingsMutex sync.Mutex
+
 // handleGitRepositoryClone clones or updates all repositories for the configured service
-func handleGitRepositoryClone(client any, c *appConfig) error {
+// and records the outcome of each backup in report
+func handleGitRepositoryClone(client any, c *appConfig, report *runReport) error {
 
 	// Check if git is available before proceeding
 	if err := checkGitAvailability(); err != nil {
 		return err
 	}
 
-	// Used for waiting for all the goroutines to finish before exiting
-	var wg sync.WaitGroup
-	defer wg.Wait()
-
-	// Set global variables used by helper functions
-	useHTTPSClone = &c.useHTTPSClone
-	ignorePrivate = &c.ignorePrivate
-
-	tokens := make(chan bool, MaxConcurrentClones)
-	gitHostUsername = getUsername(client, c.service)
-
-	if len(gitHostUsername) == 0 && c.ignorePrivate && c.useHTTPSClone {
-		return fmt.Errorf("your Git host's username is needed for backing up private repositories via HTTPS")
-	}
-
-	repositories, err := getRepositories(
-		client,
-		c.service,
-		c.githubRepoType,
-		c.githubNamespaceWhitelist,
-		c.gitlabProjectVisibility,
-		c.gitlabProjectMembershipType,
-		c.ignoreFork,
-		c.forgejoRepoType,
-	)
+	opts, repositories, err := listGitRepositories(client, c)
 	if err != nil {
 		return err
 	}
+	metrics.setReposListed(targetName(c), len(repositories))
+	report.Listed = len(repositories)
 	if len(repositories) == 0 {
 		return fmt.Errorf("no repositories retrieved")
 	}
 
+	// Used for waiting for all the goroutines to finish before exiting
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	tokens := make(chan bool, MaxConcurrentClones)
+
 	log.Printf("Backing up %v repositories now..\n", len(repositories))
 	for _, repo := range repositories {
 		tokens <- true
 		wg.Add(1)
 		go func(repo *Repository) {
-			stdoutStderr, err := backUp(c.backupDir, repo, c.bare, &wg)
+			defer wg.Done()
+			action, changed, stdoutStderr, err := backUpRepository(c, repo, opts)
 			if err != nil {
+				if len(stdoutStderr) == 0 {
+					stdoutStderr = []byte(err.Error())
+				}
 				log.Printf("Error backing up %s: %s\n", repo.Name, stdoutStderr)
 			}
+			report.addResult(repo, action, changed, err, stdoutStderr)
 			<-tokens
 		}(repo)
 	}
 	return nil
 }
+
+// listGitRepositories retrieves the repositories to back up along with the
+// options used to clone them
+func listGitRepositories(client any, c *appConfig) (*cloneOptions, []*Repository, error) {
+	globalSettingsMutex.Lock()
+	defer globalSettingsMutex.Unlock()
+
+	// Without credentials, repositories can only be cloned over HTTPS
+	if c.anonymous.Enabled {
+		c.useHTTPSClone = true
+	}
+
+	// Set global variables used by helper functions
+	useHTTPSClone = &c.useHTTPSClone
+
+	if c.anonymous.Enabled {
+		repositories, err := getAnonymousRepositories(client, c)
+		if err != nil {
+			return nil, nil, err
+		}
+		repositories, err = filterRepositories(repositories, c.filter, c.explain)
+		if err != nil {
+			return nil, nil, err
+		}
+		assignRepoDirs(c, repositories)
+		opts, err := newCloneOptions(c, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		return opts, repositories, nil
+	}
+
+	username, err := getCloneUsername(client, c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(username) == 0 && c.ignorePrivate && c.useHTTPSClone {
+		return nil, nil, fmt.Errorf("your Git host's username is needed for backing up private repositories via HTTPS")
+	}
+
+	repositories, err := getRepositories(client, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	assignRepoDirs(c, repositories)
+
+	opts, err := newCloneOptions(c, username)
+	if err != nil {
+		return nil, nil, err
+	}
+	return opts, repositories, nil
+}
@@ -2,26 +2,182 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/google/go-github/v34/github"
 )
 
+// githubOwnerTypes are the repository types the repositories of
+// github.orgs and github.users can be filtered by
+var githubOwnerTypes = []string{"sources", "forks", "public", "private", "internal"}
+
+// githubOwnerConfig selects the repositories of a GitHub organization or
+// user. Types restricts the repositories to sources or forks and to the
+// listed visibilities, all repositories are backed up without types.
+type githubOwnerConfig struct {
+	Name  string   `yaml:"name"`
+	Types []string `yaml:"types,omitempty"`
+}
+
+// githubOwnersConfig lists GitHub organizations and users whose
+// repositories are backed up in addition to those selected by the repo type
+type githubOwnersConfig struct {
+	Orgs  []githubOwnerConfig `yaml:"orgs,omitempty"`
+	Users []githubOwnerConfig `yaml:"users,omitempty"`
+}
+
+// parseGithubOwners parses a comma separated list of owners, each
+// optionally followed by a colon and types separated by +, such as
+// "kubernetes:sources+public,golang"
+func parseGithubOwners(value string) []githubOwnerConfig {
+	var owners []githubOwnerConfig
+	for _, owner := range strings.Split(value, ",") {
+		name, types, _ := strings.Cut(strings.TrimSpace(owner), ":")
+		if name == "" {
+			continue
+		}
+		o := githubOwnerConfig{Name: name}
+		if types != "" {
+			o.Types = strings.Split(types, "+")
+		}
+		owners = append(owners, o)
+	}
+	return owners
+}
+
+// validateGithubOwners returns the problems found in github.orgs and github.users
+func validateGithubOwners(owners githubOwnersConfig) []string {
+	var errors []string
+	for setting, list := range map[string][]githubOwnerConfig{"github.orgs": owners.Orgs, "github.users": owners.Users} {
+		for _, o := range list {
+			if o.Name == "" {
+				errors = append(errors, fmt.Sprintf("%s: name is required", setting))
+			}
+			for _, t := range o.Types {
+				if !contains(githubOwnerTypes, t) {
+					errors = append(errors, fmt.Sprintf("%s: invalid type %q for %s (must be sources, forks, public, private, or internal)", setting, t, o.Name))
+				}
+			}
+		}
+	}
+	sort.Strings(errors)
+	return errors
+}
+
+// githubOwnerTypesMatch reports whether repo is one of the types. Types of
+// the same kind match any of them, e.g. public+private, and types of
+// different kinds must all match, e.g. sources+public.
+func githubOwnerTypesMatch(types []string, repo *github.Repository) bool {
+	var origins, visibilities []string
+	for _, t := range types {
+		if t == "sources" || t == "forks" {
+			origins = append(origins, t)
+		} else {
+			visibilities = append(visibilities, t)
+		}
+	}
+	if len(origins) > 0 {
+		origin := "sources"
+		if repo.GetFork() {
+			origin = "forks"
+		}
+		if !contains(origins, origin) {
+			return false
+		}
+	}
+	if len(visibilities) > 0 {
+		visibility := repo.GetVisibility()
+		if visibility == "" {
+			visibility = "public"
+			if repo.GetPrivate() {
+				visibility = "private"
+			}
+		}
+		if !contains(visibilities, visibility) {
+			return false
+		}
+	}
+	return true
+}
+
+// newGithubRepository returns the Repository to back up for repo
+func newGithubRepository(repo *github.Repository) *Repository {
+	var httpsCloneURL, sshCloneURL string
+	if repo.CloneURL != nil {
+		httpsCloneURL = *repo.CloneURL
+	}
+	if repo.SSHURL != nil {
+		sshCloneURL = *repo.SSHURL
+	}
+	var id string
+	if repo.ID != nil {
+		id = strconv.FormatInt(*repo.ID, 10)
+	}
+	return &Repository{
+		ID:        id,
+		CloneURL:  getCloneURL(httpsCloneURL, sshCloneURL),
+		Name:      *repo.Name,
+		Namespace: strings.Split(*repo.FullName, "/")[0],
+		Private:   *repo.Private,
+		Fork:      repo.GetFork(),
+		Archived:  repo.GetArchived() || repo.GetDisabled(),
+		// GitHub reports the size in kilobytes
+		Size:     int64(repo.GetSize()) << 10,
+		PushedAt: repo.GetPushedAt().Time,
+		Language: repo.GetLanguage(),
+		Topics:   repo.Topics,
+	}
+}
+
 func getGithubRepositories(
 	client *github.Client,
 	githubRepoType string, githubNamespaceWhitelist []string,
+	githubOwners githubOwnersConfig,
 	ignoreFork bool,
 ) ([]*Repository, error) {
 
 	var repositories []*Repository
+	seen := map[string]bool{}
 
 	ctx := context.Background()
 
-	if githubRepoType == "starred" {
-		return getGithubStarredRepositories(ctx, client, ignoreFork)
+	// Each type is listed separately, a repository is listed once
+	for _, repoType := range orderRepoTypes(githubRepoType) {
+		var list []*Repository
+		var err error
+		switch repoType {
+		case "starred":
+			list, err = getGithubStarredRepositories(ctx, client, ignoreFork)
+		case "installation":
+			list, err = getGithubInstallationRepositories(ctx, client, githubNamespaceWhitelist, ignoreFork)
+		case "none":
+			// Only the repositories of github.orgs and github.users
+		default:
+			list, err = getGithubUserRepositories(ctx, client, repoType, githubNamespaceWhitelist, ignoreFork)
+		}
+		if err != nil {
+			return nil, err
+		}
+		repositories = appendNewRepositories(repositories, seen, list)
 	}
 
-	options := github.RepositoryListOptions{Type: githubRepoType}
+	if len(githubOwners.Orgs) == 0 && len(githubOwners.Users) == 0 {
+		return repositories, nil
+	}
+	return addGithubOwnerRepositories(ctx, client, repositories, githubOwners, ignoreFork)
+}
+
+// getGithubUserRepositories lists the repositories of the authenticated
+// user of repoType, which is all, owner or member
+func getGithubUserRepositories(
+	ctx context.Context, client *github.Client,
+	repoType string, githubNamespaceWhitelist []string, ignoreFork bool,
+) ([]*Repository, error) {
+	var repositories []*Repository
+	options := github.RepositoryListOptions{Type: repoType}
 
 	for {
 		repos, resp, err := client.Repositories.List(ctx, "", &options)
@@ -37,27 +193,65 @@ func getGithubRepositories(
 			if len(githubNamespaceWhitelist) > 0 && !contains(githubNamespaceWhitelist, namespace) {
 				continue
 			}
+			repositories = append(repositories, newGithubRepository(repo))
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		options.ListOptions.Page = resp.NextPage
+	}
+	return repositories, nil
+}
 
-			var httpsCloneURL, sshCloneURL string
-			if repo.CloneURL != nil {
-				httpsCloneURL = *repo.CloneURL
+// addGithubOwnerRepositories adds the repositories of github.orgs and
+// github.users to repositories, skipping those already listed
+func addGithubOwnerRepositories(
+	ctx context.Context, client *github.Client, repositories []*Repository,
+	githubOwners githubOwnersConfig, ignoreFork bool,
+) ([]*Repository, error) {
+	seen := map[string]bool{}
+	for _, repo := range repositories {
+		seen[repositoryKey(repo)] = true
+	}
+	add := func(owner githubOwnerConfig, repos []*github.Repository) {
+		for _, repo := range repos {
+			if repo.GetFork() && ignoreFork {
+				continue
 			}
-			if repo.SSHURL != nil {
-				sshCloneURL = *repo.SSHURL
+			if !githubOwnerTypesMatch(owner.Types, repo) {
+				continue
 			}
+			repositories = appendNewRepositories(repositories, seen, []*Repository{newGithubRepository(repo)})
+		}
+	}
 
-			cloneURL := getCloneURL(httpsCloneURL, sshCloneURL)
-			repositories = append(repositories, &Repository{
-				CloneURL:  cloneURL,
-				Name:      *repo.Name,
-				Namespace: namespace,
-				Private:   *repo.Private,
-			})
+	for _, org := range githubOwners.Orgs {
+		options := github.RepositoryListByOrgOptions{Type: "all"}
+		for {
+			repos, resp, err := client.Repositories.ListByOrg(ctx, org.Name, &options)
+			if err != nil {
+				return nil, fmt.Errorf("error listing the repositories of organization %s: %v", org.Name, err)
+			}
+			add(org, repos)
+			if resp.NextPage == 0 {
+				break
+			}
+			options.ListOptions.Page = resp.NextPage
 		}
-		if resp.NextPage == 0 {
-			break
+	}
+	for _, user := range githubOwners.Users {
+		options := github.RepositoryListOptions{Type: "owner"}
+		for {
+			repos, resp, err := client.Repositories.List(ctx, user.Name, &options)
+			if err != nil {
+				return nil, fmt.Errorf("error listing the repositories of user %s: %v", user.Name, err)
+			}
+			add(user, repos)
+			if resp.NextPage == 0 {
+				break
+			}
+			options.ListOptions.Page = resp.NextPage
 		}
-		options.ListOptions.Page = resp.NextPage
 	}
 	return repositories, nil
 }
@@ -75,28 +269,47 @@ func getGithubStarredRepositories(ctx context.Context, client *github.Client, ig
 			if *star.Repository.Fork && ignoreFork {
 				continue
 			}
-			namespace := strings.Split(*star.Repository.FullName, "/")[0]
+			r := newGithubRepository(star.Repository)
+			r.Starred = true
+			repositories = append(repositories, r)
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		options.ListOptions.Page = resp.NextPage
+	}
+	return repositories, nil
+}
 
-			var httpsCloneURL, sshCloneURL string
-			if star.Repository.CloneURL != nil {
-				httpsCloneURL = *star.Repository.CloneURL
-			}
-			if star.Repository.SSHURL != nil {
-				sshCloneURL = *star.Repository.SSHURL
+// getGithubInstallationRepositories lists the repositories accessible to the
+// GitHub App installation the client is authenticated as
+func getGithubInstallationRepositories(
+	ctx context.Context, client *github.Client,
+	githubNamespaceWhitelist []string, ignoreFork bool,
+) ([]*Repository, error) {
+	var repositories []*Repository
+	options := github.ListOptions{}
+
+	for {
+		list, resp, err := client.Apps.ListRepos(ctx, &options)
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range list.Repositories {
+			if *repo.Fork && ignoreFork {
+				continue
 			}
+			namespace := strings.Split(*repo.FullName, "/")[0]
 
-			cloneURL := getCloneURL(httpsCloneURL, sshCloneURL)
-			repositories = append(repositories, &Repository{
-				CloneURL:  cloneURL,
-				Name:      *star.Repository.Name,
-				Namespace: namespace,
-				Private:   *star.Repository.Private,
-			})
+			if len(githubNamespaceWhitelist) > 0 && !contains(githubNamespaceWhitelist, namespace) {
+				continue
+			}
+			repositories = append(repositories, newGithubRepository(repo))
 		}
 		if resp.NextPage == 0 {
 			break
 		}
-		options.ListOptions.Page = resp.NextPage
+		options.Page = resp.NextPage
 	}
 	return repositories, nil
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v34/github"
+	"golang.org/x/oauth2"
+)
+
+// githubAppUsername is the username git uses with installation tokens
+const githubAppUsername = "x-access-token"
+
+// githubAppTokenRefreshMargin is how long before their expiry installation
+// tokens are replaced, so that a clone does not start with a token which
+// expires while it runs
+const githubAppTokenRefreshMargin = 5 * time.Minute
+
+// githubAppJWTLifetime is the lifetime of the JWTs authenticating as the
+// app, GitHub allows at most 10 minutes
+const githubAppJWTLifetime = 9 * time.Minute
+
+// githubAppConfig configures authentication as a GitHub App installation
+type githubAppConfig struct {
+	AppID int64 `yaml:"app_id,omitempty"`
+	// InstallationID may be omitted if the app has a single installation
+	InstallationID int64 `yaml:"installation_id,omitempty"`
+	// PrivateKey is the PEM private key of the app, or a secret reference
+	// such as file:/run/secrets/github-app.pem
+	PrivateKey string `yaml:"private_key,omitempty"`
+}
+
+// configured reports whether GitHub App authentication is configured
+func (a githubAppConfig) configured() bool {
+	return a.AppID != 0
+}
+
+// validateGithubAppConfig returns the problems found in the GitHub App settings
+func validateGithubAppConfig(a githubAppConfig, repoType string) []string {
+	if !a.configured() {
+		return nil
+	}
+	var errors []string
+	if a.PrivateKey == "" {
+		errors = append(errors, "github.app.private_key is required with github.app.app_id")
+	} else if key, err := resolveSecret(a.PrivateKey, nil); err == nil {
+		if _, err := parseRSAPrivateKey(key); err != nil {
+			errors = append(errors, fmt.Sprintf("invalid github.app.private_key: %v", err))
+		}
+	}
+	if repoType != "all" && repoType != "installation" {
+		errors = append(errors, fmt.Sprintf("invalid github.repo_type: %q (must be installation with a GitHub App)", repoType))
+	}
+	return errors
+}
+
+// githubAppJWTTransport authenticates requests as the GitHub App itself,
+// which is needed to create installation tokens
+type githubAppJWTTransport struct {
+	appID int64
+	key   *rsa.PrivateKey
+	base  http.RoundTripper
+}
+
+func (t *githubAppJWTTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	jwt, err := newGitHubAppJWT(t.appID, t.key, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+jwt)
+	return t.base.RoundTrip(r)
+}
+
+// githubAppTokenSource creates installation tokens for a GitHub App installation
+type githubAppTokenSource struct {
+	installationID int64
+	appClient      *github.Client
+}
+
+func (s *githubAppTokenSource) Token() (*oauth2.Token, error) {
+	token, _, err := s.appClient.Apps.CreateInstallationToken(context.Background(), s.installationID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating GitHub App installation token: %v", err)
+	}
+	registerSecret(token.GetToken())
+	return &oauth2.Token{
+		AccessToken: token.GetToken(),
+		TokenType:   "token",
+		Expiry:      token.GetExpiresAt().Add(-githubAppTokenRefreshMargin),
+	}, nil
+}
+
+// newGitHubAppClient creates a GitHub client authenticated as an installation
+// of a GitHub App. It returns the current installation token, and a token
+// source which refreshes the installation token before it expires.
+func newGitHubAppClient(gitHostURLParsed *url.URL, app githubAppConfig, transport http.RoundTripper) (*github.Client, string, oauth2.TokenSource, error) {
+	pemKey, err := resolveSecret(app.PrivateKey, nil)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error reading GitHub App private key: %v", err)
+	}
+	key, err := parseRSAPrivateKey(pemKey)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("invalid GitHub App private key: %v", err)
+	}
+
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	appClient := github.NewClient(&http.Client{
+		Transport: instrumentTransport("github", &githubAppJWTTransport{appID: app.AppID, key: key, base: transport}),
+	})
+	if gitHostURLParsed != nil {
+		appClient.BaseURL = gitHostURLParsed
+	}
+
+	installationID := app.InstallationID
+	if installationID == 0 {
+		installationID, err = getGitHubAppInstallationID(appClient)
+		if err != nil {
+			return nil, "", nil, err
+		}
+	}
+
+	ts := oauth2.ReuseTokenSource(nil, &githubAppTokenSource{installationID: installationID, appClient: appClient})
+	token, err := ts.Token()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: transport})
+	tc := oauth2.NewClient(ctx, ts)
+	tc.Transport = instrumentTransport("github", tc.Transport)
+	client := github.NewClient(tc)
+	if gitHostURLParsed != nil {
+		client.BaseURL = gitHostURLParsed
+	}
+	return client, token.AccessToken, ts, nil
+}
+
+// getGitHubAppInstallationID returns the ID of the only installation of a
+// GitHub App
+func getGitHubAppInstallationID(appClient *github.Client) (int64, error) {
+	installations, _, err := appClient.Apps.ListInstallations(context.Background(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("error listing GitHub App installations: %v", err)
+	}
+	if len(installations) == 1 {
+		return installations[0].GetID(), nil
+	}
+	var ids []string
+	for _, installation := range installations {
+		ids = append(ids, fmt.Sprintf("%d (%s)", installation.GetID(), installation.GetAccount().GetLogin()))
+	}
+	if len(ids) == 0 {
+		return 0, errors.New("the GitHub App has no installations")
+	}
+	return 0, fmt.Errorf("the GitHub App has several installations, set github.app.installation_id to one of: %s", strings.Join(ids, ", "))
+}
+
+// newGitHubAppJWT returns a JWT authenticating as the GitHub App appID
+func newGitHubAppJWT(appID int64, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		// Allow for clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(githubAppJWTLifetime).Unix(),
+		"iss": strconv.FormatInt(appID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseRSAPrivateKey parses a PKCS #1 or PKCS #8 PEM encoded RSA private key
+func parseRSAPrivateKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA private key")
+	}
+	return key, nil
+}
@@ -2,78 +2,87 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"time"
+
+	"golang.org/x/oauth2"
 )
 
-func handleGithubCreateUserMigration(client interface{}, c *appConfig) {
-	repos, err := getRepositories(
-		client,
-		c.service,
-		c.githubRepoType,
-		c.githubNamespaceWhitelist,
-		c.gitlabProjectVisibility,
-		c.gitlabProjectMembershipType,
-		c.ignoreFork,
-		c.forgejoRepoType,
-	)
+func handleGithubCreateUserMigration(client interface{}, c *appConfig) error {
+	if c.githubApp.configured() {
+		return errors.New("user migrations require a personal access token, they are not available to GitHub Apps")
+	}
+
+	ctx := context.Background()
+	if c.transport != nil {
+		// Download the migration archives with the proxy and TLS settings
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: c.transport})
+	}
+
+	repos, err := getRepositories(client, c)
 	if err != nil {
-		log.Fatalf("Error getting list of repositories: %v", err)
+		return fmt.Errorf("error getting list of repositories: %v", err)
 	}
 
 	log.Printf("Creating a user migration for %d repos", len(repos))
 	m, err := createGithubUserMigration(
-		context.Background(),
+		ctx,
 		client, repos,
 		c.githubCreateUserMigrationRetry,
 		c.githubCreateUserMigrationRetryMax,
 	)
 	if err != nil {
-		log.Fatalf("Error creating migration: %v", err)
+		return fmt.Errorf("error creating migration: %v", err)
 	}
 
 	if c.githubWaitForMigrationComplete {
 		migrationStatePollingDuration := 60 * time.Second
 		err = downloadGithubUserMigrationData(
-			context.Background(),
+			ctx,
 			client, c.backupDir,
 			m.ID,
 			migrationStatePollingDuration,
 		)
 		if err != nil {
-			log.Fatalf("Error querying/downloading migration: %v", err)
+			return fmt.Errorf("error querying/downloading migration: %v", err)
 		}
 	}
 
-	orgs, err := getGithubUserOwnedOrgs(context.Background(), client)
+	orgs, err := getGithubUserOwnedOrgs(ctx, client)
 	if err != nil {
-		log.Fatal("Error getting user organizations", err)
+		return fmt.Errorf("error getting user organizations: %v", err)
 	}
 	for _, o := range orgs {
-		orgRepos, err := getGithubOrgRepositories(context.Background(), client, o)
+		orgRepos, err := getGithubOrgRepositories(ctx, client, o)
 		if err != nil {
-			log.Fatal("Error getting org repos", err)
+			return fmt.Errorf("error getting org repos: %v", err)
 		}
 		if len(orgRepos) == 0 {
 			log.Printf("No repos found in %s", *o.Login)
 			continue
 		}
 		log.Printf("Creating a org migration (%s) for %d repos", *o.Login, len(orgRepos))
-		oMigration, err := createGithubOrgMigration(context.Background(), client, *o.Login, orgRepos)
+		oMigration, err := createGithubOrgMigration(ctx, client, *o.Login, orgRepos)
 		if err != nil {
-			log.Fatalf("Error creating migration: %v", err)
+			return fmt.Errorf("error creating org migration (%s): %v", *o.Login, err)
 		}
 		if c.githubWaitForMigrationComplete {
 			migrationStatePollingDuration := 60 * time.Second
-			downloadGithubOrgMigrationData(
-				context.Background(),
+			err = downloadGithubOrgMigrationData(
+				ctx,
 				client,
 				*o.Login,
 				c.backupDir,
 				oMigration.ID,
 				migrationStatePollingDuration,
 			)
+			if err != nil {
+				return fmt.Errorf("error querying/downloading org migration (%s): %v", *o.Login, err)
+			}
 		}
 	}
-
+	return nil
 }
@@ -3,16 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 
 	"github.com/google/go-github/v34/github"
 )
 
-func handleGithubListUserMigrations(client interface{}, c *appConfig) {
+func handleGithubListUserMigrations(client interface{}, c *appConfig) error {
 
 	mList, err := getGithubUserMigrations(client)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	for _, m := range mList {
@@ -32,4 +31,5 @@ func handleGithubListUserMigrations(client interface{}, c *appConfig) {
 		}
 		fmt.Printf("%v - %v - %v - %v\n", *mData.ID, *mData.CreatedAt, *mData.State, archiveURL)
 	}
+	return nil
 }
@@ -1,73 +1,227 @@
 package main
 
 import (
+	"fmt"
+	"path"
+	"strconv"
 	"strings"
 
 	gitlab "github.com/xanzy/go-gitlab"
 )
 
+// gitlabGroupsConfig selects GitLab groups whose projects, including the
+// projects of their subgroups, are backed up in addition to the projects
+// selected by the membership type
+type gitlabGroupsConfig struct {
+	Groups []string `yaml:"groups,omitempty"`
+	// IncludeArchived also backs up the archived projects of the groups
+	IncludeArchived bool `yaml:"include_archived,omitempty"`
+	// IncludeShared also backs up the projects shared with the groups
+	IncludeShared bool `yaml:"include_shared,omitempty"`
+}
+
 func getGitlabRepositories(
 	client *gitlab.Client,
 	gitlabProjectVisibility string, gitlabProjectMembershipType string,
+	gitlabGroups gitlabGroupsConfig,
+	filter filterConfig,
 	ignoreFork bool,
 ) ([]*Repository, error) {
 
 	var repositories []*Repository
 
-	var visibility gitlab.VisibilityValue
-	var boolTrue bool = true
-
-	gitlabListOptions := gitlab.ListProjectsOptions{}
-
-	switch gitlabProjectMembershipType {
-	case "owner":
-		gitlabListOptions.Owned = &boolTrue
-	case "member":
-		gitlabListOptions.Membership = &boolTrue
-	case "starred":
-		gitlabListOptions.Starred = &boolTrue
-	case "all":
-		gitlabListOptions.Owned = &boolTrue
-		gitlabListOptions.Membership = &boolTrue
-		gitlabListOptions.Starred = &boolTrue
+	// Projects can be listed by several membership types and in a group
+	seen := map[string]bool{}
+	addProjects := func(repos []*gitlab.Project, starred bool) error {
+		var list []*Repository
+		for _, repo := range repos {
+			if repo.ForkedFromProject != nil && ignoreFork {
+				continue
+			}
+			// Do not look up the size and language of projects listed before
+			if seen[repositoryKey(&Repository{ID: strconv.Itoa(repo.ID)})] {
+				continue
+			}
+			r, err := newGitlabRepository(client, repo, filter)
+			if err != nil {
+				return err
+			}
+			r.Starred = starred
+			list = append(list, r)
+		}
+		repositories = appendNewRepositories(repositories, seen, list)
+		return nil
 	}
 
+	var visibility *gitlab.VisibilityValue
+	var boolTrue bool = true
+	var boolFalse bool = false
+
 	if gitlabProjectVisibility != "all" {
+		var v gitlab.VisibilityValue
 		switch gitlabProjectVisibility {
 		case "public":
-			visibility = gitlab.PublicVisibility
+			v = gitlab.PublicVisibility
 		case "private":
-			visibility = gitlab.PrivateVisibility
+			v = gitlab.PrivateVisibility
 		case "internal":
 			fallthrough
 		case "default":
-			visibility = gitlab.InternalVisibility
+			v = gitlab.InternalVisibility
 		}
-		gitlabListOptions.Visibility = &visibility
+		visibility = &v
 	}
 
-	for {
-		repos, resp, err := client.Projects.ListProjects(&gitlabListOptions)
-		if err != nil {
-			return nil, err
+	// GitLab returns the projects matching all of the Owned, Membership and
+	// Starred options, so each membership type is listed separately. The
+	// projects of a member include the owned ones.
+	var membershipTypes []string
+	for _, membershipType := range orderRepoTypes(gitlabProjectMembershipType) {
+		if membershipType == "all" {
+			membershipTypes = append(membershipTypes, "member", "starred")
+		} else {
+			membershipTypes = append(membershipTypes, membershipType)
 		}
-		for _, repo := range repos {
-			if repo.ForkedFromProject != nil && ignoreFork {
-				continue
+	}
+	for _, membershipType := range orderRepoTypes(strings.Join(membershipTypes, ",")) {
+		// Only the projects of the groups are backed up with "none"
+		if membershipType == "none" {
+			continue
+		}
+		gitlabListOptions := gitlab.ListProjectsOptions{Visibility: visibility}
+		switch membershipType {
+		case "owner":
+			gitlabListOptions.Owned = &boolTrue
+		case "member":
+			gitlabListOptions.Membership = &boolTrue
+		case "starred":
+			gitlabListOptions.Starred = &boolTrue
+		}
+
+		// Only members see the statistics, which include the size
+		if filter.needsSize() {
+			gitlabListOptions.Statistics = &boolTrue
+		}
+
+		for {
+			repos, resp, err := client.Projects.ListProjects(&gitlabListOptions)
+			if err != nil {
+				return nil, err
+			}
+			if err := addProjects(repos, membershipType == "starred"); err != nil {
+				return nil, err
 			}
-			namespace := strings.Split(repo.PathWithNamespace, "/")[0]
-			cloneURL := getCloneURL(repo.WebURL, repo.SSHURLToRepo)
-			repositories = append(repositories, &Repository{
-				CloneURL:  cloneURL,
-				Name:      repo.Name,
-				Namespace: namespace,
-				Private:   repo.Visibility == "private",
-			})
+			if resp.NextPage == 0 {
+				break
+			}
+			gitlabListOptions.ListOptions.Page = resp.NextPage
 		}
-		if resp.NextPage == 0 {
-			break
+	}
+
+	for _, group := range gitlabGroups.Groups {
+		groupListOptions := gitlab.ListGroupProjectsOptions{
+			IncludeSubGroups: &boolTrue,
+			Visibility:       visibility,
+		}
+		// GitLab lists both archived and shared projects by default
+		if !gitlabGroups.IncludeArchived {
+			groupListOptions.Archived = &boolFalse
+		}
+		if !gitlabGroups.IncludeShared {
+			groupListOptions.WithShared = &boolFalse
+		}
+		for {
+			repos, resp, err := client.Groups.ListGroupProjects(group, &groupListOptions)
+			if err != nil {
+				return nil, fmt.Errorf("error listing the projects of group %s: %v", group, err)
+			}
+			if err := addProjects(repos, false); err != nil {
+				return nil, err
+			}
+			if resp.NextPage == 0 {
+				break
+			}
+			groupListOptions.ListOptions.Page = resp.NextPage
 		}
-		gitlabListOptions.ListOptions.Page = resp.NextPage
 	}
 	return repositories, nil
 }
+
+// newGitlabRepository returns the Repository to back up for project. The
+// primary language, and the size if it was not listed, are only looked up
+// when filter needs them, as each takes an API request.
+func newGitlabRepository(client *gitlab.Client, project *gitlab.Project, filter filterConfig) (*Repository, error) {
+	namespace, legacyNamespace := gitlabNamespaces(project.PathWithNamespace)
+	name, legacyName := gitlabName(project.PathWithNamespace, project.Name)
+	repo := &Repository{
+		ID:              strconv.Itoa(project.ID),
+		CloneURL:        getCloneURL(project.WebURL, project.SSHURLToRepo),
+		Name:            name,
+		Namespace:       namespace,
+		Private:         project.Visibility == gitlab.PrivateVisibility,
+		LegacyNamespace: legacyNamespace,
+		LegacyName:      legacyName,
+		Fork:            project.ForkedFromProject != nil,
+		Archived:        project.Archived,
+		Topics:          project.Topics,
+	}
+	// GitLab before 14.0 only reports tags
+	if repo.Topics == nil {
+		repo.Topics = project.TagList
+	}
+	if project.LastActivityAt != nil {
+		repo.PushedAt = *project.LastActivityAt
+	}
+
+	statistics := project.Statistics
+	if statistics == nil && filter.needsSize() {
+		// Project statistics are not available to everyone, the size is
+		// unknown then
+		p, _, err := client.Projects.GetProject(project.ID, &gitlab.GetProjectOptions{Statistics: gitlab.Bool(true)})
+		if err == nil {
+			statistics = p.Statistics
+		}
+	}
+	if statistics != nil {
+		repo.Size = statistics.RepositorySize
+	}
+
+	if filter.needsLanguage() {
+		languages, _, err := client.Projects.GetProjectLanguages(project.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error getting the languages of %s: %v", project.PathWithNamespace, err)
+		}
+		var share float32
+		for language, percent := range *languages {
+			if percent > share || (percent == share && language < repo.Language) {
+				repo.Language, share = language, percent
+			}
+		}
+	}
+	return repo, nil
+}
+
+// gitlabName returns the path of a project, such as my-project, which is
+// its name in URLs. Earlier versions of gitbackup used the display name,
+// such as "My Project", which is returned as the legacy name if it differs.
+func gitlabName(pathWithNamespace, displayName string) (string, string) {
+	name := path.Base(pathWithNamespace)
+	if displayName == "" || displayName == name {
+		return name, ""
+	}
+	return name, displayName
+}
+
+// gitlabNamespaces returns the full namespace path of a project, such as
+// org/team-a for org/team-a/api, so that projects of subgroups are backed
+// up to nested directories. Earlier versions of gitbackup only used the
+// top-level group, which is returned as the legacy namespace of projects
+// in subgroups.
+func gitlabNamespaces(pathWithNamespace string) (string, string) {
+	namespace := path.Dir(pathWithNamespace)
+	topLevel := strings.Split(pathWithNamespace, "/")[0]
+	if topLevel == namespace {
+		return namespace, ""
+	}
+	return namespace, topLevel
+}
@@ -4,7 +4,6 @@ go 1.25.0
 
 require (
 	github.com/99designs/keyring v1.2.2
-	github.com/cli/oauth v1.2.2
 	github.com/google/go-github/v34 v34.0.0
 	github.com/ktrysmt/go-bitbucket v0.9.95
 	github.com/migueleliasweb/go-github-mock v0.0.22
@@ -18,6 +17,8 @@ require (
 require (
 	codeberg.org/mvdkleijn/forgejo-sdk/forgejo/v2 v2.2.0
 	github.com/urfave/cli/v2 v2.27.7
+	golang.org/x/sys v0.42.0
+	golang.org/x/term v0.41.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -43,7 +44,5 @@ require (
 	github.com/xrash/smetrics v0.0.0-20240521201337-686a1a2994c1 // indirect
 	golang.org/x/crypto v0.49.0 // indirect
 	golang.org/x/net v0.52.0 // indirect
-	golang.org/x/sys v0.42.0 // indirect
-	golang.org/x/term v0.41.0 // indirect
 	golang.org/x/time v0.12.0 // indirect
 )
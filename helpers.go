@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"net/url"
+	"strings"
 
 	forgejo "codeberg.org/mvdkleijn/forgejo-sdk/forgejo/v2"
 	"github.com/google/go-github/v34/github"
@@ -10,58 +12,62 @@ import (
 	gitlab "github.com/xanzy/go-gitlab"
 )
 
+// getCloneUsername returns the username used with the token of c for HTTPS
+// clones
+func getCloneUsername(client interface{}, c *appConfig) (string, error) {
+	if c.service == "github" && c.githubApp.configured() {
+		return githubAppUsername, nil
+	}
+	return getUsername(client, c.service)
+}
+
 // getUsername retrieves the username for the authenticated user from the git service
-func getUsername(client interface{}, service string) string {
+func getUsername(client interface{}, service string) (string, error) {
 
 	if client == nil {
-		log.Fatalf("Couldn't acquire a client to talk to %s", service)
+		return "", fmt.Errorf("couldn't acquire a client to talk to %s", service)
 	}
 
 	if service == "github" {
 		ctx := context.Background()
 		user, _, err := client.(*github.Client).Users.Get(ctx, "")
 		if err != nil {
-			log.Fatal("Error retrieving username", err.Error())
+			return "", fmt.Errorf("error retrieving username: %v", err)
 		}
-		return *user.Login
+		return *user.Login, nil
 	}
 
 	if service == "gitlab" {
 		user, _, err := client.(*gitlab.Client).Users.CurrentUser()
 		if err != nil {
-			log.Fatal("Error retrieving username", err.Error())
+			return "", fmt.Errorf("error retrieving username: %v", err)
 		}
-		return user.Username
+		return user.Username, nil
 	}
 
 	if service == "bitbucket" {
 		user, err := client.(*bitbucket.Client).User.Profile()
 		if err != nil {
-			log.Fatal("Error retrieving username", err.Error())
+			return "", fmt.Errorf("error retrieving username: %v", err)
 		}
-		return user.Username
+		return user.Username, nil
 	}
 
 	if service == "forgejo" {
 		user, _, err := client.(*forgejo.Client).GetMyUserInfo()
 		if err != nil {
-			log.Fatal("Error retrieving username", err.Error())
+			return "", fmt.Errorf("error retrieving username: %v", err)
 		}
-		return user.UserName
+		return user.UserName, nil
 	}
 
-	return ""
+	return "", nil
 }
 
-// validGitlabProjectMembership checks if the given membership type is valid
+// validGitlabProjectMembership checks if the given comma separated list of
+// membership types is valid
 func validGitlabProjectMembership(membership string) bool {
-	validMemberships := []string{"all", "owner", "member", "starred"}
-	for _, m := range validMemberships {
-		if membership == m {
-			return true
-		}
-	}
-	return false
+	return validateRepoTypes("gitlab project membership", membership, gitlabMembershipTypes) == ""
 }
 
 // contains checks if a string exists in a slice of strings
@@ -80,4 +86,21 @@ func getCloneURL(httpsURL, sshURL string) string {
 		return httpsURL
 	}
 	return sshURL
-}
\ No newline at end of file
+}
+
+// getCloneURLHost returns the host name of an HTTPS, SSH or scp-like
+// (git@host:path) clone URL
+func getCloneURLHost(cloneURL string) string {
+	u, err := url.Parse(cloneURL)
+	if err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	host, _, ok := strings.Cut(cloneURL, ":")
+	if !ok {
+		return ""
+	}
+	if _, h, ok := strings.Cut(host, "@"); ok {
+		host = h
+	}
+	return host
+}
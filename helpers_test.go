@@ -67,3 +67,18 @@ func TestValidGitlabProjectMembership(t *testing.T) {
 		}
 	}
 }
+
+func TestGetCloneURLHost(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/user/repo.git":       "github.com",
+		"https://user@bitbucket.org/abc/def.git": "bitbucket.org",
+		"ssh://git@gitlab.example.com:2222/g/r":  "gitlab.example.com",
+		"git@codeberg.org:abc/def.git":           "codeberg.org",
+		"not a url":                              "",
+	}
+	for cloneURL, want := range tests {
+		if got := getCloneURLHost(cloneURL); got != want {
+			t.Errorf("getCloneURLHost(%q) = %q, want %q", cloneURL, got, want)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultHookTimeout is how long a hook may run unless it sets a timeout
+const defaultHookTimeout = 10 * time.Minute
+
+// hookSkipExitCode is the exit code with which a pre_repo hook skips the
+// repository, any other non-zero exit code fails its backup
+const hookSkipExitCode = 99
+
+// Hooks, in the order they run
+const (
+	hookPreRun    = "pre_run"
+	hookPreRepo   = "pre_repo"
+	hookPostRepo  = "post_repo"
+	hookPostRun   = "post_run"
+	hookOnFailure = "on_failure"
+)
+
+// hooksConfig configures the commands run around the backup of a target
+// and of each of its repositories
+type hooksConfig struct {
+	PreRun    *hookConfig `yaml:"pre_run,omitempty"`
+	PostRun   *hookConfig `yaml:"post_run,omitempty"`
+	PreRepo   *hookConfig `yaml:"pre_repo,omitempty"`
+	PostRepo  *hookConfig `yaml:"post_repo,omitempty"`
+	OnFailure *hookConfig `yaml:"on_failure,omitempty"`
+}
+
+// hookConfig is a command run by the shell, sh on Unix and cmd on Windows.
+// The config file may give just the command.
+type hookConfig struct {
+	Command string `yaml:"command"`
+	// Timeout is how long the command may run before it is killed, the
+	// defaultHookTimeout if it is 0
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// UnmarshalYAML accepts both a command and a mapping with the command and
+// its timeout
+func (h *hookConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&h.Command)
+	}
+	type plain hookConfig
+	return value.Decode((*plain)(h))
+}
+
+func (h *hookConfig) timeout() time.Duration {
+	if h.Timeout == 0 {
+		return defaultHookTimeout
+	}
+	return h.Timeout
+}
+
+// validateHooksConfig returns the problems found in the hooks of a target
+func validateHooksConfig(h hooksConfig) []string {
+	var errors []string
+	for _, hook := range []struct {
+		name string
+		hook *hookConfig
+	}{
+		{hookPreRun, h.PreRun},
+		{hookPostRun, h.PostRun},
+		{hookPreRepo, h.PreRepo},
+		{hookPostRepo, h.PostRepo},
+		{hookOnFailure, h.OnFailure},
+	} {
+		if hook.hook == nil {
+			continue
+		}
+		if strings.TrimSpace(hook.hook.Command) == "" {
+			errors = append(errors, fmt.Sprintf("hooks.%s requires a command", hook.name))
+		}
+		if hook.hook.Timeout < 0 {
+			errors = append(errors, fmt.Sprintf("hooks.%s.timeout must not be negative", hook.name))
+		}
+	}
+	return errors
+}
+
+// errHookSkip is returned by a pre_repo hook which exits with the
+// hookSkipExitCode
+var errHookSkip = errors.New("skipped by the pre_repo hook")
+
+// runHook runs hook, if it is configured, with the environment variables
+// describing the target of c and env. The output of the command goes to
+// stderr, so that it does not mix with the output of list or doctor.
+func runHook(name string, hook *hookConfig, c *appConfig, env ...string) error {
+	if hook == nil {
+		return nil
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = execCommand("cmd", "/C", hook.Command)
+	} else {
+		cmd = execCommand("sh", "-c", hook.Command)
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env,
+		"GITBACKUP_HOOK="+name,
+		"GITBACKUP_TARGET="+targetName(c),
+		"GITBACKUP_SERVICE="+c.service,
+		"GITBACKUP_BACKUP_DIR="+c.backupDir,
+	)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%s hook: %v", name, err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	timer := time.NewTimer(hook.timeout())
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		var exitErr *exec.ExitError
+		if name == hookPreRepo && errors.As(err, &exitErr) && exitErr.ExitCode() == hookSkipExitCode {
+			return errHookSkip
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook: %v", name, err)
+		}
+		return nil
+	case <-timer.C:
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("%s hook: timed out after %s", name, hook.timeout())
+	}
+}
+
+// repoHookEnv returns the environment variables describing repo to the
+// pre_repo and post_repo hooks
+func repoHookEnv(c *appConfig, repo *Repository) []string {
+	return []string{
+		"GITBACKUP_REPO=" + repo.Namespace + "/" + repo.Name,
+		"GITBACKUP_REPO_NAMESPACE=" + repo.Namespace,
+		"GITBACKUP_REPO_NAME=" + repo.Name,
+		"GITBACKUP_REPO_URL=" + repo.CloneURL,
+		"GITBACKUP_REPO_PATH=" + targetRepoDir(c, repo),
+		"GITBACKUP_REPO_PRIVATE=" + strconv.FormatBool(repo.Private),
+	}
+}
+
+// runHookEnv returns the environment variables describing the outcome of
+// the run of a target to the post_run and on_failure hooks
+func runHookEnv(report *runReport) []string {
+	result := "success"
+	if report.Failed() {
+		result = "failure"
+	}
+	return []string{
+		"GITBACKUP_RESULT=" + result,
+		"GITBACKUP_ERROR=" + report.Error,
+		"GITBACKUP_LISTED=" + strconv.Itoa(report.Listed),
+		"GITBACKUP_CLONED=" + strconv.Itoa(len(report.Cloned())),
+		"GITBACKUP_UPDATED=" + strconv.Itoa(len(report.Updated())),
+		"GITBACKUP_UNCHANGED=" + strconv.Itoa(len(report.Unchanged())),
+		"GITBACKUP_SKIPPED=" + strconv.Itoa(len(report.Skipped())),
+		"GITBACKUP_FAILED=" + strconv.Itoa(len(report.FailedRepos())),
+	}
+}
+
+// recordBackupMetrics records the result of the backup of repo of the
+// target c. The size of the repository is only measured, by walking its
+// files, when the metrics are output.
+func recordBackupMetrics(c *appConfig, repo *Repository, action backupAction, err error) {
+	if err != nil {
+		metrics.recordRepoResult(targetName(c), "failed")
+		return
+	}
+	metrics.recordRepoResult(targetName(c), string(action))
+	if action == backupActionSkipped {
+		return
+	}
+	var size int64
+	if metrics.isEnabled() {
+		size = getDirSize(targetRepoDir(c, repo))
+	}
+	metrics.recordRepoSuccess(c.backupDir, repo, size)
+}
+
+// backUpRepository backs up repo of the target c, running the pre_repo and
+// post_repo hooks around the backup. It returns what was done with the
+// repository, whether it changed, and the output of git.
+func backUpRepository(c *appConfig, repo *Repository, opts *cloneOptions) (backupAction, bool, []byte, error) {
+	if err := runHook(hookPreRepo, c.hooks.PreRepo, c, repoHookEnv(c, repo)...); err != nil {
+		if err == errHookSkip {
+			log.Printf("Skipping %s/%s: %v\n", repo.Namespace, repo.Name, err)
+			metrics.recordRepoResult(targetName(c), string(backupActionSkipped))
+			return backupActionSkipped, false, nil, nil
+		}
+		metrics.recordRepoResult(targetName(c), "failed")
+		return "", false, nil, err
+	}
+
+	action, stdoutStderr, err := backUp(c.backupDir, repo, c.bare, opts)
+	recordBackupMetrics(c, repo, action, err)
+	changed := err == nil && (action == backupActionCloned ||
+		(action == backupActionUpdated && repoUpdateChanged(stdoutStderr, c.bare)))
+
+	if c.hooks.PostRepo != nil {
+		result, errText := "success", ""
+		if err != nil {
+			result, errText = "failure", redactSecrets(err.Error())
+		}
+		env := append(repoHookEnv(c, repo),
+			"GITBACKUP_ACTION="+string(action),
+			"GITBACKUP_CHANGED="+strconv.FormatBool(changed),
+			"GITBACKUP_RESULT="+result,
+			"GITBACKUP_ERROR="+errText,
+		)
+		if hookErr := runHook(hookPostRepo, c.hooks.PostRepo, c, env...); hookErr != nil {
+			if err == nil {
+				return action, changed, nil, hookErr
+			}
+			log.Printf("post_repo hook for %s/%s failed: %v\n", repo.Namespace, repo.Name, hookErr)
+		}
+	}
+	return action, changed, stdoutStderr, err
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
+)
+
+// fakeHookCommand runs the hooks, and git, in TestHelperHookProcess, which
+// records the hooks it runs in recordFile
+func fakeHookCommand(recordFile string) func(string, ...string) *exec.Cmd {
+	return func(command string, args ...string) *exec.Cmd {
+		cs := []string{"-test.run=TestHelperHookProcess", "--", command}
+		cs = append(cs, args...)
+		cmd := exec.Command(os.Args[0], cs...)
+		cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1", "HOOK_RECORD_FILE=" + recordFile}
+		return cmd
+	}
+}
+
+// TestHelperHookProcess understands the hook commands "record", which
+// records the hook and the repository, "sleep" and "exit N"
+func TestHelperHookProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	if os.Args[3] == "git" {
+		os.Exit(0)
+	}
+	fields := strings.Fields(os.Args[len(os.Args)-1])
+	for i, field := range fields {
+		switch field {
+		case "record":
+			f, err := os.OpenFile(os.Getenv("HOOK_RECORD_FILE"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				os.Exit(2)
+			}
+			fmt.Fprintf(f, "%s %s %s %s %s\n", os.Getenv("GITBACKUP_HOOK"), os.Getenv("GITBACKUP_TARGET"),
+				os.Getenv("GITBACKUP_REPO"), os.Getenv("GITBACKUP_ACTION"), os.Getenv("GITBACKUP_RESULT"))
+			f.Close()
+		case "sleep":
+			time.Sleep(10 * time.Second)
+		case "exit":
+			code, _ := strconv.Atoi(fields[i+1])
+			os.Exit(code)
+		}
+	}
+	os.Exit(0)
+}
+
+// useFakeHooks runs the hooks in TestHelperHookProcess and returns a
+// function returning the hooks which were recorded
+func useFakeHooks(t *testing.T) func() string {
+	recordFile := filepath.Join(t.TempDir(), "hooks")
+	execCommand = fakeHookCommand(recordFile)
+	t.Cleanup(func() { execCommand = exec.Command })
+	return func() string {
+		data, _ := os.ReadFile(recordFile)
+		os.Remove(recordFile)
+		return string(data)
+	}
+}
+
+func TestHooksConfig(t *testing.T) {
+	var cfg targetConfig
+	err := yaml.Unmarshal([]byte(`
+hooks:
+  pre_run: zfs snapshot tank/backup@gitbackup
+  post_repo:
+    command: scan-repo "$GITBACKUP_REPO_PATH"
+    timeout: 30s
+`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Hooks.PreRun == nil || cfg.Hooks.PreRun.Command != "zfs snapshot tank/backup@gitbackup" || cfg.Hooks.PreRun.timeout() != defaultHookTimeout {
+		t.Errorf("Unexpected pre_run hook: %+v", cfg.Hooks.PreRun)
+	}
+	if cfg.Hooks.PostRepo == nil || cfg.Hooks.PostRepo.Timeout != 30*time.Second {
+		t.Errorf("Unexpected post_repo hook: %+v", cfg.Hooks.PostRepo)
+	}
+	if errs := validateHooksConfig(cfg.Hooks); len(errs) != 0 {
+		t.Errorf("Expected no errors, got: %v", errs)
+	}
+
+	errs := validateHooksConfig(hooksConfig{PreRepo: &hookConfig{}, OnFailure: &hookConfig{Command: "alert", Timeout: -time.Second}})
+	if len(errs) != 2 {
+		t.Errorf("Expected errors for a missing command and a negative timeout, got: %v", errs)
+	}
+}
+
+func TestRunHook(t *testing.T) {
+	recorded := useFakeHooks(t)
+	c := &appConfig{name: "work", service: "github", backupDir: "/backup/github.com"}
+
+	if err := runHook(hookPreRun, &hookConfig{Command: "record"}, c); err != nil {
+		t.Fatal(err)
+	}
+	if got := recorded(); got != "pre_run work   \n" {
+		t.Errorf("Unexpected hook environment: %q", got)
+	}
+	if err := runHook(hookPreRun, nil, c); err != nil {
+		t.Errorf("Expected no error without a hook, got: %v", err)
+	}
+
+	err := runHook(hookPostRun, &hookConfig{Command: "exit 3"}, c)
+	if err == nil || !strings.Contains(err.Error(), "post_run hook: exit status 3") {
+		t.Errorf("Expected the hook to fail, got: %v", err)
+	}
+	if err := runHook(hookPreRepo, &hookConfig{Command: "exit 99"}, c); err != errHookSkip {
+		t.Errorf("Expected the pre_repo hook to skip the repository, got: %v", err)
+	}
+	if err := runHook(hookPostRepo, &hookConfig{Command: "exit 99"}, c); err == nil || err == errHookSkip {
+		t.Errorf("Expected only pre_repo hooks to skip repositories, got: %v", err)
+	}
+
+	start := time.Now()
+	err = runHook(hookPostRepo, &hookConfig{Command: "sleep", Timeout: 200 * time.Millisecond}, c)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 200ms") {
+		t.Errorf("Expected the hook to time out, got: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected the hook to be killed, it ran for %s", time.Since(start))
+	}
+}
+
+func TestBackUpRepositoryHooks(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	recorded := useFakeHooks(t)
+	c := &appConfig{service: "github", backupDir: "/backup/github.com", hooks: hooksConfig{
+		PreRepo:  &hookConfig{Command: "record"},
+		PostRepo: &hookConfig{Command: "record"},
+	}}
+	repo := &Repository{Namespace: "org", Name: "api", CloneURL: "git@github.com:org/api.git"}
+
+	action, changed, _, err := backUpRepository(c, repo, nil)
+	if err != nil || action != backupActionCloned || !changed {
+		t.Fatalf("Expected the repository to be cloned, got: %v %v %v", action, changed, err)
+	}
+	if got := recorded(); got != "pre_repo github org/api  \npost_repo github org/api cloned success\n" {
+		t.Errorf("Unexpected hooks: %q", got)
+	}
+
+	// The pre_repo hook skips the repository
+	c.hooks.PreRepo = &hookConfig{Command: "record exit 99"}
+	action, _, _, err = backUpRepository(c, repo, nil)
+	if err != nil || action != backupActionSkipped {
+		t.Errorf("Expected the repository to be skipped, got: %v %v", action, err)
+	}
+	if got := recorded(); got != "pre_repo github org/api  \n" {
+		t.Errorf("Expected no post_repo hook for a skipped repository, got: %q", got)
+	}
+
+	c.hooks.PreRepo = &hookConfig{Command: "exit 1"}
+	if _, _, _, err = backUpRepository(c, repo, nil); err == nil || !strings.Contains(err.Error(), "pre_repo hook") {
+		t.Errorf("Expected the failed pre_repo hook to fail the backup, got: %v", err)
+	}
+
+	// A failed post_repo hook fails the backup
+	c.hooks.PreRepo = nil
+	c.hooks.PostRepo = &hookConfig{Command: "exit 1"}
+	if _, _, _, err = backUpRepository(c, repo, nil); err == nil || !strings.Contains(err.Error(), "post_repo hook") {
+		t.Errorf("Expected the failed post_repo hook to fail the backup, got: %v", err)
+	}
+}
+
+func TestRunTargetHooks(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	recorded := useFakeHooks(t)
+	os.Unsetenv("UNSET_TOKEN_ONE")
+
+	hooks := hooksConfig{
+		PreRun:    &hookConfig{Command: "record"},
+		PostRun:   &hookConfig{Command: "record"},
+		OnFailure: &hookConfig{Command: "record"},
+	}
+	c := &appConfig{name: "one", service: "gitlab", backupDir: "/tmp/one", credentials: credentialsConfig{TokenEnv: "UNSET_TOKEN_ONE"}, hooks: hooks}
+	if _, err := runTarget(c); err == nil {
+		t.Fatal("Expected the target to fail")
+	}
+	if got := recorded(); got != "pre_run one   \npost_run one   failure\non_failure one   failure\n" {
+		t.Errorf("Unexpected hooks: %q", got)
+	}
+
+	// A failed pre_run hook fails the run, without running post_run
+	c.hooks.PreRun = &hookConfig{Command: "exit 1"}
+	report, err := runTarget(c)
+	if err == nil || !strings.Contains(err.Error(), "pre_run hook") || !strings.Contains(report.Error, "pre_run hook") {
+		t.Errorf("Expected the pre_run hook to fail the run, got: %v", err)
+	}
+	if got := recorded(); got != "on_failure one   failure\n" {
+		t.Errorf("Unexpected hooks: %q", got)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/99designs/keyring"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+const keyringPassphraseEnvVar = "GITBACKUP_KEYRING_PASSPHRASE"
+
+// keyringConfig selects the keyring backend credentials are stored in
+type keyringConfig struct {
+	// Backend is one of keyringBackends, empty to use the first available
+	Backend string
+	// FileDir is the directory of the encrypted file backend
+	FileDir string
+	// PassphraseFile contains the passphrase of the encrypted file backend
+	PassphraseFile string
+}
+
+// keyringSettings is the keyring configuration of the running command
+var keyringSettings keyringConfig
+
+// keyringBackends are the backends which can be selected, in the order
+// they are tried when none is selected
+var keyringBackends = []keyring.BackendType{
+	keyring.WinCredBackend,
+	keyring.KeychainBackend,
+	keyring.SecretServiceBackend,
+	keyring.KWalletBackend,
+	keyring.KeyCtlBackend,
+	keyring.PassBackend,
+	keyring.FileBackend,
+}
+
+// keyringFlags returns the CLI flags which configure the keyring
+func keyringFlags() []cli.Flag {
+	names := make([]string, 0, len(keyringBackends))
+	for _, b := range keyringBackends {
+		names = append(names, string(b))
+	}
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "keyring.backend",
+			Usage:       fmt.Sprintf("Keyring backend to store credentials in (%s)", strings.Join(names, "/")),
+			EnvVars:     []string{"GITBACKUP_KEYRING_BACKEND"},
+			DefaultText: "the first available",
+		},
+		&cli.StringFlag{
+			Name:        "keyring.fileDir",
+			Usage:       "Directory of the encrypted file keyring",
+			EnvVars:     []string{"GITBACKUP_KEYRING_FILE_DIR"},
+			DefaultText: "gitbackup/keyring in the OS config directory",
+		},
+		&cli.StringFlag{
+			Name:    "keyring.passphraseFile",
+			Usage:   "File containing the passphrase of the encrypted file keyring (or set " + keyringPassphraseEnvVar + ")",
+			EnvVars: []string{"GITBACKUP_KEYRING_PASSPHRASE_FILE"},
+		},
+	}
+}
+
+// configureKeyring sets the keyring configuration from the CLI flags
+func configureKeyring(cCtx *cli.Context) error {
+	k := keyringConfig{
+		Backend:        cCtx.String("keyring.backend"),
+		FileDir:        cCtx.String("keyring.fileDir"),
+		PassphraseFile: cCtx.String("keyring.passphraseFile"),
+	}
+	if err := validateKeyringConfig(k); err != nil {
+		return err
+	}
+	keyringSettings = k
+	return nil
+}
+
+func validateKeyringConfig(k keyringConfig) error {
+	if k.Backend == "" {
+		return nil
+	}
+	for _, b := range keyringBackends {
+		if k.Backend == string(b) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid keyring backend: %s", k.Backend)
+}
+
+// openConfiguredKeyring opens the keyring backend selected by k
+func openConfiguredKeyring(k keyringConfig) (keyring.Keyring, error) {
+	fileDir := k.FileDir
+	if fileDir == "" {
+		configDir, err := os.UserConfigDir()
+		if err == nil {
+			fileDir = filepath.Join(configDir, "gitbackup", "keyring")
+		}
+	}
+	cfg := keyring.Config{
+		ServiceName:      keyringServiceName,
+		FileDir:          fileDir,
+		FilePasswordFunc: keyringPassphraseFunc(k),
+	}
+	if k.Backend != "" {
+		cfg.AllowedBackends = []keyring.BackendType{keyring.BackendType(k.Backend)}
+	}
+
+	ring, err := keyring.Open(cfg)
+	if errors.Is(err, keyring.ErrNoAvailImpl) {
+		if k.Backend != "" {
+			return nil, fmt.Errorf("the %s keyring backend is not available on this system", k.Backend)
+		}
+		return nil, errors.New("no keyring backend is available, use --keyring.backend file")
+	}
+	return ring, err
+}
+
+// keyringPassphraseFunc returns the function the encrypted file backend
+// gets its passphrase from: the passphrase file, the environment or the
+// terminal, in that order
+func keyringPassphraseFunc(k keyringConfig) keyring.PromptFunc {
+	return func(prompt string) (string, error) {
+		if k.PassphraseFile != "" {
+			data, err := os.ReadFile(k.PassphraseFile)
+			if err != nil {
+				return "", fmt.Errorf("error reading keyring passphrase file: %v", err)
+			}
+			return strings.TrimRight(string(data), "\r\n"), nil
+		}
+		if passphrase := os.Getenv(keyringPassphraseEnvVar); passphrase != "" {
+			return passphrase, nil
+		}
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			fmt.Fprintf(os.Stderr, "%s: ", prompt)
+			data, err := term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Fprintln(os.Stderr)
+			return string(data), err
+		}
+		return "", fmt.Errorf("the file keyring needs a passphrase, set %s or --keyring.passphraseFile", keyringPassphraseEnvVar)
+	}
+}
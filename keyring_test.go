@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/99designs/keyring"
+)
+
+func TestValidateKeyringConfig(t *testing.T) {
+	for _, backend := range []string{"", "file", "secret-service", "keychain"} {
+		if err := validateKeyringConfig(keyringConfig{Backend: backend}); err != nil {
+			t.Errorf("Expected backend %q to be valid, got: %v", backend, err)
+		}
+	}
+	if err := validateKeyringConfig(keyringConfig{Backend: "vault"}); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+}
+
+func TestFileKeyringPassphraseEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(keyringPassphraseEnvVar, "correct horse")
+
+	k := keyringConfig{Backend: "file", FileDir: dir}
+	ring, err := openConfiguredKeyring(k)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := ring.Set(keyring.Item{Key: "gitlab:gitlab.com", Data: []byte("secret")}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	// The item is encrypted on disk
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected one keyring file, got: %v", files)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if strings.Contains(string(data), "secret") {
+		t.Error("Expected the keyring file to be encrypted")
+	}
+
+	ring, _ = openConfiguredKeyring(k)
+	item, err := ring.Get("gitlab:gitlab.com")
+	if err != nil || string(item.Data) != "secret" {
+		t.Errorf("Expected the item to be read back, got: %v, %v", string(item.Data), err)
+	}
+
+	t.Setenv(keyringPassphraseEnvVar, "wrong")
+	ring, _ = openConfiguredKeyring(k)
+	if _, err := ring.Get("gitlab:gitlab.com"); err == nil {
+		t.Error("Expected an error with the wrong passphrase")
+	}
+}
+
+func TestFileKeyringPassphraseFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(keyringPassphraseEnvVar, "")
+	passphraseFile := filepath.Join(dir, "passphrase")
+	os.WriteFile(passphraseFile, []byte("from a file\n"), 0600)
+
+	k := keyringConfig{Backend: "file", FileDir: filepath.Join(dir, "keyring"), PassphraseFile: passphraseFile}
+	ring, err := openConfiguredKeyring(k)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := ring.Set(keyring.Item{Key: "forgejo:codeberg.org", Data: []byte("secret")}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	// The trailing newline is not part of the passphrase
+	t.Setenv(keyringPassphraseEnvVar, "from a file")
+	ring, _ = openConfiguredKeyring(keyringConfig{Backend: "file", FileDir: filepath.Join(dir, "keyring")})
+	if _, err := ring.Get("forgejo:codeberg.org"); err != nil {
+		t.Errorf("Expected the item to be read with the passphrase, got: %v", err)
+	}
+}
+
+func TestFileKeyringWithoutPassphrase(t *testing.T) {
+	t.Setenv(keyringPassphraseEnvVar, "")
+	ring, err := openConfiguredKeyring(keyringConfig{Backend: "file", FileDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	// Tests do not run on a terminal, so the passphrase cannot be prompted for
+	err = ring.Set(keyring.Item{Key: "github:github.com", Data: []byte("secret")})
+	if err == nil || !strings.Contains(err.Error(), keyringPassphraseEnvVar) {
+		t.Errorf("Expected an error naming %s, got: %v", keyringPassphraseEnvVar, err)
+	}
+}
+
+func TestUnavailableKeyringBackend(t *testing.T) {
+	backend := "wincred"
+	if runtime.GOOS == "windows" {
+		backend = "keychain"
+	}
+	_, err := openConfiguredKeyring(keyringConfig{Backend: backend})
+	if err == nil || !strings.Contains(err.Error(), "not available") {
+		t.Errorf("Expected an error for an unavailable backend, got: %v", err)
+	}
+}
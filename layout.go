@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// layoutPlaceholder matches the placeholders of a layout template
+var layoutPlaceholder = regexp.MustCompile(`\{([a-z_]*)\}`)
+
+// layoutPlaceholders are the placeholders a layout template may use
+var layoutPlaceholders = []string{"host", "service", "owner", "namespace_path", "name", "visibility", "subdir"}
+
+// validateLayout returns the problems found in the layout template of a
+// target. starredSubdir must be placed by the layout with {subdir}.
+func validateLayout(layout string, starredSubdir string) []string {
+	if layout == "" {
+		return nil
+	}
+	var errors []string
+	for _, m := range layoutPlaceholder.FindAllStringSubmatch(layout, -1) {
+		if !contains(layoutPlaceholders, m[1]) {
+			errors = append(errors, fmt.Sprintf("invalid layout: unknown placeholder %s", m[0]))
+		}
+	}
+	if !strings.Contains(layout, "{name}") {
+		errors = append(errors, "invalid layout: {name} is required")
+	}
+	clean := path.Clean(strings.ReplaceAll(layout, "\\", "/"))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") || strings.Contains(clean, "/../") {
+		errors = append(errors, fmt.Sprintf("invalid layout: %q must be relative to the backup directory", layout))
+	}
+	if starredSubdir != "" && !strings.Contains(layout, "{subdir}") {
+		errors = append(errors, "invalid layout: {subdir} is required with starred_subdir")
+	}
+	return errors
+}
+
+// expandLayout returns the directory of repo relative to the backup root
+// as given by the layout template
+func expandLayout(layout string, c *appConfig, repo *Repository) string {
+	visibility := "public"
+	if repo.Private {
+		visibility = "private"
+	}
+	// buildConfigs has rejected invalid githost URLs
+	host, _ := getGitHost(c.service, c.gitHostURL)
+	values := map[string]string{
+		"host":           host,
+		"service":        c.service,
+		"owner":          sanitizePathSegment(strings.Split(repo.Namespace, "/")[0]),
+		"namespace_path": sanitizeNamespace(repo.Namespace),
+		"name":           sanitizePathSegment(repo.Name),
+		"visibility":     visibility,
+		"subdir":         repo.Subdir,
+	}
+	expanded := layoutPlaceholder.ReplaceAllStringFunc(layout, func(placeholder string) string {
+		return values[strings.Trim(placeholder, "{}")]
+	})
+	// Empty placeholders, such as {subdir} of repositories which are not
+	// starred, leave no empty directories
+	return path.Clean(expanded)
+}
+
+// layoutRepoDir returns the directory repo is backed up to with the layout
+// template, or with the default layout if it is empty
+func layoutRepoDir(layout string, c *appConfig, repo *Repository) string {
+	if layout == "" {
+		return getRepoDir(c.backupDir, repo, c.bare)
+	}
+	return path.Join(c.backupRoot, expandLayout(layout, c, repo))
+}
+
+// assignRepoDirs sets the directories the repositories are backed up to
+// with the starred_subdir and the layout of the target, giving repositories
+// whose directories collide a directory of their own
+func assignRepoDirs(c *appConfig, repositories []*Repository) {
+	for _, repo := range repositories {
+		if repo.Starred && c.starredSubdir != "" {
+			repo.Subdir = c.starredSubdir
+		}
+		if c.layout != "" {
+			repo.Dir = layoutRepoDir(c.layout, c, repo)
+		}
+	}
+	resolveRepoDirs(c, repositories)
+}
+
+// targetRepoDir returns the directory repo is backed up to, once
+// assignRepoDirs has set the directories of the repositories of the target
+func targetRepoDir(c *appConfig, repo *Repository) string {
+	if repo.Dir != "" {
+		return repo.Dir
+	}
+	return getRepoDir(c.backupDir, repo, c.bare)
+}
+
+func relayoutCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "relayout",
+		Usage: "Move the existing backups from a previous layout to the configured layout",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "from",
+				Usage:       "Layout template the backups were made with",
+				DefaultText: "the default layout",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Only print the moves",
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			if err := configureKeyring(cCtx); err != nil {
+				return err
+			}
+			configs, _, err := buildConfigs(cCtx)
+			if err != nil {
+				return err
+			}
+			for _, c := range configs {
+				if err := validateConfig(c); err != nil {
+					return fmt.Errorf("target %s: %v", targetName(c), err)
+				}
+				if errs := validateLayout(cCtx.String("from"), c.starredSubdir); len(errs) > 0 {
+					return fmt.Errorf("--from: %s", strings.Join(errs, ", "))
+				}
+			}
+			for _, c := range configs {
+				c.dryRun = cCtx.Bool("dry-run")
+				if !c.dryRun {
+					if err := setupBackupDir(c); err != nil {
+						return fmt.Errorf("target %s: %v", targetName(c), err)
+					}
+				}
+				client, err := newClient(c)
+				if err != nil {
+					return fmt.Errorf("target %s: %v", targetName(c), err)
+				}
+				_, repositories, err := listGitRepositories(client, c)
+				if err != nil {
+					return fmt.Errorf("target %s: %v", targetName(c), err)
+				}
+				if err := handleRelayout(cCtx.App.Writer, c, repositories, cCtx.String("from"), cCtx.Bool("dry-run")); err != nil {
+					return fmt.Errorf("target %s: %v", targetName(c), err)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// handleRelayout moves the backups of the repositories of a target from
+// their directories with the layout from to their current directories.
+// Backups are only moved if they were cloned from the repository and
+// nothing exists at the new directory, so that relayout can be repeated.
+func handleRelayout(w io.Writer, c *appConfig, repositories []*Repository, from string, dryRun bool) error {
+	moved, failed := 0, 0
+	for _, repo := range repositories {
+		oldDir := layoutRepoDir(from, c, repo)
+		newDir := targetRepoDir(c, repo)
+		if oldDir == newDir {
+			continue
+		}
+		if _, err := appFS.Stat(oldDir); err != nil {
+			continue
+		}
+		if !sameCloneURL(readOriginURL(oldDir, c.bare), repo.CloneURL) {
+			fmt.Fprintf(w, "Skipping %s: it is not a backup of %s/%s\n", oldDir, repo.Namespace, repo.Name)
+			continue
+		}
+		if _, err := appFS.Stat(newDir); err == nil {
+			fmt.Fprintf(w, "Skipping %s: %s already exists\n", oldDir, newDir)
+			continue
+		}
+		fmt.Fprintf(w, "Moving %s to %s\n", oldDir, newDir)
+		if dryRun {
+			continue
+		}
+		if err := appFS.MkdirAll(path.Dir(newDir), 0771); err != nil {
+			log.Printf("Error moving %s: %v\n", oldDir, err)
+			failed++
+			continue
+		}
+		if err := appFS.Rename(oldDir, newDir); err != nil {
+			log.Printf("Error moving %s: %v\n", oldDir, err)
+			failed++
+			continue
+		}
+		removeEmptyParents(path.Dir(oldDir), c.backupRoot)
+		moved++
+	}
+	if !dryRun {
+		fmt.Fprintf(w, "%d moved, %d failed\n", moved, failed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d backups could not be moved", failed)
+	}
+	return nil
+}
+
+// removeEmptyParents removes dir and its parents below root while they are
+// empty
+func removeEmptyParents(dir, root string) {
+	for dir != root && strings.HasPrefix(dir, root+"/") {
+		entries, err := readDirNames(dir)
+		if err != nil || len(entries) > 0 {
+			return
+		}
+		if err := appFS.Remove(dir); err != nil {
+			return
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// readDirNames returns the names of the entries of dir
+func readDirNames(dir string) ([]string, error) {
+	f, err := appFS.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
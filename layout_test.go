@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestExpandLayout(t *testing.T) {
+	c := &appConfig{service: "gitlab", gitHostURL: "https://git.example.com"}
+	repo := &Repository{Namespace: "org/team-a", Name: "api", Private: true}
+	starred := &Repository{Namespace: "other", Name: "tool", Subdir: "starred"}
+
+	tests := []struct {
+		layout string
+		repo   *Repository
+		want   string
+	}{
+		{"{host}/{owner}/{name}.git", repo, "git.example.com/org/api.git"},
+		{"{service}/{namespace_path}/{name}", repo, "gitlab/org/team-a/api"},
+		{"{owner}/{visibility}/{name}", repo, "org/private/api"},
+		{"{owner}/{visibility}/{name}", starred, "other/public/tool"},
+		{"{host}/{subdir}/{namespace_path}/{name}", repo, "git.example.com/org/team-a/api"},
+		{"{host}/{subdir}/{namespace_path}/{name}", starred, "git.example.com/starred/other/tool"},
+	}
+	for _, tt := range tests {
+		if got := expandLayout(tt.layout, c, tt.repo); got != tt.want {
+			t.Errorf("expandLayout(%q) = %q, want %q", tt.layout, got, tt.want)
+		}
+	}
+}
+
+func TestValidateLayout(t *testing.T) {
+	tests := []struct {
+		layout        string
+		starredSubdir string
+		wantErrs      int
+	}{
+		{"", "", 0},
+		{"{host}/{owner}/{name}.git", "", 0},
+		{"{host}/{owner}/{name}.git", "starred", 1},
+		{"{host}/{repo}", "", 2},
+		{"{namespace}/{name}", "", 1},
+		{"/{owner}/{name}", "", 1},
+		{"../{owner}/{name}", "", 1},
+	}
+	for _, tt := range tests {
+		if errs := validateLayout(tt.layout, tt.starredSubdir); len(errs) != tt.wantErrs {
+			t.Errorf("validateLayout(%q, %q) = %v, want %d errors", tt.layout, tt.starredSubdir, errs, tt.wantErrs)
+		}
+	}
+}
+
+func TestAssignRepoDirs(t *testing.T) {
+	c := &appConfig{service: "github", backupRoot: "/backup", backupDir: "/backup/github.com", starredSubdir: "starred", layout: "{subdir}/{owner}/{name}.git"}
+	repos := []*Repository{{Namespace: "me", Name: "api"}, {Namespace: "other", Name: "tool", Starred: true}}
+	assignRepoDirs(c, repos)
+	if repos[0].Dir != "/backup/me/api.git" || repos[1].Dir != "/backup/starred/other/tool.git" {
+		t.Errorf("Unexpected directories: %q, %q", repos[0].Dir, repos[1].Dir)
+	}
+
+	// The default layout is used without a layout
+	c.layout = ""
+	repos = []*Repository{{Namespace: "other", Name: "tool", Starred: true}}
+	assignRepoDirs(c, repos)
+	if repos[0].Dir != "" || getRepoDir(c.backupDir, repos[0], false) != "/backup/github.com/starred/other/tool" {
+		t.Errorf("Unexpected directory: %q", getRepoDir(c.backupDir, repos[0], false))
+	}
+}
+
+func TestHandleRelayout(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	gitConfig := func(url string) []byte {
+		return []byte("[core]\n\tbare = false\n[remote \"origin\"]\n\tfetch = +refs/heads/*:refs/remotes/origin/*\n\turl = " + url + "\n")
+	}
+	afero.WriteFile(appFS, "/backup/github.com/org/api/.git/config", gitConfig("git@github.com:org/api.git"), 0644)
+	afero.WriteFile(appFS, "/backup/github.com/org/web/.git/config", gitConfig("git@github.com:org/web.git"), 0644)
+	afero.WriteFile(appFS, "/backup/org/public/web/README", []byte("already there"), 0644)
+	// A directory which is not a backup of the repository is left alone
+	afero.WriteFile(appFS, "/backup/github.com/org/tool/.git/config", gitConfig("git@github.com:someone/tool.git"), 0644)
+
+	c := &appConfig{service: "github", backupRoot: "/backup", backupDir: "/backup/github.com", layout: "{owner}/{visibility}/{name}"}
+	repos := []*Repository{
+		{Namespace: "org", Name: "api", CloneURL: "git@github.com:org/api.git", Private: true},
+		{Namespace: "org", Name: "web", CloneURL: "git@github.com:org/web.git"},
+		{Namespace: "org", Name: "tool", CloneURL: "git@github.com:org/tool.git"},
+		{Namespace: "org", Name: "new", CloneURL: "git@github.com:org/new.git"},
+	}
+	assignRepoDirs(c, repos)
+
+	var out bytes.Buffer
+	if err := handleRelayout(&out, c, repos, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := afero.Exists(appFS, "/backup/org/private/api"); exists {
+		t.Error("Expected nothing to be moved in a dry run")
+	}
+	if !strings.Contains(out.String(), "Moving /backup/github.com/org/api to /backup/org/private/api") {
+		t.Errorf("Expected the move to be printed, got:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := handleRelayout(&out, c, repos, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := afero.Exists(appFS, "/backup/org/private/api/.git/config"); !exists {
+		t.Error("Expected the backup to be moved to the new layout")
+	}
+	if exists, _ := afero.Exists(appFS, "/backup/github.com/org/web/.git/config"); !exists {
+		t.Error("Expected the backup not to replace an existing directory")
+	}
+	if exists, _ := afero.Exists(appFS, "/backup/github.com/org/tool/.git/config"); !exists {
+		t.Error("Expected the backup of another repository not to be moved")
+	}
+	for _, expected := range []string{"already exists", "is not a backup of org/tool", "1 moved, 0 failed"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in the output, got:\n%s", expected, out.String())
+		}
+	}
+
+	// Moving the last backup of a directory removes it
+	afero.WriteFile(appFS, "/backup/github.com/solo/lib/.git/config", gitConfig("git@github.com:solo/lib.git"), 0644)
+	repos = []*Repository{{Namespace: "solo", Name: "lib", CloneURL: "git@github.com:solo/lib.git"}}
+	assignRepoDirs(c, repos)
+	if err := handleRelayout(&out, c, repos, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := afero.Exists(appFS, "/backup/github.com/solo"); exists {
+		t.Error("Expected the empty directory to be removed")
+	}
+	if exists, _ := afero.Exists(appFS, "/backup/github.com"); !exists {
+		t.Error("Expected the host directory to be kept")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// originURLLine matches the url setting of the origin remote in a git
+// configuration file
+var originURLLine = regexp.MustCompile(`(?m)^\[remote "origin"\][^\[]*?^[ \t]*url[ \t]*=[ \t]*(\S+)[ \t]*$`)
+
+// migrateLegacyRepoDir moves the backup of repo from the directory of its
+// legacy namespace or name to repoDir, so that backups written by earlier
+// versions of gitbackup are updated rather than cloned again. Several
+// repositories shared the legacy directories, so they are only moved if
+// they were cloned from repo.
+func migrateLegacyRepoDir(backupDir string, repo *Repository, bare bool, repoDir string) {
+	if repo.LegacyNamespace == "" && repo.LegacyName == "" {
+		return
+	}
+	if _, err := appFS.Stat(repoDir); err == nil {
+		return
+	}
+	legacyDir := findLegacyRepoDir(backupDir, repo, bare, repoDir)
+	if legacyDir == "" {
+		return
+	}
+
+	log.Printf("Moving %s to %s\n", legacyDir, repoDir)
+	if err := appFS.MkdirAll(path.Dir(repoDir), 0771); err != nil {
+		log.Printf("Error moving %s: %v\n", legacyDir, err)
+		return
+	}
+	if err := appFS.Rename(legacyDir, repoDir); err != nil {
+		log.Printf("Error moving %s: %v\n", legacyDir, err)
+	}
+}
+
+// findLegacyRepoDir returns the legacy directory which repo was backed up
+// to, or an empty string if there is none
+func findLegacyRepoDir(backupDir string, repo *Repository, bare bool, repoDir string) string {
+	namespaces := []string{repo.Namespace}
+	if repo.LegacyNamespace != "" {
+		namespaces = append(namespaces, repo.LegacyNamespace)
+	}
+	names := []string{repo.Name}
+	if repo.LegacyName != "" {
+		names = append(names, repo.LegacyName)
+	}
+	for _, namespace := range namespaces {
+		for _, name := range names {
+			legacyRepo := &Repository{Name: name, Namespace: namespace, Subdir: repo.Subdir}
+			legacyDir := getRepoDir(backupDir, legacyRepo, bare)
+			if legacyDir == repoDir {
+				continue
+			}
+			if _, err := appFS.Stat(legacyDir); err != nil {
+				continue
+			}
+			if sameCloneURL(readOriginURL(legacyDir, bare), repo.CloneURL) {
+				return legacyDir
+			}
+		}
+	}
+	return ""
+}
+
+// readOriginURL returns the URL of the origin remote of the repository in
+// repoDir, or an empty string if it cannot be read
+func readOriginURL(repoDir string, bare bool) string {
+	configPath := path.Join(repoDir, ".git", "config")
+	if bare {
+		configPath = path.Join(repoDir, "config")
+	}
+	data, err := afero.ReadFile(appFS, configPath)
+	if err != nil {
+		return ""
+	}
+	m := originURLLine.FindStringSubmatch(string(data))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// sameCloneURL reports whether two clone URLs point to the same repository,
+// whether they use HTTPS, SSH or scp-like syntax
+func sameCloneURL(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return strings.EqualFold(getCloneURLHost(a), getCloneURLHost(b)) && cloneURLPath(a) == cloneURLPath(b)
+}
+
+// cloneURLPath returns the repository path of a clone URL without the .git
+// suffix, e.g. org/team-a/api
+func cloneURLPath(cloneURL string) string {
+	var p string
+	if u, err := url.Parse(cloneURL); err == nil && u.Host != "" {
+		p = u.Path
+	} else if _, rest, ok := strings.Cut(cloneURL, ":"); ok {
+		p = rest
+	}
+	return strings.TrimSuffix(strings.Trim(p, "/"), ".git")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestSameCloneURL(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"git@gitlab.com:org/team-a/api.git", "git@gitlab.com:org/team-a/api.git", true},
+		{"git@gitlab.com:org/team-a/api.git", "https://gitlab.com/org/team-a/api.git", true},
+		{"ssh://git@GitLab.com/org/team-a/api", "git@gitlab.com:org/team-a/api.git", true},
+		{"git@gitlab.com:org/team-a/api.git", "git@gitlab.com:org/team-b/api.git", false},
+		{"git@gitlab.com:org/api.git", "git@example.com:org/api.git", false},
+		{"", "git@gitlab.com:org/api.git", false},
+	}
+	for _, tt := range tests {
+		if got := sameCloneURL(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameCloneURL(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMigrateLegacyRepoDir(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	backupDir := "/backup/gitlab.com"
+	gitConfig := func(url string) []byte {
+		return []byte("[core]\n\tbare = false\n[remote \"origin\"]\n\tfetch = +refs/heads/*:refs/remotes/origin/*\n\turl = " + url + "\n")
+	}
+	// org/team-b/api was backed up to org/api, org/team-a/api was not as
+	// it has the same name
+	afero.WriteFile(appFS, backupDir+"/org/api/.git/config", gitConfig("git@gitlab.com:org/team-b/api.git"), 0644)
+
+	teamA := &Repository{Name: "api", Namespace: "org/team-a", LegacyNamespace: "org", CloneURL: "git@gitlab.com:org/team-a/api.git"}
+	teamB := &Repository{Name: "api", Namespace: "org/team-b", LegacyNamespace: "org", CloneURL: "git@gitlab.com:org/team-b/api.git"}
+
+	migrateLegacyRepoDir(backupDir, teamA, false, getRepoDir(backupDir, teamA, false))
+	if exists, _ := afero.Exists(appFS, backupDir+"/org/team-a/api"); exists {
+		t.Error("Expected the backup of another repository not to be moved")
+	}
+
+	migrateLegacyRepoDir(backupDir, teamB, false, getRepoDir(backupDir, teamB, false))
+	if exists, _ := afero.Exists(appFS, backupDir+"/org/team-b/api/.git/config"); !exists {
+		t.Error("Expected the backup to be moved to the nested directory")
+	}
+	if exists, _ := afero.Exists(appFS, backupDir+"/org/api"); exists {
+		t.Error("Expected the legacy directory to be gone")
+	}
+
+	// Bare repositories keep their configuration at the top level
+	afero.WriteFile(appFS, backupDir+"/org/api.git/config", gitConfig("https://gitlab.com/org/team-a/api.git"), 0644)
+	migrateLegacyRepoDir(backupDir, teamA, true, getRepoDir(backupDir, teamA, true))
+	if exists, _ := afero.Exists(appFS, backupDir+"/org/team-a/api.git/config"); !exists {
+		t.Error("Expected the bare backup to be moved to the nested directory")
+	}
+}
+
+func TestMigrateLegacyRepoDirName(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	backupDir := "/backup/gitlab.com"
+	// Earlier versions used the display name of GitLab projects
+	afero.WriteFile(appFS, backupDir+"/org/My Project/.git/config", []byte("[remote \"origin\"]\n\turl = git@gitlab.com:org/my-project.git\n"), 0644)
+
+	repo := &Repository{Name: "my-project", Namespace: "org", LegacyName: "My Project", CloneURL: "git@gitlab.com:org/my-project.git"}
+	migrateLegacyRepoDir(backupDir, repo, false, getRepoDir(backupDir, repo, false))
+	if exists, _ := afero.Exists(appFS, backupDir+"/org/my-project/.git/config"); !exists {
+		t.Error("Expected the backup to be moved to the directory of the project path")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// listFormats are the output formats of list and --dry-run
+var listFormats = []string{"table", "json", "csv"}
+
+// listedRepository is a repository as printed by list and --dry-run
+type listedRepository struct {
+	Target     string `json:"target,omitempty"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	Visibility string `json:"visibility"`
+	Fork       bool   `json:"fork"`
+	Archived   bool   `json:"archived"`
+	// Size is 0 when the service does not report it
+	Size     int64      `json:"size_bytes"`
+	PushedAt *time.Time `json:"pushed_at,omitempty"`
+	Path     string     `json:"path"`
+}
+
+func listCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "list",
+		Usage: "List the repositories which would be backed up, and where, without cloning them",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "Output format: table, json, or csv",
+				Value: "table",
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			if err := configureKeyring(cCtx); err != nil {
+				return err
+			}
+			configs, _, err := buildConfigs(cCtx)
+			if err != nil {
+				return err
+			}
+			for _, c := range configs {
+				if err := validateConfig(c); err != nil {
+					return fmt.Errorf("target %s: %v", targetName(c), err)
+				}
+			}
+			return handleList(cCtx.App.Writer, configs, cCtx.String("format"))
+		},
+	}
+}
+
+// handleList lists the repositories of every target with all filters
+// applied, and the directories they would be backed up to, in format.
+// Nothing is cloned or written to the backup directories.
+func handleList(w io.Writer, configs []*appConfig, format string) error {
+	if !contains(listFormats, format) {
+		return fmt.Errorf("invalid format: %q (must be %s)", format, describeChoices(listFormats))
+	}
+	listed := []listedRepository{}
+	for _, c := range configs {
+		c.dryRun = true
+
+		globalSettingsMutex.Lock()
+		client, err := newClient(c)
+		globalSettingsMutex.Unlock()
+		if err == nil {
+			_, err = checkToken(client, c)
+		}
+		var repositories []*Repository
+		if err == nil {
+			_, repositories, err = listGitRepositories(client, c)
+		}
+		if err != nil {
+			return fmt.Errorf("target %s: %v", targetName(c), err)
+		}
+		for _, repo := range repositories {
+			listed = append(listed, newListedRepository(c, repo, len(configs) > 1))
+		}
+	}
+
+	switch format {
+	case "json":
+		return writeListJSON(w, listed)
+	case "csv":
+		return writeListCSV(w, listed)
+	}
+	return writeListTable(w, listed, len(configs) > 1)
+}
+
+// newListedRepository returns repo of the target c as it is listed. The
+// target is only named when several targets are listed.
+func newListedRepository(c *appConfig, repo *Repository, withTarget bool) listedRepository {
+	r := listedRepository{
+		Namespace:  repo.Namespace,
+		Name:       repo.Name,
+		Visibility: "public",
+		Fork:       repo.Fork,
+		Archived:   repo.Archived,
+		Size:       repo.Size,
+		Path:       targetRepoDir(c, repo),
+	}
+	if withTarget {
+		r.Target = targetName(c)
+	}
+	if repo.Private {
+		r.Visibility = "private"
+	}
+	if !repo.PushedAt.IsZero() {
+		pushedAt := repo.PushedAt.UTC()
+		r.PushedAt = &pushedAt
+	}
+	return r
+}
+
+func writeListJSON(w io.Writer, listed []listedRepository) error {
+	data, err := json.MarshalIndent(listed, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+func writeListCSV(w io.Writer, listed []listedRepository) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"target", "namespace", "name", "visibility", "fork", "archived", "size_bytes", "pushed_at", "path"})
+	for _, r := range listed {
+		pushedAt := ""
+		if r.PushedAt != nil {
+			pushedAt = r.PushedAt.Format(time.RFC3339)
+		}
+		cw.Write([]string{
+			r.Target, r.Namespace, r.Name, r.Visibility,
+			strconv.FormatBool(r.Fork), strconv.FormatBool(r.Archived),
+			strconv.FormatInt(r.Size, 10), pushedAt, r.Path,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeListTable prints the repositories as a table for people to read,
+// with a target column if several targets are listed
+func writeListTable(w io.Writer, listed []listedRepository, withTarget bool) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if withTarget {
+		fmt.Fprint(tw, "TARGET\t")
+	}
+	fmt.Fprintln(tw, "NAMESPACE\tNAME\tVISIBILITY\tFORK\tARCHIVED\tSIZE\tPUSHED\tPATH")
+	for _, r := range listed {
+		size, pushed := "-", "-"
+		if r.Size > 0 {
+			size = formatBytes(uint64(r.Size))
+		}
+		if r.PushedAt != nil {
+			pushed = r.PushedAt.Format("2006-01-02")
+		}
+		if withTarget {
+			fmt.Fprintf(tw, "%s\t", r.Target)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Namespace, r.Name, r.Visibility, yesNo(r.Fork), yesNo(r.Archived), size, pushed, r.Path)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d repositories\n", len(listed))
+	return err
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestListCommand(t *testing.T) {
+	useTestKeyring(t)
+	useOsFs(t)
+	t.Cleanup(func() { useHTTPSClone = nil })
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v4/user":
+			fmt.Fprint(w, `{"username": "gluser"}`)
+		case "/api/v4/personal_access_tokens/self":
+			fmt.Fprint(w, `{"scopes": ["api"], "active": true}`)
+		case "/api/v4/projects":
+			fmt.Fprint(w, `[
+				{"id": 1, "name": "API", "path_with_namespace": "gluser/api", "ssh_url_to_repo": "git@example.com:gluser/api.git", "visibility": "private", "last_activity_at": "2026-03-04T10:00:00Z", "statistics": {"repository_size": 2097152}},
+				{"id": 2, "name": "fork", "path_with_namespace": "gluser/fork", "ssh_url_to_repo": "git@example.com:gluser/fork.git", "visibility": "public", "archived": true, "forked_from_project": {"id": 9}},
+				{"id": 3, "name": "Api", "path_with_namespace": "gluser/Api", "ssh_url_to_repo": "git@example.com:gluser/Api.git", "visibility": "public"}
+			]`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	backupDir := t.TempDir()
+	configPath := filepath.Join(t.TempDir(), "gitbackup.yml")
+	config := fmt.Sprintf(`service: gitlab
+githost_url: %s
+backup_dir: %s
+gitlab:
+  project_visibility: all
+  project_membership_type: all
+credentials:
+  token: gltoken
+`, ts.URL, backupDir)
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runList := func(format string) (string, error) {
+		var out bytes.Buffer
+		app := &cli.App{Flags: appFlags(), Commands: []*cli.Command{listCommand()}, Writer: &out}
+		err := app.Run([]string{"gitbackup", "-config", configPath, "list", "-format", format})
+		return out.String(), err
+	}
+	hostDir := filepath.ToSlash(filepath.Join(backupDir, strings.TrimPrefix(ts.URL, "http://")))
+
+	out, err := runList("table")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v\n%s", err, out)
+	}
+	for _, expected := range []string{
+		"NAMESPACE  NAME  VISIBILITY  FORK  ARCHIVED  SIZE",
+		"private     no    no        2.0 MiB  2026-03-04  " + hostDir + "/gluser/api",
+		"public      yes   yes       -        -           " + hostDir + "/gluser/fork",
+		"3 repositories",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in the output, got:\n%s", expected, out)
+		}
+	}
+
+	out, err = runList("json")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v\n%s", err, out)
+	}
+	var listed []listedRepository
+	if err := json.Unmarshal([]byte(out), &listed); err != nil {
+		t.Fatalf("Expected JSON output, got: %v\n%s", err, out)
+	}
+	if len(listed) != 3 || listed[0].Size != 2097152 || listed[0].PushedAt == nil || !listed[1].Fork || !listed[1].Archived {
+		t.Errorf("Unexpected repositories: %+v", listed)
+	}
+	// The directories of gluser/api and gluser/Api collide on
+	// case-insensitive file systems
+	if listed[0].Path == listed[2].Path || !strings.HasPrefix(listed[2].Path, hostDir+"/gluser/Api-") {
+		t.Errorf("Expected the colliding directories to be resolved, got: %q and %q", listed[0].Path, listed[2].Path)
+	}
+	if strings.Contains(out, `"target"`) || !strings.Contains(out, `"size_bytes": 0`) {
+		t.Errorf("Unexpected JSON fields:\n%s", out)
+	}
+
+	out, err = runList("csv")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v\n%s", err, out)
+	}
+	records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || strings.Join(records[0], ",") != "target,namespace,name,visibility,fork,archived,size_bytes,pushed_at,path" {
+		t.Errorf("Unexpected CSV output:\n%s", out)
+	}
+	if strings.Join(records[1][:8], ",") != ",gluser,api,private,false,false,2097152,2026-03-04T10:00:00Z" {
+		t.Errorf("Unexpected CSV record: %v", records[1])
+	}
+
+	// Listing creates no directories, clones nothing, and does not record
+	// the directories of colliding repositories
+	if entries, _ := os.ReadDir(backupDir); len(entries) != 0 {
+		t.Errorf("Expected the backup directory to be left alone, found %d entries", len(entries))
+	}
+
+	if _, err := runList("xml"); err == nil || !strings.Contains(err.Error(), "invalid format") {
+		t.Errorf("Expected an invalid format error, got: %v", err)
+	}
+}
@@ -14,10 +14,7 @@ const MaxConcurrentClones = 20
 
 const defaultMaxUserMigrationRetry = 5
 
-var gitHostToken string
 var useHTTPSClone *bool
-var ignorePrivate *bool
-var gitHostUsername string
 
 // The services we know of and their default public host names
 var knownServices = map[string]string{
@@ -28,32 +25,64 @@ var knownServices = map[string]string{
 }
 
 func main() {
+	log.SetOutput(&redactingWriter{w: os.Stderr})
+
 	app := &cli.App{
 		Name:  "gitbackup",
 		Usage: "Backup your Git repositories from GitHub, GitLab, Bitbucket, or Forgejo",
 		Flags: appFlags(),
 		Action: func(cCtx *cli.Context) error {
-			c, err := buildConfig(cCtx)
-			if err != nil {
+			if err := configureKeyring(cCtx); err != nil {
 				return err
 			}
-			err = validateConfig(c)
+			if cCtx.Bool("github.listUserMigrations") {
+				c, err := buildConfig(cCtx)
+				if err != nil {
+					return err
+				}
+				err = validateConfig(c)
+				if err != nil {
+					return err
+				}
+				client, err := newClient(c)
+				if err != nil {
+					return err
+				}
+				if _, err := checkToken(client, c); err != nil {
+					return err
+				}
+				return handleGithubListUserMigrations(client, c)
+			}
+
+			configs, parallel, err := buildConfigs(cCtx)
 			if err != nil {
 				return err
 			}
+			for _, c := range configs {
+				if err := validateConfig(c); err != nil {
+					if c.name != "" {
+						return fmt.Errorf("target %s: %v", c.name, err)
+					}
+					return err
+				}
+			}
 
-			client := newClient(c.service, c.gitHostURL)
+			if cCtx.Bool("dry-run") {
+				return handleList(cCtx.App.Writer, configs, cCtx.String("format"))
+			}
 
-			if c.githubListUserMigrations {
-				handleGithubListUserMigrations(client, c)
-			} else if c.githubCreateUserMigration {
-				handleGithubCreateUserMigration(client, c)
-			} else {
-				if err := handleGitRepositoryClone(client, c); err != nil {
-					return err
+			textfile := cCtx.String("metrics.textfile")
+			if textfile != "" {
+				metrics.enable()
+			}
+			err = runTargets(configs, parallel)
+
+			if textfile != "" {
+				if err := writeMetricsTextfile(textfile); err != nil {
+					log.Printf("Error writing metrics: %v\n", err)
 				}
 			}
-			return nil
+			return err
 		},
 		Commands: []*cli.Command{
 			{
@@ -72,21 +101,63 @@ func main() {
 			{
 				Name:  "validate",
 				Usage: "Validate the gitbackup.yml configuration file",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:  "config",
 						Usage: "Path to config file (default: OS config directory)",
 					},
-				},
+				}, keyringFlags()...),
 				Action: func(cCtx *cli.Context) error {
+					if err := configureKeyring(cCtx); err != nil {
+						return err
+					}
 					return handleValidateConfig(cCtx.String("config"))
 				},
 			},
+			{
+				Name:  "serve",
+				Usage: "Listen for push webhooks and back up the pushed repositories",
+				Flags: serveFlags(),
+				Action: func(cCtx *cli.Context) error {
+					if err := configureKeyring(cCtx); err != nil {
+						return err
+					}
+					c, err := buildConfig(cCtx)
+					if err != nil {
+						return err
+					}
+					err = validateConfig(c)
+					if err != nil {
+						return err
+					}
+					if err := setupBackupDir(c); err != nil {
+						return err
+					}
+
+					client, err := newClient(c)
+					if err != nil {
+						return err
+					}
+					if _, err := checkToken(client, c); err != nil {
+						return err
+					}
+					return handleServe(
+						client, c,
+						cCtx.String("listen"),
+						cCtx.String("webhook.secret"),
+						cCtx.Duration("webhook.debounce"),
+					)
+				},
+			},
+			authCommand(),
+			doctorCommand(),
+			relayoutCommand(),
+			listCommand(),
 		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", redactSecrets(err.Error()))
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// gitOperationDurationBuckets are the upper bounds (in seconds) of the
+// git operation duration histogram buckets
+var gitOperationDurationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800}
+
+// metrics collects the backup metrics of this process
+var metrics = newMetricsRegistry()
+
+// repoMetricKey identifies a repository in the per-repository metrics
+type repoMetricKey struct {
+	backupDir  string
+	repository string
+}
+
+// repoResultKey counts the repositories of a target with a result
+type repoResultKey struct {
+	target string
+	result string
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, upper := range gitOperationDurationBuckets {
+		if v <= upper {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metricsRegistry holds the counters and gauges exposed in the
+// Prometheus text format
+type metricsRegistry struct {
+	mutex sync.Mutex
+
+	// enabled is set when the metrics are output, the sizes of the
+	// repositories are only measured then
+	enabled bool
+
+	reposListed  map[string]int
+	repoResults  map[repoResultKey]uint64
+	lastSuccess  map[repoMetricKey]time.Time
+	repoSize     map[repoMetricKey]int64
+	gitDurations map[string]*histogram
+
+	apiRequests        map[string]uint64
+	rateLimitRemaining map[string]int
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		reposListed:        make(map[string]int),
+		repoResults:        make(map[repoResultKey]uint64),
+		lastSuccess:        make(map[repoMetricKey]time.Time),
+		repoSize:           make(map[repoMetricKey]int64),
+		gitDurations:       make(map[string]*histogram),
+		apiRequests:        make(map[string]uint64),
+		rateLimitRemaining: make(map[string]int),
+	}
+}
+
+// setReposListed records the number of repositories retrieved for a target
+func (m *metricsRegistry) setReposListed(target string, n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.reposListed[target] = n
+}
+
+// enable records that the metrics are output, by -metrics.textfile or
+// the /metrics endpoint of serve
+func (m *metricsRegistry) enable() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.enabled = true
+}
+
+func (m *metricsRegistry) isEnabled() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.enabled
+}
+
+// recordRepoResult counts a repository of a target as cloned, updated,
+// failed or skipped
+func (m *metricsRegistry) recordRepoResult(target, result string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.repoResults[repoResultKey{target, result}]++
+}
+
+// recordRepoSuccess records the time of the last successful backup of a
+// repository and its size on disk
+func (m *metricsRegistry) recordRepoSuccess(backupDir string, repo *Repository, size int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := repoMetricKey{backupDir, repo.Namespace + "/" + repo.Name}
+	m.lastSuccess[key] = time.Now()
+	m.repoSize[key] = size
+}
+
+// recordGitOperation records the duration of a git clone or update
+func (m *metricsRegistry) recordGitOperation(operation string, d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, ok := m.gitDurations[operation]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(gitOperationDurationBuckets))}
+		m.gitDurations[operation] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// recordAPIRequest counts an API request to a service and records the
+// remaining rate limit if the response carries one
+func (m *metricsRegistry) recordAPIRequest(service string, resp *http.Response) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.apiRequests[service]++
+	if resp == nil {
+		return
+	}
+	for _, header := range []string{"X-RateLimit-Remaining", "RateLimit-Remaining"} {
+		if v := resp.Header.Get(header); v != "" {
+			if remaining, err := strconv.Atoi(v); err == nil {
+				m.rateLimitRemaining[service] = remaining
+			}
+			return
+		}
+	}
+}
+
+// writeTo writes all metrics in the Prometheus text exposition format
+func (m *metricsRegistry) writeTo(w io.Writer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var b strings.Builder
+
+	writeHeader(&b, "gitbackup_repositories_listed", "gauge", "Number of repositories retrieved for the target in the last run.")
+	for _, target := range sortedKeys(m.reposListed) {
+		fmt.Fprintf(&b, "gitbackup_repositories_listed{target=%s} %d\n", quoteLabelValue(target), m.reposListed[target])
+	}
+
+	targets := map[string]bool{}
+	for k := range m.repoResults {
+		targets[k.target] = true
+	}
+	for _, result := range []string{"cloned", "updated", "failed", "skipped"} {
+		name := "gitbackup_repositories_" + result + "_total"
+		writeHeader(&b, name, "counter", "Number of repositories "+result+" for the target.")
+		for _, target := range sortedKeys(targets) {
+			fmt.Fprintf(&b, "%s{target=%s} %d\n", name, quoteLabelValue(target), m.repoResults[repoResultKey{target, result}])
+		}
+	}
+
+	keys := make([]repoMetricKey, 0, len(m.lastSuccess))
+	for k := range m.lastSuccess {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].backupDir != keys[j].backupDir {
+			return keys[i].backupDir < keys[j].backupDir
+		}
+		return keys[i].repository < keys[j].repository
+	})
+
+	writeHeader(&b, "gitbackup_repository_last_success_timestamp_seconds", "gauge", "Unix time of the last successful backup of a repository.")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "gitbackup_repository_last_success_timestamp_seconds{backup_dir=%s,repository=%s} %d\n",
+			quoteLabelValue(k.backupDir), quoteLabelValue(k.repository), m.lastSuccess[k].Unix())
+	}
+
+	writeHeader(&b, "gitbackup_repository_size_bytes", "gauge", "Size on disk of a backed up repository.")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "gitbackup_repository_size_bytes{backup_dir=%s,repository=%s} %d\n",
+			quoteLabelValue(k.backupDir), quoteLabelValue(k.repository), m.repoSize[k])
+	}
+
+	writeHeader(&b, "gitbackup_git_operation_duration_seconds", "histogram", "Duration of git clone and update operations.")
+	for _, operation := range sortedKeys(m.gitDurations) {
+		h := m.gitDurations[operation]
+		for i, upper := range gitOperationDurationBuckets {
+			fmt.Fprintf(&b, "gitbackup_git_operation_duration_seconds_bucket{operation=%s,le=%s} %d\n",
+				quoteLabelValue(operation), quoteLabelValue(strconv.FormatFloat(upper, 'g', -1, 64)), h.buckets[i])
+		}
+		fmt.Fprintf(&b, "gitbackup_git_operation_duration_seconds_bucket{operation=%s,le=\"+Inf\"} %d\n", quoteLabelValue(operation), h.count)
+		fmt.Fprintf(&b, "gitbackup_git_operation_duration_seconds_sum{operation=%s} %s\n", quoteLabelValue(operation), strconv.FormatFloat(h.sum, 'f', -1, 64))
+		fmt.Fprintf(&b, "gitbackup_git_operation_duration_seconds_count{operation=%s} %d\n", quoteLabelValue(operation), h.count)
+	}
+
+	writeHeader(&b, "gitbackup_api_requests_total", "counter", "Number of API requests made to the git service.")
+	for _, service := range sortedKeys(m.apiRequests) {
+		fmt.Fprintf(&b, "gitbackup_api_requests_total{service=%s} %d\n", quoteLabelValue(service), m.apiRequests[service])
+	}
+
+	writeHeader(&b, "gitbackup_api_rate_limit_remaining", "gauge", "Remaining API requests in the current rate limit window.")
+	for _, service := range sortedKeys(m.rateLimitRemaining) {
+		fmt.Fprintf(&b, "gitbackup_api_rate_limit_remaining{service=%s} %d\n", quoteLabelValue(service), m.rateLimitRemaining[service])
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeHeader(b *strings.Builder, name, metricType, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabelValue quotes and escapes a label value for the Prometheus text format
+func quoteLabelValue(v string) string {
+	return `"` + labelValueReplacer.Replace(v) + `"`
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ServeHTTP exposes the metrics on the /metrics endpoint
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.writeTo(w)
+}
+
+// writeMetricsTextfile atomically writes the metrics to a file for the
+// node_exporter textfile collector
+func writeMetricsTextfile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("error creating metrics file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := metrics.writeTo(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing metrics file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing metrics file: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// getDirSize returns the total size of the files under dir
+func getDirSize(dir string) int64 {
+	var size int64
+	afero.Walk(appFS, dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// instrumentedTransport counts the API requests made by a client
+type instrumentedTransport struct {
+	service string
+	base    http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(r)
+	metrics.recordAPIRequest(t.service, resp)
+	return resp, err
+}
+
+// instrumentTransport wraps base so that API requests to service are
+// recorded in the metrics
+func instrumentTransport(service string, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &instrumentedTransport{service: service, base: base}
+}
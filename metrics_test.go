@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestMetricsRegistryWriteTo(t *testing.T) {
+	m := newMetricsRegistry()
+	m.setReposListed("github", 3)
+	m.recordRepoResult("github", "cloned")
+	m.recordRepoResult("github", "cloned")
+	m.recordRepoResult("github", "failed")
+	m.recordRepoResult("work", "cloned")
+	m.recordRepoSuccess("/backup/github.com", &Repository{Namespace: "test", Name: "r\"1"}, 1024)
+	m.recordGitOperation("clone", 2*time.Second)
+
+	var b strings.Builder
+	if err := m.writeTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+
+	expected := []string{
+		`gitbackup_repositories_listed{target="github"} 3`,
+		`gitbackup_repositories_cloned_total{target="github"} 2`,
+		`gitbackup_repositories_cloned_total{target="work"} 1`,
+		`gitbackup_repositories_failed_total{target="github"} 1`,
+		`gitbackup_repositories_failed_total{target="work"} 0`,
+		`gitbackup_repositories_updated_total{target="github"} 0`,
+		`gitbackup_repository_size_bytes{backup_dir="/backup/github.com",repository="test/r\"1"} 1024`,
+		`gitbackup_git_operation_duration_seconds_bucket{operation="clone",le="1"} 0`,
+		`gitbackup_git_operation_duration_seconds_bucket{operation="clone",le="5"} 1`,
+		`gitbackup_git_operation_duration_seconds_bucket{operation="clone",le="+Inf"} 1`,
+		`gitbackup_git_operation_duration_seconds_count{operation="clone"} 1`,
+		`# TYPE gitbackup_git_operation_duration_seconds histogram`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, got)
+		}
+	}
+}
+
+func TestInstrumentTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	metrics = newMetricsRegistry()
+	client := &http.Client{Transport: instrumentTransport("github", nil)}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if metrics.apiRequests["github"] != 2 {
+		t.Errorf("Expected 2 API requests, got: %d", metrics.apiRequests["github"])
+	}
+	if metrics.rateLimitRemaining["github"] != 4999 {
+		t.Errorf("Expected rate limit remaining 4999, got: %d", metrics.rateLimitRemaining["github"])
+	}
+}
+
+func TestBackupRecordsMetrics(t *testing.T) {
+	repo := Repository{Name: "testrepo", Namespace: "test", CloneURL: "git://foo.com/foo"}
+	backupDir := "/tmp/backupdir"
+
+	appFS = afero.NewMemMapFs()
+	appFS.MkdirAll(backupDir, 0771)
+	metrics = newMetricsRegistry()
+
+	defer func() {
+		execCommand = exec.Command
+	}()
+
+	c := &appConfig{name: "work", service: "github", backupDir: backupDir}
+	execCommand = fakeCloneCommand
+	backUpRepository(c, &repo, nil)
+
+	repoDir := getRepoDir(backupDir, &repo, false)
+	appFS.MkdirAll(repoDir, 0771)
+	afero.WriteFile(appFS, repoDir+"/README", make([]byte, 10), 0644)
+	execCommand = fakePullCommand
+	backUpRepository(c, &repo, nil)
+
+	if metrics.repoResults[repoResultKey{"work", "cloned"}] != 1 || metrics.repoResults[repoResultKey{"work", "updated"}] != 1 {
+		t.Errorf("Expected one clone and one update of the target, got: %v", metrics.repoResults)
+	}
+	if metrics.gitDurations["clone"].count != 1 || metrics.gitDurations["update"].count != 1 {
+		t.Error("Expected git operation durations to be recorded")
+	}
+	key := repoMetricKey{backupDir, "test/testrepo"}
+	if _, ok := metrics.lastSuccess[key]; !ok {
+		t.Error("Expected last success timestamp to be recorded")
+	}
+	// The size is only measured when the metrics are output
+	if metrics.repoSize[key] != 0 {
+		t.Errorf("Expected the size not to be measured, got: %d", metrics.repoSize[key])
+	}
+	metrics.enable()
+	backUpRepository(c, &repo, nil)
+	if metrics.repoSize[key] != 10 {
+		t.Errorf("Expected a size of 10 bytes, got: %d", metrics.repoSize[key])
+	}
+}
+
+func TestWriteMetricsTextfile(t *testing.T) {
+	metrics = newMetricsRegistry()
+	metrics.recordRepoResult("github", "skipped")
+
+	textfile := filepath.Join(t.TempDir(), "gitbackup.prom")
+	if err := writeMetricsTextfile(textfile); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	data, err := os.ReadFile(textfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "gitbackup_repositories_skipped_total{target=\"github\"} 1\n") {
+		t.Errorf("Unexpected metrics file contents:\n%s", data)
+	}
+}
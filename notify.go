@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Notification events
+const (
+	notifyOnFailure  = "failure"
+	notifyOnRecovery = "recovery"
+	notifyOnSuccess  = "success"
+)
+
+// runStatusFile is written to the backup directory to remember whether
+// the previous run failed, so that we can notify about recoveries
+const runStatusFile = ".gitbackup-status.json"
+
+const notificationTimeout = 30 * time.Second
+
+const defaultNotificationSubjectTemplate = `gitbackup {{.Event}}: {{with .Target}}{{.}} {{end}}{{.Service}} backup to {{.BackupDir}}`
+
+const defaultNotificationTemplate = `gitbackup {{.Event}}: {{with .Target}}{{.}} {{end}}{{.Service}} backup to {{.BackupDir}} ({{.Duration}})
+{{if .Error}}Error: {{.Error}}
+{{end}}{{range .Warnings}}Warning: {{.}}
+{{end}}{{.Listed}} repositories listed, {{len .Cloned}} cloned, {{len .Updated}} updated, {{len .Unchanged}} unchanged, {{len .Skipped}} skipped, {{len .FailedRepos}} failed
+{{range .FailedRepos}}Failed: {{.Repository}}: {{.Error}}
+{{end}}{{range .Cloned}}Cloned: {{.}}
+{{end}}{{range .Updated}}Updated: {{.}}
+{{end}}`
+
+// notificationsConfig configures where and when we send notifications
+type notificationsConfig struct {
+	NotifyOn []string               `yaml:"notify_on,omitempty"`
+	Email    *emailNotifierConfig   `yaml:"email,omitempty"`
+	Webhook  *webhookNotifierConfig `yaml:"webhook,omitempty"`
+	Chat     *chatNotifierConfig    `yaml:"chat,omitempty"`
+}
+
+// configured reports whether any notifier is configured
+func (n notificationsConfig) configured() bool {
+	return n.Email != nil || n.Webhook != nil || n.Chat != nil
+}
+
+// emailNotifierConfig configures notifications sent via SMTP. Unless set
+// in the config file, the SMTP password is read from the
+// GITBACKUP_SMTP_PASSWORD environment variable.
+type emailNotifierConfig struct {
+	SMTPHost        string   `yaml:"smtp_host"`
+	SMTPPort        int      `yaml:"smtp_port,omitempty"`
+	Username        string   `yaml:"username,omitempty"`
+	Password        string   `yaml:"password,omitempty"`
+	From            string   `yaml:"from"`
+	To              []string `yaml:"to"`
+	SubjectTemplate string   `yaml:"subject_template,omitempty"`
+	BodyTemplate    string   `yaml:"body_template,omitempty"`
+}
+
+// webhookNotifierConfig configures notifications POSTed to a URL, by
+// default as a JSON document describing the run
+type webhookNotifierConfig struct {
+	URL          string            `yaml:"url"`
+	Headers      map[string]string `yaml:"headers,omitempty"`
+	BodyTemplate string            `yaml:"body_template,omitempty"`
+}
+
+// chatNotifierConfig configures notifications sent to a Slack or
+// Mattermost compatible incoming webhook
+type chatNotifierConfig struct {
+	URL      string `yaml:"url"`
+	Template string `yaml:"template,omitempty"`
+}
+
+// notification is the data made available to the notification templates
+type notification struct {
+	Event string
+	*runReport
+}
+
+// webhookNotification is the default JSON body of generic webhook notifications
+type webhookNotification struct {
+	Event     string       `json:"event"`
+	Target    string       `json:"target,omitempty"`
+	Service   string       `json:"service"`
+	BackupDir string       `json:"backup_dir"`
+	StartTime time.Time    `json:"start_time"`
+	EndTime   time.Time    `json:"end_time"`
+	Listed    int          `json:"listed"`
+	Cloned    []string     `json:"cloned"`
+	Updated   []string     `json:"updated"`
+	Unchanged []string     `json:"unchanged"`
+	Skipped   []string     `json:"skipped"`
+	Failed    []repoResult `json:"failed"`
+	Error     string       `json:"error,omitempty"`
+
+	RateLimit *rateLimitStatus `json:"rate_limit,omitempty"`
+	Warnings  []string         `json:"warnings,omitempty"`
+}
+
+type runStatus struct {
+	Failed  bool      `json:"failed"`
+	EndTime time.Time `json:"end_time"`
+}
+
+var notificationHTTPClient = &http.Client{Timeout: notificationTimeout}
+
+// validateNotificationsConfig returns the problems found in the
+// notification configuration
+func validateNotificationsConfig(n notificationsConfig) []string {
+	var errors []string
+	for _, event := range n.NotifyOn {
+		if !contains([]string{notifyOnFailure, notifyOnRecovery, notifyOnSuccess}, event) {
+			errors = append(errors, fmt.Sprintf("invalid notifications.notify_on: %q (must be failure, recovery or success)", event))
+		}
+	}
+
+	templates := map[string]string{}
+	if n.Email != nil {
+		if n.Email.SMTPHost == "" || n.Email.From == "" || len(n.Email.To) == 0 {
+			errors = append(errors, "notifications.email requires smtp_host, from and to")
+		}
+		templates["notifications.email.subject_template"] = n.Email.SubjectTemplate
+		templates["notifications.email.body_template"] = n.Email.BodyTemplate
+	}
+	if n.Webhook != nil {
+		if n.Webhook.URL == "" {
+			errors = append(errors, "notifications.webhook requires url")
+		}
+		templates["notifications.webhook.body_template"] = n.Webhook.BodyTemplate
+	}
+	if n.Chat != nil {
+		if n.Chat.URL == "" {
+			errors = append(errors, "notifications.chat requires url")
+		}
+		templates["notifications.chat.template"] = n.Chat.Template
+	}
+	for name, text := range templates {
+		if _, err := template.New(name).Parse(text); err != nil {
+			errors = append(errors, fmt.Sprintf("invalid %s: %v", name, err))
+		}
+	}
+	return errors
+}
+
+// notificationEvent determines the event of a finished run and records
+// its status in the backup directory for the next run. The name of the
+// target is sanitized like the directories of repositories, so that it
+// cannot name a file outside of the backup directory.
+func notificationEvent(report *runReport) string {
+	statusFile := path.Join(report.BackupDir, runStatusFile)
+	if report.Target != "" {
+		statusFile = path.Join(report.BackupDir, sanitizePathSegment(".gitbackup-status-"+report.Target+".json"))
+	}
+
+	var previous runStatus
+	if data, err := afero.ReadFile(appFS, statusFile); err == nil {
+		json.Unmarshal(data, &previous)
+	}
+
+	current := runStatus{Failed: report.Failed(), EndTime: report.EndTime}
+	if data, err := json.Marshal(current); err == nil {
+		if err := afero.WriteFile(appFS, statusFile, data, 0644); err != nil {
+			log.Printf("Error saving run status: %v\n", err)
+		}
+	}
+
+	switch {
+	case current.Failed:
+		return notifyOnFailure
+	case previous.Failed:
+		return notifyOnRecovery
+	default:
+		return notifyOnSuccess
+	}
+}
+
+// sendNotifications sends the configured notifications for a finished run.
+// Errors are logged since they should not affect the outcome of the run.
+// Without notifiers, the status of the run is not recorded either.
+func sendNotifications(n notificationsConfig, report *runReport) {
+	if !n.configured() {
+		return
+	}
+	event := notificationEvent(report)
+
+	notifyOn := n.NotifyOn
+	if len(notifyOn) == 0 {
+		notifyOn = []string{notifyOnFailure, notifyOnRecovery}
+	}
+	if !contains(notifyOn, event) {
+		return
+	}
+
+	data := notification{Event: event, runReport: report}
+	if n.Email != nil {
+		if err := sendEmailNotification(n.Email, data); err != nil {
+			log.Printf("Error sending email notification: %v\n", err)
+		}
+	}
+	if n.Webhook != nil {
+		if err := sendWebhookNotification(n.Webhook, data); err != nil {
+			log.Printf("Error sending webhook notification: %v\n", err)
+		}
+	}
+	if n.Chat != nil {
+		if err := sendChatNotification(n.Chat, data); err != nil {
+			log.Printf("Error sending chat notification: %v\n", err)
+		}
+	}
+}
+
+// renderNotification executes text as a template, falling back to
+// defaultText if it is empty
+func renderNotification(text, defaultText string, data notification) (string, error) {
+	if text == "" {
+		text = defaultText
+	}
+	t, err := template.New("notification").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// buildEmailMessage renders the email headers and body of a notification
+func buildEmailMessage(cfg *emailNotifierConfig, data notification) ([]byte, error) {
+	subject, err := renderNotification(cfg.SubjectTemplate, defaultNotificationSubjectTemplate, data)
+	if err != nil {
+		return nil, err
+	}
+	body, err := renderNotification(cfg.BodyTemplate, defaultNotificationTemplate, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.ReplaceAll(strings.TrimSpace(subject), "\n", " "))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return msg.Bytes(), nil
+}
+
+func sendEmailNotification(cfg *emailNotifierConfig, data notification) error {
+	msg, err := buildEmailMessage(cfg, data)
+	if err != nil {
+		return err
+	}
+
+	port := cfg.SMTPPort
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		password := cfg.Password
+		if password == "" {
+			password = os.Getenv("GITBACKUP_SMTP_PASSWORD")
+		}
+		registerSecret(password)
+		auth = smtp.PlainAuth("", cfg.Username, password, cfg.SMTPHost)
+	}
+	addr := net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(port))
+	return smtp.SendMail(addr, auth, cfg.From, cfg.To, msg)
+}
+
+func sendWebhookNotification(cfg *webhookNotifierConfig, data notification) error {
+	var body []byte
+	contentType := "application/json"
+	if cfg.BodyTemplate != "" {
+		rendered, err := renderNotification(cfg.BodyTemplate, "", data)
+		if err != nil {
+			return err
+		}
+		body = []byte(rendered)
+	} else {
+		var err error
+		body, err = json.Marshal(webhookNotification{
+			Event:     data.Event,
+			Target:    data.Target,
+			Service:   data.Service,
+			BackupDir: data.BackupDir,
+			StartTime: data.StartTime,
+			EndTime:   data.EndTime,
+			Listed:    data.Listed,
+			Cloned:    data.Cloned(),
+			Updated:   data.Updated(),
+			Unchanged: data.Unchanged(),
+			Skipped:   data.Skipped(),
+			Failed:    data.FailedRepos(),
+			Error:     data.Error,
+			RateLimit: data.RateLimit,
+			Warnings:  data.Warnings,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return postNotification(cfg.URL, contentType, cfg.Headers, body)
+}
+
+func sendChatNotification(cfg *chatNotifierConfig, data notification) error {
+	text, err := renderNotification(cfg.Template, defaultNotificationTemplate, data)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	return postNotification(cfg.URL, "application/json", nil, body)
+}
+
+func postNotification(url, contentType string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := notificationHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func newTestReport(failed bool) *runReport {
+	r := newRunReport(&appConfig{service: "github", backupDir: "/backup/github.com"})
+	r.Listed = 2
+	r.addResult(&Repository{Namespace: "test", Name: "r1"}, backupActionCloned, true, nil, nil)
+	if failed {
+		r.addResult(&Repository{Namespace: "test", Name: "r2"}, backupActionUpdated, false, errors.New("exit status 1"), []byte("fatal: error"))
+	} else {
+		r.addResult(&Repository{Namespace: "test", Name: "r2"}, backupActionUpdated, false, nil, nil)
+	}
+	r.finish(nil)
+	return r
+}
+
+func TestNotificationEvent(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	appFS.MkdirAll("/backup/github.com", 0771)
+
+	steps := []struct {
+		failed bool
+		want   string
+	}{
+		{false, notifyOnSuccess},
+		{true, notifyOnFailure},
+		{true, notifyOnFailure},
+		{false, notifyOnRecovery},
+		{false, notifyOnSuccess},
+	}
+	for i, step := range steps {
+		if got := notificationEvent(newTestReport(step.failed)); got != step.want {
+			t.Errorf("Run %d: expected event %q, got %q", i, step.want, got)
+		}
+	}
+}
+
+func TestSendNotifications(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	appFS.MkdirAll("/backup/github.com", 0771)
+
+	// Without notifiers, the run status is not recorded
+	sendNotifications(notificationsConfig{NotifyOn: []string{notifyOnSuccess}}, newTestReport(true))
+	if exists, _ := afero.Exists(appFS, "/backup/github.com/"+runStatusFile); exists {
+		t.Fatal("Expected no run status without notifiers")
+	}
+
+	var chatBody, webhookBody []byte
+	var webhookHeader http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/chat":
+			chatBody = body
+		case "/webhook":
+			webhookBody = body
+			webhookHeader = r.Header
+		}
+	}))
+	defer server.Close()
+
+	n := notificationsConfig{
+		Webhook: &webhookNotifierConfig{URL: server.URL + "/webhook", Headers: map[string]string{"Authorization": "Bearer abc"}},
+		Chat:    &chatNotifierConfig{URL: server.URL + "/chat"},
+	}
+
+	// Successful runs are not notified by default
+	sendNotifications(n, newTestReport(false))
+	if chatBody != nil || webhookBody != nil {
+		t.Fatal("Expected no notifications for a successful run")
+	}
+
+	sendNotifications(n, newTestReport(true))
+
+	var chat map[string]string
+	if err := json.Unmarshal(chatBody, &chat); err != nil {
+		t.Fatalf("Error parsing chat notification: %v", err)
+	}
+	if !strings.Contains(chat["text"], "gitbackup failure") || !strings.Contains(chat["text"], "Failed: test/r2: exit status 1: fatal: error") {
+		t.Errorf("Unexpected chat notification: %s", chat["text"])
+	}
+
+	var payload webhookNotification
+	if err := json.Unmarshal(webhookBody, &payload); err != nil {
+		t.Fatalf("Error parsing webhook notification: %v", err)
+	}
+	if payload.Event != notifyOnFailure || len(payload.Failed) != 1 || payload.Cloned[0] != "test/r1" {
+		t.Errorf("Unexpected webhook notification: %+v", payload)
+	}
+	if webhookHeader.Get("Authorization") != "Bearer abc" {
+		t.Errorf("Expected custom header to be sent, got: %v", webhookHeader)
+	}
+
+	// Recovery is notified by default
+	chatBody = nil
+	sendNotifications(n, newTestReport(false))
+	if !strings.Contains(string(chatBody), "gitbackup recovery") {
+		t.Errorf("Expected recovery notification, got: %s", chatBody)
+	}
+	payload = webhookNotification{}
+	if err := json.Unmarshal(webhookBody, &payload); err != nil {
+		t.Fatalf("Error parsing webhook notification: %v", err)
+	}
+	if len(payload.Unchanged) != 1 || payload.Unchanged[0] != "test/r2" {
+		t.Errorf("Expected the unchanged repository in the webhook notification, got: %+v", payload)
+	}
+}
+
+func TestNotificationEventTargetName(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	appFS.MkdirAll("/backup/github.com", 0771)
+
+	report := newTestReport(false)
+	report.Target = "../../work"
+	notificationEvent(report)
+	if exists, _ := afero.Exists(appFS, "/backup/github.com/.gitbackup-status-.._.._work.json"); !exists {
+		files, _ := afero.Glob(appFS, "/backup/*/.gitbackup-status*")
+		t.Errorf("Expected the status file in the backup directory, got: %v", files)
+	}
+}
+
+func TestBuildEmailMessage(t *testing.T) {
+	cfg := &emailNotifierConfig{
+		From:            "gitbackup@example.com",
+		To:              []string{"ops@example.com", "dev@example.com"},
+		SubjectTemplate: "[{{.Event}}] {{.Service}}",
+		BodyTemplate:    "{{range .Cloned}}new: {{.}}\n{{end}}",
+	}
+	msg, err := buildEmailMessage(cfg, notification{Event: notifyOnSuccess, runReport: newTestReport(false)})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	for _, want := range []string{
+		"To: ops@example.com, dev@example.com\r\n",
+		"Subject: [success] github\r\n",
+		"\r\n\r\nnew: test/r1\r\n",
+	} {
+		if !strings.Contains(string(msg), want) {
+			t.Errorf("Expected message to contain %q, got:\n%s", want, msg)
+		}
+	}
+}
+
+func TestValidateNotificationsConfig(t *testing.T) {
+	n := notificationsConfig{
+		NotifyOn: []string{"failure", "sometimes"},
+		Email:    &emailNotifierConfig{SMTPHost: "smtp.example.com"},
+		Chat:     &chatNotifierConfig{URL: "https://chat.example.com/hooks/x", Template: "{{.Event"},
+	}
+	errors := validateNotificationsConfig(n)
+	if len(errors) != 3 {
+		t.Errorf("Expected 3 validation errors, got: %v", errors)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"strings"
 
@@ -10,12 +11,16 @@ import (
 
 // appFlags returns the CLI flags for the backup command.
 func appFlags() []cli.Flag {
-	return []cli.Flag{
+	flags := []cli.Flag{
 		// Config file flag
 		&cli.StringFlag{
 			Name:  "config",
 			Usage: "Path to config file (default: OS config directory)",
 		},
+		&cli.StringSliceFlag{
+			Name:  "target",
+			Usage: "Only back up the named targets of the config file (may be repeated)",
+		},
 
 		// Generic flags
 		&cli.StringFlag{
@@ -46,11 +51,135 @@ func appFlags() []cli.Flag {
 			Name:  "bare",
 			Usage: "Clone bare repositories",
 		},
+		&cli.StringFlag{
+			Name:  "starred-subdir",
+			Usage: "Back up starred repositories to this directory below the backup directory, unless they are also selected by another repo type",
+		},
+		&cli.StringFlag{
+			Name:        "layout",
+			Usage:       "Template of the directories repositories are backed up to below the backup directory, e.g. '{host}/{owner}/{name}.git'",
+			DefaultText: "{host}/{subdir}/{namespace_path}/{name}",
+		},
+		&cli.StringSliceFlag{
+			Name:  "include",
+			Usage: "Only back up repositories whose namespace/name matches this glob or /regular expression/ (may be repeated)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "Skip repositories whose namespace/name matches this glob or /regular expression/ (may be repeated)",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-archived",
+			Usage: "Skip archived repositories, and disabled GitHub repositories",
+		},
+		&cli.IntFlag{
+			Name:  "max-size-mb",
+			Usage: "Skip repositories larger than this many megabytes",
+		},
+		&cli.IntFlag{
+			Name:  "pushed-within-days",
+			Usage: "Skip repositories which were not pushed to in this many days",
+		},
+		&cli.StringSliceFlag{
+			Name:  "language",
+			Usage: "Only back up repositories with this primary language (may be repeated)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "include-topic",
+			Usage: "Only back up repositories with this topic (may be repeated)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "exclude-topic",
+			Usage: "Skip repositories with this topic (may be repeated)",
+		},
+		&cli.BoolFlag{
+			Name:  "explain",
+			Usage: "Log which include or exclude rule selected or skipped each repository",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "List the repositories which would be backed up, and where, without cloning them",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "Output format of --dry-run: table, json, or csv",
+			Value: "table",
+		},
+		&cli.BoolFlag{
+			Name:  "anonymous",
+			Usage: "Back up the public repositories of anonymous.owners without credentials, over HTTPS",
+		},
+		&cli.StringFlag{
+			Name:  "anonymous.owners",
+			Usage: "Users, organizations, groups or workspaces whose public repositories to clone anonymously (separate each value by a comma: 'user1,org2')",
+		},
+		&cli.StringFlag{
+			Name:  "ssh.keyFile",
+			Usage: "Private key to use for SSH clones",
+		},
+		&cli.StringFlag{
+			Name:  "ssh.knownHostsFile",
+			Usage: "Known hosts file to use for SSH clones",
+		},
+		&cli.BoolFlag{
+			Name:  "ssh.strictHostKeyChecking",
+			Usage: "Refuse SSH connections to hosts which are not in the known hosts file",
+		},
+		&cli.BoolFlag{
+			Name:  "ssh.trustOnFirstUse",
+			Usage: "Add the keys of unknown hosts to the known hosts file and refuse changed keys",
+		},
+		&cli.StringSliceFlag{
+			Name:  "ssh.option",
+			Usage: "Extra SSH option for SSH clones, e.g. ConnectTimeout=10 (may be repeated)",
+		},
+		&cli.StringFlag{
+			Name:  "http.proxy",
+			Usage: "Proxy URL for API requests and HTTPS clones (default: HTTPS_PROXY environment variable)",
+		},
+		&cli.StringFlag{
+			Name:  "http.caCert",
+			Usage: "PEM bundle of certificate authorities to trust, in addition to the system ones for API requests and instead of them for git",
+		},
+		&cli.StringFlag{
+			Name:  "http.clientCert",
+			Usage: "PEM client certificate for mutual TLS",
+		},
+		&cli.StringFlag{
+			Name:  "http.clientKey",
+			Usage: "PEM private key of the client certificate",
+		},
+		&cli.BoolFlag{
+			Name:  "http.insecureSkipVerify",
+			Usage: "Do not verify server certificates (insecure)",
+		},
+		&cli.IntFlag{
+			Name:        "api.maxRetries",
+			Usage:       "Number of times to retry rate limited API requests and server errors",
+			DefaultText: "3",
+			Value:       defaultAPIMaxRetries,
+		},
+		&cli.DurationFlag{
+			Name:        "api.maxRateLimitWait",
+			Usage:       "Longest time to wait for an exceeded API rate limit to reset",
+			DefaultText: "15m",
+			Value:       defaultAPIMaxRateLimitWait,
+		},
+		&cli.IntFlag{
+			Name:        "credentials.expiryWarningDays",
+			Usage:       "Warn this many days before the token expires (0 to disable)",
+			DefaultText: "14",
+			Value:       defaultTokenExpiryWarningDays,
+		},
+		&cli.StringFlag{
+			Name:  "metrics.textfile",
+			Usage: "Write Prometheus metrics to this file for the node_exporter textfile collector",
+		},
 
 		// GitHub specific flags
 		&cli.StringFlag{
 			Name:        "github.repoType",
-			Usage:       "Repo types to backup (all, owner, member, starred)",
+			Usage:       "Repo types to backup, separated by commas (all, owner, member, starred, none)",
 			DefaultText: "all",
 			Value:       "all",
 		},
@@ -58,6 +187,27 @@ func appFlags() []cli.Flag {
 			Name:  "github.namespaceWhitelist",
 			Usage: "Organizations/Users from where we should clone (separate each value by a comma: 'user1,org2')",
 		},
+		&cli.StringFlag{
+			Name:  "github.orgs",
+			Usage: "Organizations whose repositories to clone, including those you are not a member of, optionally with types (separate each value by a comma: 'org1,org2:sources+public')",
+		},
+		&cli.StringFlag{
+			Name:  "github.users",
+			Usage: "Users whose repositories to clone, optionally with types (separate each value by a comma: 'user1,user2:forks')",
+		},
+		&cli.Int64Flag{
+			Name:  "github.appID",
+			Usage: "Authenticate as the GitHub App with this ID instead of with a token",
+		},
+		&cli.Int64Flag{
+			Name:        "github.appInstallationID",
+			Usage:       "GitHub App installation to back up",
+			DefaultText: "the only installation of the app",
+		},
+		&cli.StringFlag{
+			Name:  "github.appPrivateKeyFile",
+			Usage: "Private key of the GitHub App",
+		},
 		&cli.BoolFlag{
 			Name:  "github.createUserMigration",
 			Usage: "Download user data",
@@ -94,118 +244,357 @@ func appFlags() []cli.Flag {
 		},
 		&cli.StringFlag{
 			Name:        "gitlab.projectMembershipType",
-			Usage:       "Project type to clone (all, owner, member, starred)",
+			Usage:       "Project types to clone, separated by commas (all, owner, member, starred, none)",
 			DefaultText: "all",
 			Value:       "all",
 		},
+		&cli.StringFlag{
+			Name:  "gitlab.groups",
+			Usage: "Comma separated list of groups whose projects, including those of subgroups, to clone",
+		},
+		&cli.BoolFlag{
+			Name:  "gitlab.includeArchived",
+			Usage: "Clone the archived projects of gitlab.groups",
+		},
+		&cli.BoolFlag{
+			Name:  "gitlab.includeShared",
+			Usage: "Clone the projects shared with gitlab.groups",
+		},
 
 		// Forgejo specific flags
 		&cli.StringFlag{
 			Name:        "forgejo.repoType",
-			Usage:       "Repo types to backup (user, starred)",
+			Usage:       "Repo types to backup, separated by commas (user, starred)",
 			DefaultText: "user",
 			Value:       "user",
 		},
 	}
+	return append(flags, keyringFlags()...)
 }
 
 // buildConfig builds an appConfig from the CLI context, respecting config file precedence.
 // If a config file exists, its values are used as the base and only explicitly-set
-// CLI flags override them.
+// CLI flags override them. When the config file configures several targets,
+// exactly one of them must be selected with --target.
 func buildConfig(cCtx *cli.Context) (*appConfig, error) {
+	configs, _, err := buildConfigs(cCtx)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) != 1 {
+		return nil, errors.New("several targets are configured, select one with --target")
+	}
+	return configs[0], nil
+}
+
+// buildConfigs builds the configuration of every target to back up, and
+// reports whether the targets should be backed up in parallel. Explicitly-set
+// CLI flags override the values of every target in the config file.
+func buildConfigs(cCtx *cli.Context) ([]*appConfig, bool, error) {
 	configPath := cCtx.String("config")
+	selected := cCtx.StringSlice("target")
 
 	// Try to load config file as the base configuration
-	var c appConfig
-	configFileLoaded := false
-
+	var fc *fileConfig
 	resolvedPath, pathErr := resolveConfigPath(configPath)
 	if pathErr == nil {
 		if _, err := os.Stat(resolvedPath); err == nil {
-			fc, err := loadConfigFile(configPath)
+			fc, err = loadConfigFile(configPath)
 			if err != nil {
-				return nil, err
+				return nil, false, err
 			}
-			c = *fileConfigToAppConfig(fc)
-			configFileLoaded = true
 		}
 	}
 
-	if configFileLoaded {
-		// Only override config file values with flags that were explicitly set
-		if cCtx.IsSet("service") {
-			c.service = cCtx.String("service")
-		}
-		if cCtx.IsSet("githost.url") {
-			c.gitHostURL = cCtx.String("githost.url")
-		}
-		if cCtx.IsSet("backupdir") {
-			c.backupDir = cCtx.String("backupdir")
-		}
-		if cCtx.IsSet("ignore-private") {
-			c.ignorePrivate = cCtx.Bool("ignore-private")
-		}
-		if cCtx.IsSet("ignore-fork") {
-			c.ignoreFork = cCtx.Bool("ignore-fork")
-		}
-		if cCtx.IsSet("use-https-clone") {
-			c.useHTTPSClone = cCtx.Bool("use-https-clone")
-		}
-		if cCtx.IsSet("bare") {
-			c.bare = cCtx.Bool("bare")
+	var configs []*appConfig
+	switch {
+	case fc == nil:
+		// No config file — read all values from CLI context directly
+		if len(selected) > 0 {
+			return nil, false, errors.New("--target requires targets to be configured in the config file")
 		}
-		if cCtx.IsSet("github.repoType") {
-			c.githubRepoType = cCtx.String("github.repoType")
+		configs = append(configs, configFromFlags(cCtx))
+	case len(fc.Targets) == 0:
+		if len(selected) > 0 {
+			return nil, false, errors.New("--target requires targets to be configured in the config file")
 		}
-		if cCtx.IsSet("github.namespaceWhitelist") {
-			ns := cCtx.String("github.namespaceWhitelist")
-			if len(ns) > 0 {
-				c.githubNamespaceWhitelist = strings.Split(ns, ",")
+		c := fileConfigToAppConfig(fc)
+		applyFlagOverrides(cCtx, c)
+		configs = append(configs, c)
+	default:
+		names := map[string]bool{}
+		for i := range fc.Targets {
+			t := &fc.Targets[i]
+			if t.Name == "" {
+				return nil, false, fmt.Errorf("targets[%d]: name is required", i)
+			}
+			if names[t.Name] {
+				return nil, false, fmt.Errorf("duplicate target name: %q", t.Name)
 			}
+			names[t.Name] = true
+			if len(selected) > 0 && !contains(selected, t.Name) {
+				continue
+			}
+			c := targetConfigToAppConfig(t, fc)
+			applyFlagOverrides(cCtx, c)
+			configs = append(configs, c)
 		}
-		if cCtx.IsSet("gitlab.projectVisibility") {
-			c.gitlabProjectVisibility = cCtx.String("gitlab.projectVisibility")
+		for _, name := range selected {
+			if !names[name] {
+				return nil, false, fmt.Errorf("unknown target: %q", name)
+			}
 		}
-		if cCtx.IsSet("gitlab.projectMembershipType") {
-			c.gitlabProjectMembershipType = cCtx.String("gitlab.projectMembershipType")
+	}
+
+	// The backup directories are created when the targets are backed up,
+	// so that a target whose directory cannot be created does not stop the
+	// others
+	for _, c := range configs {
+		var err error
+		if c.backupRoot, err = getBackupRoot(c.backupDir); err == nil {
+			c.backupDir, err = getBackupDir(c.backupDir, c.service, c.gitHostURL)
 		}
-		if cCtx.IsSet("forgejo.repoType") {
-			c.forgejoRepoType = cCtx.String("forgejo.repoType")
+		if err != nil {
+			if c.name != "" {
+				return nil, false, fmt.Errorf("target %s: %v", c.name, err)
+			}
+			return nil, false, err
 		}
+	}
+	return configs, fc != nil && fc.Parallel, nil
+}
 
-		// Migration flags are always from CLI (not in config file)
-		c.githubCreateUserMigration = cCtx.Bool("github.createUserMigration")
-		c.githubCreateUserMigrationRetry = cCtx.Bool("github.createUserMigrationRetry")
-		c.githubCreateUserMigrationRetryMax = cCtx.Int("github.createUserMigrationRetryMax")
-		c.githubListUserMigrations = cCtx.Bool("github.listUserMigrations")
-		c.githubWaitForMigrationComplete = cCtx.Bool("github.waitForUserMigration")
-	} else {
-		// No config file — read all values from CLI context directly
+// configFromFlags builds an appConfig from the CLI flags alone
+func configFromFlags(cCtx *cli.Context) *appConfig {
+	var c appConfig
+	c.service = cCtx.String("service")
+	c.gitHostURL = cCtx.String("githost.url")
+	c.backupDir = cCtx.String("backupdir")
+	c.ignorePrivate = cCtx.Bool("ignore-private")
+	c.ignoreFork = cCtx.Bool("ignore-fork")
+	c.useHTTPSClone = cCtx.Bool("use-https-clone")
+	c.bare = cCtx.Bool("bare")
+	c.starredSubdir = cCtx.String("starred-subdir")
+	c.layout = cCtx.String("layout")
+	c.filter = filterConfig{
+		Include:          cCtx.StringSlice("include"),
+		Exclude:          cCtx.StringSlice("exclude"),
+		SkipArchived:     cCtx.Bool("skip-archived"),
+		MaxSizeMB:        cCtx.Int("max-size-mb"),
+		PushedWithinDays: cCtx.Int("pushed-within-days"),
+		Languages:        cCtx.StringSlice("language"),
+		IncludeTopics:    cCtx.StringSlice("include-topic"),
+		ExcludeTopics:    cCtx.StringSlice("exclude-topic"),
+	}
+	c.anonymous.Enabled = cCtx.Bool("anonymous")
+	if owners := cCtx.String("anonymous.owners"); owners != "" {
+		c.anonymous.Owners = strings.Split(owners, ",")
+	}
+	c.githubRepoType = cCtx.String("github.repoType")
+	c.gitlabProjectVisibility = cCtx.String("gitlab.projectVisibility")
+	c.gitlabProjectMembershipType = cCtx.String("gitlab.projectMembershipType")
+	if groups := cCtx.String("gitlab.groups"); groups != "" {
+		c.gitlabGroups.Groups = strings.Split(groups, ",")
+	}
+	c.gitlabGroups.IncludeArchived = cCtx.Bool("gitlab.includeArchived")
+	c.gitlabGroups.IncludeShared = cCtx.Bool("gitlab.includeShared")
+	c.forgejoRepoType = cCtx.String("forgejo.repoType")
+	c.ssh = sshConfig{
+		KeyFile:               cCtx.String("ssh.keyFile"),
+		KnownHostsFile:        cCtx.String("ssh.knownHostsFile"),
+		StrictHostKeyChecking: cCtx.Bool("ssh.strictHostKeyChecking"),
+		TrustOnFirstUse:       cCtx.Bool("ssh.trustOnFirstUse"),
+		Options:               cCtx.StringSlice("ssh.option"),
+	}
+	c.http = httpConfig{
+		Proxy:              cCtx.String("http.proxy"),
+		CACert:             cCtx.String("http.caCert"),
+		ClientCert:         cCtx.String("http.clientCert"),
+		ClientKey:          cCtx.String("http.clientKey"),
+		InsecureSkipVerify: cCtx.Bool("http.insecureSkipVerify"),
+	}
+	maxRetries := cCtx.Int("api.maxRetries")
+	maxRateLimitWait := cCtx.Duration("api.maxRateLimitWait")
+	c.api = apiConfig{MaxRetries: &maxRetries, MaxRateLimitWait: &maxRateLimitWait}
+	expiryWarningDays := cCtx.Int("credentials.expiryWarningDays")
+	c.credentials.ExpiryWarningDays = &expiryWarningDays
+	c.githubApp = githubAppConfig{
+		AppID:          cCtx.Int64("github.appID"),
+		InstallationID: cCtx.Int64("github.appInstallationID"),
+	}
+	if keyFile := cCtx.String("github.appPrivateKeyFile"); keyFile != "" {
+		c.githubApp.PrivateKey = secretRefFile + keyFile
+	}
+	c.githubCreateUserMigration = cCtx.Bool("github.createUserMigration")
+	c.githubCreateUserMigrationRetry = cCtx.Bool("github.createUserMigrationRetry")
+	c.githubCreateUserMigrationRetryMax = cCtx.Int("github.createUserMigrationRetryMax")
+	c.githubListUserMigrations = cCtx.Bool("github.listUserMigrations")
+	c.githubWaitForMigrationComplete = cCtx.Bool("github.waitForUserMigration")
+	c.explain = cCtx.Bool("explain")
+	c.githubOwners.Orgs = parseGithubOwners(cCtx.String("github.orgs"))
+	c.githubOwners.Users = parseGithubOwners(cCtx.String("github.users"))
+
+	ns := cCtx.String("github.namespaceWhitelist")
+	if len(ns) > 0 {
+		c.githubNamespaceWhitelist = strings.Split(ns, ",")
+	}
+	return &c
+}
+
+// applyFlagOverrides overrides config file values with the flags that
+// were explicitly set
+func applyFlagOverrides(cCtx *cli.Context, c *appConfig) {
+	if cCtx.IsSet("service") {
 		c.service = cCtx.String("service")
+	}
+	if cCtx.IsSet("githost.url") {
 		c.gitHostURL = cCtx.String("githost.url")
+	}
+	if cCtx.IsSet("backupdir") {
 		c.backupDir = cCtx.String("backupdir")
+	}
+	if cCtx.IsSet("ignore-private") {
 		c.ignorePrivate = cCtx.Bool("ignore-private")
+	}
+	if cCtx.IsSet("ignore-fork") {
 		c.ignoreFork = cCtx.Bool("ignore-fork")
+	}
+	if cCtx.IsSet("use-https-clone") {
 		c.useHTTPSClone = cCtx.Bool("use-https-clone")
+	}
+	if cCtx.IsSet("bare") {
 		c.bare = cCtx.Bool("bare")
+	}
+	if cCtx.IsSet("starred-subdir") {
+		c.starredSubdir = cCtx.String("starred-subdir")
+	}
+	if cCtx.IsSet("layout") {
+		c.layout = cCtx.String("layout")
+	}
+	if cCtx.IsSet("github.repoType") {
 		c.githubRepoType = cCtx.String("github.repoType")
-		c.gitlabProjectVisibility = cCtx.String("gitlab.projectVisibility")
-		c.gitlabProjectMembershipType = cCtx.String("gitlab.projectMembershipType")
-		c.forgejoRepoType = cCtx.String("forgejo.repoType")
-		c.githubCreateUserMigration = cCtx.Bool("github.createUserMigration")
-		c.githubCreateUserMigrationRetry = cCtx.Bool("github.createUserMigrationRetry")
-		c.githubCreateUserMigrationRetryMax = cCtx.Int("github.createUserMigrationRetryMax")
-		c.githubListUserMigrations = cCtx.Bool("github.listUserMigrations")
-		c.githubWaitForMigrationComplete = cCtx.Bool("github.waitForUserMigration")
-
+	}
+	if cCtx.IsSet("github.namespaceWhitelist") {
 		ns := cCtx.String("github.namespaceWhitelist")
 		if len(ns) > 0 {
 			c.githubNamespaceWhitelist = strings.Split(ns, ",")
 		}
 	}
+	if cCtx.IsSet("github.orgs") {
+		c.githubOwners.Orgs = parseGithubOwners(cCtx.String("github.orgs"))
+	}
+	if cCtx.IsSet("github.users") {
+		c.githubOwners.Users = parseGithubOwners(cCtx.String("github.users"))
+	}
+	if cCtx.IsSet("github.appID") {
+		c.githubApp.AppID = cCtx.Int64("github.appID")
+	}
+	if cCtx.IsSet("github.appInstallationID") {
+		c.githubApp.InstallationID = cCtx.Int64("github.appInstallationID")
+	}
+	if cCtx.IsSet("github.appPrivateKeyFile") {
+		c.githubApp.PrivateKey = secretRefFile + cCtx.String("github.appPrivateKeyFile")
+	}
+	if cCtx.IsSet("gitlab.projectVisibility") {
+		c.gitlabProjectVisibility = cCtx.String("gitlab.projectVisibility")
+	}
+	if cCtx.IsSet("gitlab.projectMembershipType") {
+		c.gitlabProjectMembershipType = cCtx.String("gitlab.projectMembershipType")
+	}
+	if cCtx.IsSet("gitlab.groups") {
+		c.gitlabGroups.Groups = strings.Split(cCtx.String("gitlab.groups"), ",")
+	}
+	if cCtx.IsSet("gitlab.includeArchived") {
+		c.gitlabGroups.IncludeArchived = cCtx.Bool("gitlab.includeArchived")
+	}
+	if cCtx.IsSet("gitlab.includeShared") {
+		c.gitlabGroups.IncludeShared = cCtx.Bool("gitlab.includeShared")
+	}
+	if cCtx.IsSet("forgejo.repoType") {
+		c.forgejoRepoType = cCtx.String("forgejo.repoType")
+	}
+	if cCtx.IsSet("ssh.keyFile") {
+		c.ssh.KeyFile = cCtx.String("ssh.keyFile")
+	}
+	if cCtx.IsSet("ssh.knownHostsFile") {
+		c.ssh.KnownHostsFile = cCtx.String("ssh.knownHostsFile")
+	}
+	if cCtx.IsSet("ssh.strictHostKeyChecking") {
+		c.ssh.StrictHostKeyChecking = cCtx.Bool("ssh.strictHostKeyChecking")
+	}
+	if cCtx.IsSet("ssh.trustOnFirstUse") {
+		c.ssh.TrustOnFirstUse = cCtx.Bool("ssh.trustOnFirstUse")
+	}
+	if cCtx.IsSet("ssh.option") {
+		c.ssh.Options = cCtx.StringSlice("ssh.option")
+	}
+	if cCtx.IsSet("http.proxy") {
+		c.http.Proxy = cCtx.String("http.proxy")
+	}
+	if cCtx.IsSet("http.caCert") {
+		c.http.CACert = cCtx.String("http.caCert")
+	}
+	if cCtx.IsSet("http.clientCert") {
+		c.http.ClientCert = cCtx.String("http.clientCert")
+	}
+	if cCtx.IsSet("http.clientKey") {
+		c.http.ClientKey = cCtx.String("http.clientKey")
+	}
+	if cCtx.IsSet("http.insecureSkipVerify") {
+		c.http.InsecureSkipVerify = cCtx.Bool("http.insecureSkipVerify")
+	}
+	if cCtx.IsSet("include") {
+		c.filter.Include = cCtx.StringSlice("include")
+	}
+	if cCtx.IsSet("exclude") {
+		c.filter.Exclude = cCtx.StringSlice("exclude")
+	}
+	if cCtx.IsSet("skip-archived") {
+		c.filter.SkipArchived = cCtx.Bool("skip-archived")
+	}
+	if cCtx.IsSet("max-size-mb") {
+		c.filter.MaxSizeMB = cCtx.Int("max-size-mb")
+	}
+	if cCtx.IsSet("pushed-within-days") {
+		c.filter.PushedWithinDays = cCtx.Int("pushed-within-days")
+	}
+	if cCtx.IsSet("language") {
+		c.filter.Languages = cCtx.StringSlice("language")
+	}
+	if cCtx.IsSet("include-topic") {
+		c.filter.IncludeTopics = cCtx.StringSlice("include-topic")
+	}
+	if cCtx.IsSet("exclude-topic") {
+		c.filter.ExcludeTopics = cCtx.StringSlice("exclude-topic")
+	}
+	if cCtx.IsSet("anonymous") {
+		c.anonymous.Enabled = cCtx.Bool("anonymous")
+	}
+	if cCtx.IsSet("anonymous.owners") {
+		c.anonymous.Owners = strings.Split(cCtx.String("anonymous.owners"), ",")
+	}
+	if cCtx.IsSet("api.maxRetries") {
+		maxRetries := cCtx.Int("api.maxRetries")
+		c.api.MaxRetries = &maxRetries
+	}
+	if cCtx.IsSet("api.maxRateLimitWait") {
+		maxRateLimitWait := cCtx.Duration("api.maxRateLimitWait")
+		c.api.MaxRateLimitWait = &maxRateLimitWait
+	}
+	if cCtx.IsSet("credentials.expiryWarningDays") {
+		expiryWarningDays := cCtx.Int("credentials.expiryWarningDays")
+		c.credentials.ExpiryWarningDays = &expiryWarningDays
+	}
+
+	// Migration flags are always from CLI (not in config file)
+	c.githubCreateUserMigration = cCtx.Bool("github.createUserMigration")
+	c.githubCreateUserMigrationRetry = cCtx.Bool("github.createUserMigrationRetry")
+	c.githubCreateUserMigrationRetryMax = cCtx.Int("github.createUserMigrationRetryMax")
+	c.githubListUserMigrations = cCtx.Bool("github.listUserMigrations")
+	c.githubWaitForMigrationComplete = cCtx.Bool("github.waitForUserMigration")
 
-	c.backupDir = setupBackupDir(&c.backupDir, &c.service, &c.gitHostURL)
-	return &c, nil
+	// Explaining the filters is a property of the run, not of a target
+	c.explain = cCtx.Bool("explain")
 }
 
 // validateConfig validates the configuration and returns an error if invalid
@@ -215,7 +604,37 @@ func validateConfig(c *appConfig) error {
 	}
 
 	if !validGitlabProjectMembership(c.gitlabProjectMembershipType) {
-		return errors.New("please specify a valid gitlab project membership - all/owner/member/starred")
+		return errors.New("please specify a valid gitlab project membership - all/owner/member/starred/none")
+	}
+	if c.service == "gitlab" && hasRepoType(c.gitlabProjectMembershipType, "none") && len(c.gitlabGroups.Groups) == 0 {
+		return errors.New("gitlab project membership none requires gitlab groups")
+	}
+	errs := append(validateSSHConfig(c.ssh), validateHTTPConfig(c.http)...)
+	if e := validateStarredSubdir(c.starredSubdir); e != "" {
+		errs = append(errs, e)
+	}
+	errs = append(errs, validateLayout(c.layout, c.starredSubdir)...)
+	errs = append(errs, validateAPIConfig(c.api)...)
+	if c.credentials.expiryWarningDays() < 0 {
+		errs = append(errs, "credentials.expiryWarningDays must not be negative")
+	}
+	if c.service == "github" {
+		errs = append(errs, validateGithubAppConfig(c.githubApp, c.githubRepoType)...)
+		errs = append(errs, validateGithubOwners(c.githubOwners)...)
+		if c.githubRepoType == "none" && !c.anonymous.Enabled && len(c.githubOwners.Orgs) == 0 && len(c.githubOwners.Users) == 0 {
+			errs = append(errs, "github repo type none requires github orgs or users")
+		}
+	}
+	errs = append(errs, validateFilterConfig(c.filter, c.service)...)
+	errs = append(errs, validateAnonymousConfig(c.anonymous, c.service, c.githubOwners, c.gitlabGroups)...)
+	if c.anonymous.Enabled && (c.githubCreateUserMigration || c.githubListUserMigrations) {
+		errs = append(errs, "GitHub migrations require a token")
+	}
+	if c.anonymous.Enabled && c.githubApp.configured() {
+		errs = append(errs, "anonymous cannot be used with a GitHub App")
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
 	}
 	return nil
 }
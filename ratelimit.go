@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAPIMaxRetries       = 3
+	defaultAPIMaxRateLimitWait = 15 * time.Minute
+
+	// apiRetryBaseDelay is the delay before the first retry of a server
+	// error, doubled for every further retry
+	apiRetryBaseDelay = 2 * time.Second
+
+	// secondaryRateLimitDelay is how long to wait after GitHub's secondary
+	// rate limit was hit without a Retry-After header, as recommended by
+	// GitHub
+	secondaryRateLimitDelay = time.Minute
+)
+
+// sleepContext waits for d or until ctx is done, overridden in tests
+var sleepContext = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// apiConfig configures how API requests which are rate limited or fail with
+// a server error are retried
+type apiConfig struct {
+	// MaxRetries is the number of times a request is retried
+	MaxRetries *int `yaml:"max_retries,omitempty"`
+	// MaxRateLimitWait is the longest gitbackup waits for a rate limit to
+	// reset, requests fail if the rate limit resets later
+	MaxRateLimitWait *time.Duration `yaml:"max_rate_limit_wait,omitempty"`
+}
+
+func (a apiConfig) maxRetries() int {
+	if a.MaxRetries == nil {
+		return defaultAPIMaxRetries
+	}
+	return *a.MaxRetries
+}
+
+func (a apiConfig) maxRateLimitWait() time.Duration {
+	if a.MaxRateLimitWait == nil {
+		return defaultAPIMaxRateLimitWait
+	}
+	return *a.MaxRateLimitWait
+}
+
+// validateAPIConfig returns the problems found in the API settings of a target
+func validateAPIConfig(a apiConfig) []string {
+	var errors []string
+	if a.maxRetries() < 0 {
+		errors = append(errors, "api.max_retries must not be negative")
+	}
+	if a.maxRateLimitWait() < 0 {
+		errors = append(errors, "api.max_rate_limit_wait must not be negative")
+	}
+	return errors
+}
+
+// rateLimitStatus is the rate limit quota of a service as last reported by
+// its API
+type rateLimitStatus struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+func (s *rateLimitStatus) String() string {
+	return fmt.Sprintf("%d of %d requests remaining, resets at %s",
+		s.Remaining, s.Limit, s.Reset.Local().Format("15:04:05"))
+}
+
+// rateLimitTransport waits for rate limits to reset and retries rate
+// limited requests and server errors
+type rateLimitTransport struct {
+	service string
+	base    http.RoundTripper
+	config  apiConfig
+
+	mutex  sync.Mutex
+	status *rateLimitStatus
+}
+
+// newRateLimitTransport wraps base, or http.DefaultTransport if base is nil
+func newRateLimitTransport(service string, base http.RoundTripper, config apiConfig) *rateLimitTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &rateLimitTransport{service: service, base: base, config: config}
+}
+
+// rateLimit returns the last rate limit quota reported by the API, or nil
+func (t *rateLimitTransport) rateLimit() *rateLimitStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.status == nil {
+		return nil
+	}
+	status := *t.status
+	return &status
+}
+
+func (t *rateLimitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req := r
+		if attempt > 0 {
+			if r.Body != nil && r.GetBody == nil {
+				// The request cannot be sent again
+				return nil, fmt.Errorf("%s API request cannot be retried", t.service)
+			}
+			req = r.Clone(r.Context())
+			if r.GetBody != nil {
+				body, err := r.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		t.recordRateLimit(resp)
+
+		wait, reason := t.retryDelay(r.Method, resp, attempt)
+		if reason == "" {
+			// Wait before returning the last request of the rate limit, as
+			// the GitHub client refuses to send requests until it resets
+			if err := t.waitForReset(r.Context(), resp); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+			return resp, nil
+		}
+		if attempt >= t.config.maxRetries() {
+			return resp, nil
+		}
+		if wait < 0 {
+			wait = 0
+		}
+		if wait > t.config.maxRateLimitWait() {
+			log.Printf("%s: %s, not waiting %s for it to reset\n", t.service, reason, wait.Round(time.Second))
+			return resp, nil
+		}
+
+		log.Printf("%s: %s, retrying in %s\n", t.service, reason, wait.Round(time.Second))
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err := sleepContext(r.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying the request of resp
+// and why, or an empty reason if the request should not be retried. Rate
+// limited requests were not processed and are retried whatever their
+// method, server errors only for GET and HEAD requests, as other requests
+// may have had an effect.
+func (t *rateLimitTransport) retryDelay(method string, resp *http.Response, attempt int) (time.Duration, string) {
+	switch {
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests:
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return retryAfter, "rate limit exceeded"
+		}
+		if remaining, ok := rateLimitHeader(resp, "Remaining"); ok && remaining == "0" {
+			if reset, ok := parseRateLimitReset(resp); ok {
+				// Allow for clock skew between us and the service
+				return time.Until(reset) + time.Second, "rate limit exceeded"
+			}
+		}
+		if resp.StatusCode == http.StatusTooManyRequests || isSecondaryRateLimit(resp) {
+			return secondaryRateLimitDelay << attempt, "secondary rate limit exceeded"
+		}
+	case (method == http.MethodGet || method == http.MethodHead) &&
+		(resp.StatusCode == http.StatusInternalServerError || resp.StatusCode == http.StatusBadGateway ||
+			resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout):
+		return apiRetryBaseDelay << attempt, fmt.Sprintf("server error (%s)", resp.Status)
+	}
+	return 0, ""
+}
+
+// waitForReset waits for the rate limit to reset if resp used up the last
+// request of it
+func (t *rateLimitTransport) waitForReset(ctx context.Context, resp *http.Response) error {
+	if remaining, ok := rateLimitHeader(resp, "Remaining"); !ok || remaining != "0" {
+		return nil
+	}
+	reset, ok := parseRateLimitReset(resp)
+	if !ok {
+		return nil
+	}
+	wait := time.Until(reset) + time.Second
+	if wait <= 0 || wait > t.config.maxRateLimitWait() {
+		return nil
+	}
+	log.Printf("%s: rate limit used up, waiting %s for it to reset\n", t.service, wait.Round(time.Second))
+	return sleepContext(ctx, wait)
+}
+
+// recordRateLimit remembers the rate limit quota reported in resp
+func (t *rateLimitTransport) recordRateLimit(resp *http.Response) {
+	// GitHub reports the quotas of its search and GraphQL APIs separately
+	if resource := resp.Header.Get("X-RateLimit-Resource"); resource != "" && resource != "core" {
+		return
+	}
+	limitValue, ok := rateLimitHeader(resp, "Limit")
+	if !ok {
+		return
+	}
+	remainingValue, _ := rateLimitHeader(resp, "Remaining")
+	limit, err := strconv.Atoi(limitValue)
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(remainingValue)
+	if err != nil {
+		return
+	}
+	reset, _ := parseRateLimitReset(resp)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.status = &rateLimitStatus{Limit: limit, Remaining: remaining, Reset: reset}
+}
+
+// rateLimitHeader returns a rate limit header, named X-RateLimit-<name> by
+// GitHub and Forgejo and RateLimit-<name> by GitLab
+func rateLimitHeader(resp *http.Response, name string) (string, bool) {
+	for _, header := range []string{"X-RateLimit-" + name, "RateLimit-" + name} {
+		if v := resp.Header.Get(header); v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// parseRateLimitReset returns the time the rate limit of resp resets
+func parseRateLimitReset(resp *http.Response) (time.Time, bool) {
+	v, ok := rateLimitHeader(resp, "Reset")
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// parseRetryAfter parses a Retry-After header in seconds or as an HTTP date
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// isSecondaryRateLimit reports whether resp is GitHub's response to
+// exceeding a secondary rate limit. The body of resp can still be read.
+func isSecondaryRateLimit(resp *http.Response) bool {
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	body := strings.ToLower(string(data))
+	return strings.Contains(body, "secondary rate limit") || strings.Contains(body, "abuse detection")
+}
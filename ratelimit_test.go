@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v34/github"
+)
+
+// recordSleeps replaces sleepContext to record the waits instead of sleeping
+func recordSleeps(t *testing.T) *[]time.Duration {
+	t.Helper()
+	var mutex sync.Mutex
+	sleeps := []time.Duration{}
+	saved := sleepContext
+	sleepContext = func(ctx context.Context, d time.Duration) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sleeps = append(sleeps, d)
+		return nil
+	}
+	t.Cleanup(func() { sleepContext = saved })
+	return &sleeps
+}
+
+// newSequenceServer returns a server which answers the requests with the
+// given handlers in turn, repeating the last one
+func newSequenceServer(handlers ...http.HandlerFunc) (*httptest.Server, *int) {
+	var mutex sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		i := requests
+		requests++
+		mutex.Unlock()
+		if i >= len(handlers) {
+			i = len(handlers) - 1
+		}
+		handlers[i](w, r)
+	}))
+	return ts, &requests
+}
+
+func respondWith(code int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+		fmt.Fprint(w, http.StatusText(code))
+	}
+}
+
+func rateLimited(reset time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message": "API rate limit exceeded"}`)
+	}
+}
+
+func intPtr(i int) *int { return &i }
+
+func durationPtr(d time.Duration) *time.Duration { return &d }
+
+func TestRateLimitTransportRetries(t *testing.T) {
+	reset := time.Now().Add(30 * time.Second)
+	tests := []struct {
+		name         string
+		config       apiConfig
+		method       string
+		handlers     []http.HandlerFunc
+		wantStatus   int
+		wantRequests int
+		wantSleeps   int
+	}{
+		{
+			name:         "server errors are retried with backoff",
+			handlers:     []http.HandlerFunc{respondWith(502), respondWith(503), respondWith(200)},
+			wantStatus:   200,
+			wantRequests: 3,
+			wantSleeps:   2,
+		},
+		{
+			name:         "server errors of POST requests are not retried",
+			method:       http.MethodPost,
+			handlers:     []http.HandlerFunc{respondWith(502), respondWith(200)},
+			wantStatus:   502,
+			wantRequests: 1,
+		},
+		{
+			name:         "rate limited POST requests are retried",
+			method:       http.MethodPost,
+			handlers:     []http.HandlerFunc{rateLimited(reset), respondWith(200)},
+			wantStatus:   200,
+			wantRequests: 2,
+			wantSleeps:   1,
+		},
+		{
+			name:         "retries are limited",
+			config:       apiConfig{MaxRetries: intPtr(1)},
+			handlers:     []http.HandlerFunc{respondWith(500)},
+			wantStatus:   500,
+			wantRequests: 2,
+			wantSleeps:   1,
+		},
+		{
+			name:         "client errors are not retried",
+			handlers:     []http.HandlerFunc{respondWith(404), respondWith(200)},
+			wantStatus:   404,
+			wantRequests: 1,
+		},
+		{
+			name:         "permission errors are not retried",
+			handlers:     []http.HandlerFunc{respondWith(403), respondWith(200)},
+			wantStatus:   403,
+			wantRequests: 1,
+		},
+		{
+			name:         "rate limited requests are retried after the reset",
+			handlers:     []http.HandlerFunc{rateLimited(reset), respondWith(200)},
+			wantStatus:   200,
+			wantRequests: 2,
+			wantSleeps:   1,
+		},
+		{
+			name:         "rate limits resetting after the maximum wait are not waited for",
+			config:       apiConfig{MaxRateLimitWait: durationPtr(10 * time.Second)},
+			handlers:     []http.HandlerFunc{rateLimited(reset), respondWith(200)},
+			wantStatus:   403,
+			wantRequests: 1,
+		},
+		{
+			name: "secondary rate limits are retried",
+			handlers: []http.HandlerFunc{func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{"message": "You have exceeded a secondary rate limit."}`)
+			}, respondWith(200)},
+			wantStatus:   200,
+			wantRequests: 2,
+			wantSleeps:   1,
+		},
+		{
+			name: "Retry-After is respected",
+			handlers: []http.HandlerFunc{func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "5")
+				w.WriteHeader(http.StatusTooManyRequests)
+			}, respondWith(200)},
+			wantStatus:   200,
+			wantRequests: 2,
+			wantSleeps:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sleeps := recordSleeps(t)
+			ts, requests := newSequenceServer(tt.handlers...)
+			defer ts.Close()
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req, err := http.NewRequest(method, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: newRateLimitTransport("github", nil, tt.config)}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("Expected status %d, got: %d", tt.wantStatus, resp.StatusCode)
+			}
+			if *requests != tt.wantRequests {
+				t.Errorf("Expected %d requests, got: %d", tt.wantRequests, *requests)
+			}
+			if len(*sleeps) != tt.wantSleeps {
+				t.Errorf("Expected %d waits, got: %v", tt.wantSleeps, *sleeps)
+			}
+		})
+	}
+}
+
+func TestRateLimitTransportWaits(t *testing.T) {
+	sleeps := recordSleeps(t)
+	reset := time.Now().Add(30 * time.Second)
+	ts, _ := newSequenceServer(
+		respondWith(502), respondWith(502), respondWith(502),
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+		},
+		rateLimited(reset),
+		respondWith(200),
+	)
+	defer ts.Close()
+
+	client := &http.Client{Transport: newRateLimitTransport("gitlab", nil, apiConfig{MaxRetries: intPtr(5)})}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	resp.Body.Close()
+
+	got := *sleeps
+	if len(got) != 5 {
+		t.Fatalf("Expected 5 waits, got: %v", got)
+	}
+	for i, want := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 7 * time.Second} {
+		if got[i] != want {
+			t.Errorf("Expected wait %d to be %s, got: %s", i, want, got[i])
+		}
+	}
+	if got[4] < 25*time.Second || got[4] > 32*time.Second {
+		t.Errorf("Expected to wait for the rate limit to reset, got: %s", got[4])
+	}
+}
+
+func TestRateLimitTransportReplaysBody(t *testing.T) {
+	recordSleeps(t)
+	var bodies []string
+	ts, _ := newSequenceServer(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, string(data))
+			w.WriteHeader(http.StatusTooManyRequests)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			data, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, string(data))
+		},
+	)
+	defer ts.Close()
+
+	client := &http.Client{Transport: newRateLimitTransport("github", nil, apiConfig{})}
+	resp, err := client.Post(ts.URL, "application/json", strings.NewReader(`{"repositories": ["a/b"]}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	resp.Body.Close()
+	if len(bodies) != 2 || bodies[0] != bodies[1] || bodies[1] != `{"repositories": ["a/b"]}` {
+		t.Errorf("Expected the body to be sent again, got: %q", bodies)
+	}
+}
+
+func TestRateLimitTransportStatus(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Truncate(time.Second)
+	ts, _ := newSequenceServer(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("RateLimit-Limit", "2000")
+			w.Header().Set("RateLimit-Remaining", "1999")
+			w.Header().Set("RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			// Other GitHub resources do not replace the core quota
+			w.Header().Set("X-RateLimit-Resource", "search")
+			w.Header().Set("X-RateLimit-Limit", "30")
+			w.Header().Set("X-RateLimit-Remaining", "29")
+		},
+	)
+	defer ts.Close()
+
+	transport := newRateLimitTransport("gitlab", nil, apiConfig{})
+	if transport.rateLimit() != nil {
+		t.Fatal("Expected no rate limit before any request")
+	}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	got := transport.rateLimit()
+	if got == nil || got.Limit != 2000 || got.Remaining != 1999 || !got.Reset.Equal(reset) {
+		t.Errorf("Unexpected rate limit: %+v", got)
+	}
+	if !strings.HasPrefix(got.String(), "1999 of 2000 requests remaining, resets at ") {
+		t.Errorf("Unexpected rate limit summary: %s", got)
+	}
+}
+
+func TestRateLimitGitHubClient(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "$$$randome")
+
+	// The first page uses up the rate limit, which the GitHub client
+	// refuses to make further requests for until it resets
+	reset := time.Now().Add(time.Second)
+	ts, _ := newSequenceServer(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-RateLimit-Limit", "60")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			w.Header().Set("Link", fmt.Sprintf(`<%s/user/repos?page=2>; rel="next"`, "http://"+r.Host))
+			fmt.Fprint(w, `[{"full_name": "user/repo1", "name": "repo1", "ssh_url": "git@github.com:user/repo1.git", "private": false, "fork": false}]`)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-RateLimit-Limit", "60")
+			w.Header().Set("X-RateLimit-Remaining", "59")
+			fmt.Fprint(w, `[{"full_name": "user/repo2", "name": "repo2", "ssh_url": "git@github.com:user/repo2.git", "private": false, "fork": false}]`)
+		},
+	)
+	defer ts.Close()
+
+	c := &appConfig{service: "github", gitHostURL: ts.URL + "/"}
+	client, err := newClient(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	repos, err := getGithubRepositories(client.(*github.Client), "all", nil, githubOwnersConfig{}, false)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(repos) != 2 {
+		t.Errorf("Expected 2 repositories, got: %v", repos)
+	}
+	if time.Now().Before(reset) {
+		t.Error("Expected to wait for the rate limit to reset")
+	}
+	if got := c.rateLimit.rateLimit(); got == nil || got.Remaining != 59 {
+		t.Errorf("Expected the last rate limit to be recorded, got: %+v", got)
+	}
+}
+
+func TestAPIConfigFromFile(t *testing.T) {
+	configPath := t.TempDir() + "/gitbackup.yml"
+	os.WriteFile(configPath, []byte("service: github\napi:\n  max_retries: 0\n  max_rate_limit_wait: 2m\n"), 0644)
+	fc, err := loadConfigFile(configPath)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	c := fileConfigToAppConfig(fc)
+	if c.api.maxRetries() != 0 || c.api.maxRateLimitWait() != 2*time.Minute {
+		t.Errorf("Unexpected API settings: %d, %s", c.api.maxRetries(), c.api.maxRateLimitWait())
+	}
+
+	if got := (apiConfig{}); got.maxRetries() != defaultAPIMaxRetries || got.maxRateLimitWait() != defaultAPIMaxRateLimitWait {
+		t.Error("Expected the defaults when the API settings are not set")
+	}
+	if errs := validateAPIConfig(apiConfig{MaxRetries: intPtr(-1)}); len(errs) != 1 {
+		t.Errorf("Expected an error for negative retries, got: %v", errs)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "REDACTED"
+
+// minSecretLength avoids redacting short values such as empty passwords,
+// which would garble unrelated output
+const minSecretLength = 4
+
+var secretsMutex sync.RWMutex
+var knownSecrets []string
+
+// urlPassword matches the password of credentials embedded in URLs
+var urlPassword = regexp.MustCompile(`(://[^/\s:@]*):[^/\s@]+@`)
+
+// registerSecret adds a secret which is redacted from the log output
+func registerSecret(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	for _, s := range knownSecrets {
+		if s == secret {
+			return
+		}
+	}
+	knownSecrets = append(knownSecrets, secret)
+}
+
+// redactSecrets replaces the registered secrets and passwords embedded in
+// URLs in s
+func redactSecrets(s string) string {
+	secretsMutex.RLock()
+	defer secretsMutex.RUnlock()
+	for _, secret := range knownSecrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return urlPassword.ReplaceAllString(s, "$1:"+redacted+"@")
+}
+
+// redactingWriter redacts secrets from everything written to w
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write([]byte(redactSecrets(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// repoPathsFile records, in the backup directory of each host, the
+// directories repositories were moved to because they collided with
+// another repository
+const repoPathsFile = ".gitbackup-paths.json"
+
+// repoPathsMutex serialises reading and writing the repoPathsFile, which
+// targets backed up in parallel or webhooks may share
+var repoPathsMutex sync.Mutex
+
+// unsafePathChars are not allowed in file names on Windows, or are control
+// characters
+var unsafePathChars = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1f]`)
+
+// reservedPathNames are device names on Windows, with or without an
+// extension
+var reservedPathNames = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9]|lpt[0-9])(\..*)?$`)
+
+// sanitizePathSegment returns name as a valid file name on every file
+// system. Characters which are not allowed are replaced by _, and trailing
+// dots and spaces, which Windows drops, are removed.
+func sanitizePathSegment(name string) string {
+	name = unsafePathChars.ReplaceAllString(name, "_")
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "_"
+	}
+	if reservedPathNames.MatchString(name) {
+		return name + "_"
+	}
+	return name
+}
+
+// sanitizeNamespace sanitizes each directory of a namespace such as
+// org/team-a
+func sanitizeNamespace(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+	segments := strings.Split(namespace, "/")
+	for i, segment := range segments {
+		segments[i] = sanitizePathSegment(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// repoPathEntry is the directory a repository is backed up to instead of
+// the directory of the layout, which collided with another repository
+type repoPathEntry struct {
+	// Layout is the directory of the layout, relative to the backup root.
+	// The entry only applies while the layout gives this directory.
+	Layout string `json:"layout"`
+	// Path is the directory the repository is backed up to, relative to
+	// the backup root
+	Path string `json:"path"`
+}
+
+// repoPathKey identifies a repository in the repoPathsFile by the host and
+// path of its clone URL
+func repoPathKey(repo *Repository) string {
+	return strings.ToLower(getCloneURLHost(repo.CloneURL) + "/" + cloneURLPath(repo.CloneURL))
+}
+
+// loadRepoPaths reads the repoPathsFile at p, which may not exist
+func loadRepoPaths(p string) (map[string]repoPathEntry, error) {
+	paths := map[string]repoPathEntry{}
+	data, err := afero.ReadFile(appFS, p)
+	if os.IsNotExist(err) {
+		return paths, nil
+	}
+	if err != nil {
+		return paths, err
+	}
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return map[string]repoPathEntry{}, err
+	}
+	return paths, nil
+}
+
+// saveRepoPaths writes the repoPathsFile at p
+func saveRepoPaths(p string, paths map[string]repoPathEntry) error {
+	data, err := json.MarshalIndent(paths, "", "  ")
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(appFS, p, append(data, '\n'), 0644)
+}
+
+// resolveRepoDirs gives every repository a directory of its own. The
+// directories of the layout may collide, when they only differ in case,
+// after sanitizing, or when the layout leaves out the namespace. The
+// repository already backed up to a colliding directory keeps it, or else
+// the repository with the first clone URL, and the others are backed up to
+// the directory with a suffix derived from their clone URL. The suffixed
+// directories are recorded in the repoPathsFile, so that they are kept
+// when the colliding repository goes away.
+func resolveRepoDirs(c *appConfig, repositories []*Repository) {
+	repoPathsMutex.Lock()
+	defer repoPathsMutex.Unlock()
+
+	pathsFile := path.Join(c.backupDir, repoPathsFile)
+	paths, err := loadRepoPaths(pathsFile)
+	if err != nil {
+		log.Printf("Error reading %s: %v\n", pathsFile, err)
+	}
+	relative := func(dir string) string {
+		return strings.TrimPrefix(dir, c.backupRoot+"/")
+	}
+
+	groups := map[string][]*Repository{}
+	var dirs []string
+	for _, repo := range repositories {
+		dir := layoutRepoDir(c.layout, c, repo)
+		if entry, ok := paths[repoPathKey(repo)]; ok && entry.Layout == relative(dir) {
+			dir = path.Join(c.backupRoot, entry.Path)
+			repo.Dir = dir
+		}
+		// Case-insensitive file systems do not tell the directories apart
+		folded := strings.ToLower(dir)
+		if groups[folded] == nil {
+			dirs = append(dirs, folded)
+		}
+		groups[folded] = append(groups[folded], repo)
+	}
+
+	changed := false
+	for _, folded := range dirs {
+		group := groups[folded]
+		if len(group) < 2 {
+			continue
+		}
+		owner := collisionOwner(c, group)
+		for _, repo := range group {
+			if repo == owner {
+				continue
+			}
+			dir := layoutRepoDir(c.layout, c, repo)
+			repo.Dir = suffixRepoDir(dir, repoPathKey(repo))
+			paths[repoPathKey(repo)] = repoPathEntry{Layout: relative(dir), Path: relative(repo.Dir)}
+			changed = true
+			log.Printf("%s/%s has the same directory as %s/%s, backing it up to %s\n",
+				repo.Namespace, repo.Name, owner.Namespace, owner.Name, repo.Dir)
+		}
+	}
+	if changed && !c.dryRun {
+		if err := saveRepoPaths(pathsFile, paths); err != nil {
+			log.Printf("Error writing %s: %v\n", pathsFile, err)
+		}
+	}
+}
+
+// collisionOwner returns the repository of group, whose directories
+// collide, which keeps the directory: the one which is backed up there
+// already, or else the one with the first clone URL
+func collisionOwner(c *appConfig, group []*Repository) *Repository {
+	for _, repo := range group {
+		dir := layoutRepoDir(c.layout, c, repo)
+		if sameCloneURL(readOriginURL(dir, c.bare), repo.CloneURL) {
+			return repo
+		}
+	}
+	sorted := append([]*Repository{}, group...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return repoPathKey(sorted[i]) < repoPathKey(sorted[j])
+	})
+	return sorted[0]
+}
+
+// suffixRepoDir returns dir with a suffix derived from key, before the
+// .git extension of bare repositories
+func suffixRepoDir(dir, key string) string {
+	hash := sha256.Sum256([]byte(key))
+	suffix := "-" + hex.EncodeToString(hash[:4])
+	if strings.HasSuffix(dir, ".git") {
+		return fmt.Sprintf("%s%s.git", strings.TrimSuffix(dir, ".git"), suffix)
+	}
+	return dir + suffix
+}
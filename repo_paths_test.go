@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestSanitizePathSegment(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"api", "api"},
+		{"My Project", "My Project"},
+		{`a:b*c?`, "a_b_c_"},
+		{"trailing. ", "trailing"},
+		{"..", "_"},
+		{"CON", "CON_"},
+		{"nul.txt", "nul.txt_"},
+		{"console", "console"},
+	}
+	for _, tt := range tests {
+		if got := sanitizePathSegment(tt.name); got != tt.want {
+			t.Errorf("sanitizePathSegment(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if got := sanitizeNamespace("org/aux/team:a"); got != "org/aux_/team_a" {
+		t.Errorf("sanitizeNamespace = %q", got)
+	}
+	if got := getRepoDir("/backup", &Repository{Namespace: "org", Name: "api."}, true); got != "/backup/org/api.git" {
+		t.Errorf("getRepoDir = %q", got)
+	}
+}
+
+func TestResolveRepoDirs(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	c := &appConfig{service: "gitlab", backupRoot: "/backup", backupDir: "/backup/gitlab.com", layout: "{owner}/{name}"}
+	teamA := &Repository{Namespace: "org/team-a", Name: "api", CloneURL: "git@gitlab.com:org/team-a/api.git"}
+	teamB := &Repository{Namespace: "org/team-b", Name: "API", CloneURL: "git@gitlab.com:org/team-b/API.git"}
+	other := &Repository{Namespace: "org", Name: "web", CloneURL: "git@gitlab.com:org/web.git"}
+
+	assignRepoDirs(c, []*Repository{teamB, teamA, other})
+	if teamA.Dir != "/backup/org/api" {
+		t.Errorf("Expected the first clone URL to keep the directory, got %q", teamA.Dir)
+	}
+	suffixed := teamB.Dir
+	if !strings.HasPrefix(suffixed, "/backup/org/API-") || suffixed == teamA.Dir {
+		t.Errorf("Expected a suffixed directory, got %q", suffixed)
+	}
+	if other.Dir != "/backup/org/web" {
+		t.Errorf("Expected no change without a collision, got %q", other.Dir)
+	}
+	data, err := afero.ReadFile(appFS, "/backup/gitlab.com/"+repoPathsFile)
+	if err != nil || !strings.Contains(string(data), `"gitlab.com/org/team-b/api"`) {
+		t.Errorf("Expected the directory to be recorded, got %s %v", data, err)
+	}
+
+	// The recorded directory is kept without the collision
+	teamB = &Repository{Namespace: "org/team-b", Name: "API", CloneURL: "git@gitlab.com:org/team-b/API.git"}
+	assignRepoDirs(c, []*Repository{teamB})
+	if teamB.Dir != suffixed {
+		t.Errorf("Expected the recorded directory %q, got %q", suffixed, teamB.Dir)
+	}
+
+	// ... but not when the layout changes
+	c.layout = "{namespace_path}/{name}"
+	assignRepoDirs(c, []*Repository{teamB})
+	if teamB.Dir != "/backup/org/team-b/API" {
+		t.Errorf("Expected the directory of the new layout, got %q", teamB.Dir)
+	}
+}
+
+func TestResolveRepoDirsExistingBackup(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	c := &appConfig{service: "github", backupRoot: "/backup", backupDir: "/backup/github.com", layout: "{name}"}
+	afero.WriteFile(appFS, "/backup/tool/.git/config", []byte("[remote \"origin\"]\n\turl = git@github.com:zed/tool.git\n"), 0644)
+
+	first := &Repository{Namespace: "alice", Name: "tool", CloneURL: "git@github.com:alice/tool.git"}
+	backedUp := &Repository{Namespace: "zed", Name: "tool", CloneURL: "git@github.com:zed/tool.git"}
+	assignRepoDirs(c, []*Repository{first, backedUp})
+	if backedUp.Dir != "/backup/tool" || first.Dir == "/backup/tool" {
+		t.Errorf("Expected the repository backed up already to keep the directory, got %q and %q", backedUp.Dir, first.Dir)
+	}
+}
+
+func TestResolveRepoDirsDryRun(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	c := &appConfig{service: "github", backupRoot: "/backup", backupDir: "/backup/github.com", layout: "{name}", dryRun: true}
+	first := &Repository{Namespace: "alice", Name: "tool", CloneURL: "git@github.com:alice/tool.git"}
+	second := &Repository{Namespace: "zed", Name: "tool", CloneURL: "git@github.com:zed/tool.git"}
+	assignRepoDirs(c, []*Repository{first, second})
+	if first.Dir == second.Dir {
+		t.Errorf("Expected the colliding directories to be resolved, got %q", first.Dir)
+	}
+	if exists, _ := afero.Exists(appFS, "/backup/github.com/"+repoPathsFile); exists {
+		t.Error("Expected a dry run not to record the directories")
+	}
+}
+
+func TestSuffixRepoDir(t *testing.T) {
+	got := suffixRepoDir("/backup/org/api.git", "gitlab.com/org/team-b/api")
+	if !strings.HasPrefix(got, "/backup/org/api-") || !strings.HasSuffix(got, ".git") || len(got) != len("/backup/org/api-12345678.git") {
+		t.Errorf("Unexpected directory %q", got)
+	}
+	if got != suffixRepoDir("/backup/org/api.git", "gitlab.com/org/team-b/api") {
+		t.Error("Expected the suffix to be deterministic")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Repository types which each service accepts, "none" only lists the
+// repositories of github.orgs, github.users or gitlab.groups
+var (
+	githubRepoTypes       = []string{"all", "owner", "member", "starred", "installation", "none"}
+	gitlabMembershipTypes = []string{"all", "owner", "member", "starred", "none"}
+	forgejoRepoTypes      = []string{"user", "starred"}
+)
+
+// repoTypeList is a comma separated list of repository types, such as
+// "owner,starred". The config file may also list them as a sequence.
+type repoTypeList string
+
+// UnmarshalYAML accepts both a string and a sequence of strings
+func (l *repoTypeList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		var types []string
+		if err := value.Decode(&types); err != nil {
+			return err
+		}
+		*l = repoTypeList(strings.Join(types, ","))
+		return nil
+	}
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	*l = repoTypeList(s)
+	return nil
+}
+
+// splitRepoTypes returns the types of a comma separated list, without
+// blanks and duplicates
+func splitRepoTypes(types string) []string {
+	var list []string
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.TrimSpace(t); t != "" && !contains(list, t) {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// hasRepoType reports whether the comma separated list types contains t
+func hasRepoType(types string, t string) bool {
+	return contains(splitRepoTypes(types), t)
+}
+
+// validateRepoTypes returns the problem with the comma separated list of
+// types of setting, or an empty string. Every type must be one of valid,
+// and "none" cannot be combined with other types.
+func validateRepoTypes(setting string, types string, valid []string) string {
+	list := splitRepoTypes(types)
+	if len(list) == 0 {
+		return fmt.Sprintf("invalid %s: %q (must be %s)", setting, types, describeChoices(valid))
+	}
+	for _, t := range list {
+		if !contains(valid, t) {
+			return fmt.Sprintf("invalid %s: %q (must be %s)", setting, t, describeChoices(valid))
+		}
+	}
+	if len(list) > 1 && contains(list, "none") {
+		return fmt.Sprintf("invalid %s: none cannot be combined with other types", setting)
+	}
+	return ""
+}
+
+// describeChoices formats choices as "a, b, or c"
+func describeChoices(choices []string) string {
+	switch len(choices) {
+	case 0:
+		return ""
+	case 1:
+		return choices[0]
+	case 2:
+		return choices[0] + " or " + choices[1]
+	}
+	return strings.Join(choices[:len(choices)-1], ", ") + ", or " + choices[len(choices)-1]
+}
+
+// validateStarredSubdir returns the problem with the starred_subdir dir, or
+// an empty string. It must be a relative path inside the backup directory.
+func validateStarredSubdir(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	clean := path.Clean(strings.ReplaceAll(dir, "\\", "/"))
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Sprintf("invalid starred_subdir: %q (must be a directory inside the backup directory)", dir)
+	}
+	return ""
+}
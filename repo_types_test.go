@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRepoTypeListYAML(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want repoTypeList
+	}{
+		{"repo_type: owner", "owner"},
+		{"repo_type: owner,starred", "owner,starred"},
+		{"repo_type: [owner, starred]", "owner,starred"},
+		{"repo_type:\n  - member\n  - starred\n", "member,starred"},
+	}
+	for _, tt := range tests {
+		var c githubConfig
+		if err := yaml.Unmarshal([]byte(tt.doc), &c); err != nil {
+			t.Fatalf("Unmarshal(%q): %v", tt.doc, err)
+		}
+		if c.RepoType != tt.want {
+			t.Errorf("Unmarshal(%q) = %q, want %q", tt.doc, c.RepoType, tt.want)
+		}
+	}
+}
+
+func TestSplitRepoTypes(t *testing.T) {
+	got := splitRepoTypes(" owner, starred,,owner ")
+	if !reflect.DeepEqual(got, []string{"owner", "starred"}) {
+		t.Errorf("Expected [owner starred], got %v", got)
+	}
+	if got := orderRepoTypes("starred,member"); !reflect.DeepEqual(got, []string{"member", "starred"}) {
+		t.Errorf("Expected starred to be listed last, got %v", got)
+	}
+}
+
+func TestValidateRepoTypes(t *testing.T) {
+	tests := []struct {
+		types   string
+		wantErr string
+	}{
+		{"owner,starred", ""},
+		{"all", ""},
+		{"", `invalid github.repo_type: "" (must be all, owner, member, starred, installation, or none)`},
+		{"owner,stars", `invalid github.repo_type: "stars" (must be all, owner, member, starred, installation, or none)`},
+		{"none,owner", "invalid github.repo_type: none cannot be combined with other types"},
+	}
+	for _, tt := range tests {
+		if got := validateRepoTypes("github.repo_type", tt.types, githubRepoTypes); got != tt.wantErr {
+			t.Errorf("validateRepoTypes(%q) = %q, want %q", tt.types, got, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateStarredSubdir(t *testing.T) {
+	for _, dir := range []string{"", "starred", "stars/github"} {
+		if e := validateStarredSubdir(dir); e != "" {
+			t.Errorf("Expected %q to be valid, got: %s", dir, e)
+		}
+	}
+	for _, dir := range []string{"/starred", ".", "..", "../starred", `..\starred`} {
+		if e := validateStarredSubdir(dir); e == "" {
+			t.Errorf("Expected %q to be invalid", dir)
+		}
+	}
+}
+
+func TestGetRepoDirStarredSubdir(t *testing.T) {
+	repo := &Repository{Namespace: "other", Name: "r2", Subdir: "starred"}
+	if got := getRepoDir("/backup", repo, false); got != "/backup/starred/other/r2" {
+		t.Errorf("Expected /backup/starred/other/r2, got %s", got)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// repoResult is the outcome of backing up a single repository
+type repoResult struct {
+	Repository string `json:"repository"`
+	Action     string `json:"action"`
+	Changed    bool   `json:"changed"`
+	Error      string `json:"error,omitempty"`
+}
+
+// runReport summarises a gitbackup run for notifications
+type runReport struct {
+	mutex sync.Mutex
+
+	Target    string           `json:"target,omitempty"`
+	Service   string           `json:"service"`
+	BackupDir string           `json:"backup_dir"`
+	StartTime time.Time        `json:"start_time"`
+	EndTime   time.Time        `json:"end_time"`
+	Listed    int              `json:"listed"`
+	RateLimit *rateLimitStatus `json:"rate_limit,omitempty"`
+	Warnings  []string         `json:"warnings,omitempty"`
+	Results   []repoResult     `json:"results"`
+	Error     string           `json:"error,omitempty"`
+}
+
+func newRunReport(c *appConfig) *runReport {
+	return &runReport{
+		Target:    c.name,
+		Service:   c.service,
+		BackupDir: c.backupDir,
+		StartTime: time.Now(),
+	}
+}
+
+// addResult records the outcome of backing up a repository
+func (r *runReport) addResult(repo *Repository, action backupAction, changed bool, err error, stdoutStderr []byte) {
+	result := repoResult{
+		Repository: repo.Namespace + "/" + repo.Name,
+		Action:     string(action),
+		Changed:    changed,
+	}
+	if err != nil {
+		result.Action = "failed"
+		result.Error = err.Error()
+		if len(stdoutStderr) > 0 {
+			result.Error += ": " + string(stdoutStderr)
+		}
+		result.Error = redactSecrets(result.Error)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Results = append(r.Results, result)
+}
+
+// finish records the end of the run and the error it ended with, if any
+func (r *runReport) finish(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.EndTime = time.Now()
+	if err != nil {
+		r.Error = redactSecrets(err.Error())
+	}
+	sort.Slice(r.Results, func(i, j int) bool {
+		return r.Results[i].Repository < r.Results[j].Repository
+	})
+}
+
+// Failed reports whether the run or any repository backup failed
+func (r *runReport) Failed() bool {
+	return r.Error != "" || len(r.FailedRepos()) > 0
+}
+
+// Duration returns how long the run took
+func (r *runReport) Duration() time.Duration {
+	return r.EndTime.Sub(r.StartTime).Round(time.Second)
+}
+
+// Cloned returns the repositories which were cloned for the first time
+func (r *runReport) Cloned() []string {
+	return r.repositories(func(res repoResult) bool { return res.Action == string(backupActionCloned) })
+}
+
+// Updated returns the repositories which received new commits or refs
+func (r *runReport) Updated() []string {
+	return r.repositories(func(res repoResult) bool {
+		return res.Action == string(backupActionUpdated) && res.Changed
+	})
+}
+
+// Unchanged returns the repositories which were already up to date
+func (r *runReport) Unchanged() []string {
+	return r.repositories(func(res repoResult) bool {
+		return res.Action == string(backupActionUpdated) && !res.Changed
+	})
+}
+
+// Skipped returns the repositories which were not backed up
+func (r *runReport) Skipped() []string {
+	return r.repositories(func(res repoResult) bool { return res.Action == string(backupActionSkipped) })
+}
+
+// FailedRepos returns the results of the repositories which failed to back up
+func (r *runReport) FailedRepos() []repoResult {
+	var failed []repoResult
+	for _, res := range r.Results {
+		if res.Action == "failed" {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+func (r *runReport) repositories(match func(repoResult) bool) []string {
+	var repos []string
+	for _, res := range r.Results {
+		if match(res) {
+			repos = append(repos, res.Repository)
+		}
+	}
+	return repos
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRunReport(t *testing.T) {
+	r := newRunReport(&appConfig{service: "gitlab", backupDir: "/backup/gitlab.com"})
+	r.addResult(&Repository{Namespace: "b", Name: "updated"}, backupActionUpdated, true, nil, nil)
+	r.addResult(&Repository{Namespace: "a", Name: "cloned"}, backupActionCloned, true, nil, nil)
+	r.addResult(&Repository{Namespace: "a", Name: "unchanged"}, backupActionUpdated, false, nil, nil)
+	r.addResult(&Repository{Namespace: "a", Name: "private"}, backupActionSkipped, false, nil, nil)
+	r.finish(nil)
+
+	if r.Failed() {
+		t.Error("Expected run not to have failed")
+	}
+	if !reflect.DeepEqual(r.Cloned(), []string{"a/cloned"}) {
+		t.Errorf("Unexpected cloned repositories: %v", r.Cloned())
+	}
+	if !reflect.DeepEqual(r.Updated(), []string{"b/updated"}) {
+		t.Errorf("Unexpected updated repositories: %v", r.Updated())
+	}
+	if !reflect.DeepEqual(r.Unchanged(), []string{"a/unchanged"}) {
+		t.Errorf("Unexpected unchanged repositories: %v", r.Unchanged())
+	}
+	if !reflect.DeepEqual(r.Skipped(), []string{"a/private"}) {
+		t.Errorf("Unexpected skipped repositories: %v", r.Skipped())
+	}
+
+	r.addResult(&Repository{Namespace: "a", Name: "broken"}, backupActionCloned, false, errors.New("exit status 128"), nil)
+	if !r.Failed() || len(r.FailedRepos()) != 1 {
+		t.Error("Expected run with a failed repository to have failed")
+	}
+
+	r = newRunReport(&appConfig{service: "gitlab"})
+	r.finish(errors.New("no repositories retrieved"))
+	if !r.Failed() {
+		t.Error("Expected run with an error to have failed")
+	}
+}
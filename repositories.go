@@ -1,8 +1,9 @@
 package main
 
 import (
-	"log"
+	"fmt"
 	"net/http"
+	"time"
 
 	forgejo "codeberg.org/mvdkleijn/forgejo-sdk/forgejo/v2"
 	"github.com/google/go-github/v34/github"
@@ -29,53 +30,144 @@ type Response struct {
 
 // Repository represents a git repository to be backed up
 type Repository struct {
+	// ID identifies the repository on the service, it is used to list a
+	// repository only once when it is selected by several types
+	ID        string
 	CloneURL  string
 	Name      string
 	Namespace string
 	Private   bool
+
+	// Starred is set for repositories listed because they are starred
+	Starred bool
+	// Subdir is the directory below the backup directory which the
+	// repository is backed up to, such as the starred_subdir
+	Subdir string
+	// Dir is the directory the repository is backed up to as given by the
+	// layout of the target, or empty for the default layout
+	Dir string
+
+	// LegacyNamespace is the namespace directory which earlier versions of
+	// gitbackup backed the repository up to, if it differs from Namespace
+	LegacyNamespace string
+	// LegacyName is the directory name which earlier versions of gitbackup
+	// backed the repository up to, if it differs from Name, such as the
+	// display name of GitLab projects
+	LegacyName string
+
+	// The metadata below is used by the filters, and is the zero value when
+	// the service does not report it
+
+	// Fork is set for repositories which are forks of another repository
+	Fork bool
+	// Archived is set for archived, and disabled GitHub, repositories
+	Archived bool
+	// Size is the size of the repository in bytes
+	Size int64
+	// PushedAt is when the repository was last pushed to, or last active
+	// on services which do not report pushes
+	PushedAt time.Time
+	// Language is the primary language of the repository
+	Language string
+	Topics   []string
 }
 
-// getRepositories retrieves all repositories from the specified git service
-// that match the given criteria (repo type, visibility, membership, etc.)
-func getRepositories(
-	client interface{},
-	service string, githubRepoType string, githubNamespaceWhitelist []string,
-	gitlabProjectVisibility string, gitlabProjectMembershipType string,
-	ignoreFork bool, forgejoRepoType string,
-) ([]*Repository, error) {
+// repositoryKey identifies repo among the repositories of a service, by its
+// ID or, if the service did not report it, by its clone URL
+func repositoryKey(repo *Repository) string {
+	if repo.ID != "" {
+		return "id:" + repo.ID
+	}
+	return repo.CloneURL
+}
+
+// appendNewRepositories appends the repositories of list which were not
+// listed before, as recorded in seen, to repositories and records them
+func appendNewRepositories(repositories []*Repository, seen map[string]bool, list []*Repository) []*Repository {
+	var added []string
+	for _, repo := range list {
+		key := repositoryKey(repo)
+		if seen[key] {
+			continue
+		}
+		added = append(added, key)
+		repositories = append(repositories, repo)
+	}
+	for _, key := range added {
+		seen[key] = true
+	}
+	return repositories
+}
+
+// orderRepoTypes returns the types of the comma separated list types with
+// "starred" last, so that repositories which are also listed by another
+// type are not backed up as starred ones. An empty list returns a single
+// empty type, which lists the default repositories of the service.
+func orderRepoTypes(types string) []string {
+	list := splitRepoTypes(types)
+	if len(list) == 0 {
+		return []string{""}
+	}
+	var ordered []string
+	for _, t := range list {
+		if t != "starred" {
+			ordered = append(ordered, t)
+		}
+	}
+	if len(ordered) < len(list) {
+		ordered = append(ordered, "starred")
+	}
+	return ordered
+}
+
+// getRepositories retrieves all repositories of the target c that match its
+// criteria (repo type, visibility, membership, filters, etc.)
+func getRepositories(client interface{}, c *appConfig) ([]*Repository, error) {
 	if client == nil {
-		log.Fatalf("Couldn't acquire a client to talk to %s", service)
+		return nil, fmt.Errorf("couldn't acquire a client to talk to %s", c.service)
 	}
 
 	var repositories []*Repository
 	var err error
 
-	switch service {
+	switch c.service {
 	case "github":
+		// GitHub Apps can only list the repositories of their installation
+		githubRepoType := c.githubRepoType
+		if c.githubApp.configured() {
+			githubRepoType = "installation"
+		}
 		repositories, err = getGithubRepositories(
 			client.(*github.Client),
 			githubRepoType,
-			githubNamespaceWhitelist,
-			ignoreFork,
+			c.githubNamespaceWhitelist,
+			c.githubOwners,
+			c.ignoreFork,
 		)
 	case "gitlab":
 		repositories, err = getGitlabRepositories(
 			client.(*gitlab.Client),
-			gitlabProjectVisibility,
-			gitlabProjectMembershipType,
-			ignoreFork,
+			c.gitlabProjectVisibility,
+			c.gitlabProjectMembershipType,
+			c.gitlabGroups,
+			c.filter,
+			c.ignoreFork,
 		)
 	case "bitbucket":
 		repositories, err = getBitbucketRepositories(
 			client.(*bitbucket.Client),
-			ignoreFork,
+			c.ignoreFork,
 		)
 	case "forgejo":
 		repositories, err = getForgejoRepositories(
 			client.(*forgejo.Client),
-			forgejoRepoType,
-			ignoreFork,
+			c.forgejoRepoType,
+			c.filter,
+			c.ignoreFork,
 		)
 	}
-	return repositories, err
+	if err != nil {
+		return nil, err
+	}
+	return filterRepositories(repositories, c.filter, c.explain)
 }
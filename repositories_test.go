@@ -9,6 +9,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	forgejo "codeberg.org/mvdkleijn/forgejo-sdk/forgejo/v2"
 	"github.com/google/go-github/v34/github"
@@ -82,12 +83,12 @@ func TestGetPublicGitHubRepositories(t *testing.T) {
 		fmt.Fprint(w, `[{"full_name": "test/r1", "id":1, "ssh_url": "https://github.com/u/r1", "name": "r1", "private": false, "fork": false}]`)
 	})
 
-	repos, err := getRepositories(GitHubClient, "github", "all", []string{}, "", "", false, "")
+	repos, err := getRepositories(GitHubClient, &appConfig{service: "github", githubRepoType: "all"})
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: false})
+	expected = append(expected, &Repository{ID: "1", Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: false})
 	if !reflect.DeepEqual(repos, expected) {
 		t.Errorf("Expected %+v, Got %+v", expected, repos)
 	}
@@ -101,12 +102,12 @@ func TestGetPrivateGitHubRepositories(t *testing.T) {
 		fmt.Fprint(w, `[{"full_name": "test/r1", "id":1, "ssh_url": "https://github.com/u/r1", "name": "r1", "private": true, "fork": false}]`)
 	})
 
-	repos, err := getRepositories(GitHubClient, "github", "all", []string{}, "", "", false, "")
+	repos, err := getRepositories(GitHubClient, &appConfig{service: "github", githubRepoType: "all"})
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: true})
+	expected = append(expected, &Repository{ID: "1", Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: true})
 	if !reflect.DeepEqual(repos, expected) {
 		t.Errorf("Expected %+v, Got %+v", expected, repos)
 	}
@@ -120,12 +121,12 @@ func TestGetStarredGitHubRepositories(t *testing.T) {
 		fmt.Fprint(w, `[{"repo":{"full_name": "test/r1", "id":1, "ssh_url": "https://github.com/u/r1", "name": "r1", "private": true, "fork": false}}]`)
 	})
 
-	repos, err := getRepositories(GitHubClient, "github", "starred", []string{}, "", "", false, "")
+	repos, err := getRepositories(GitHubClient, &appConfig{service: "github", githubRepoType: "starred"})
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: true})
+	expected = append(expected, &Repository{ID: "1", Starred: true, Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: true})
 	if !reflect.DeepEqual(repos, expected) {
 		t.Errorf("Expected %+v, Got %+v", expected, repos)
 	}
@@ -143,19 +144,119 @@ func TestGetWhitelistGitHubRepositories(t *testing.T) {
 		]`)
 	})
 
-	repos, err := getRepositories(GitHubClient, "github", "all", []string{"test", "user1"}, "", "", false, "")
+	repos, err := getRepositories(GitHubClient, &appConfig{service: "github", githubRepoType: "all", githubNamespaceWhitelist: []string{"test", "user1"}})
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: false})
-	expected = append(expected, &Repository{Namespace: "user1", CloneURL: "https://github.com/u/r1", Name: "r1", Private: false})
+	expected = append(expected, &Repository{ID: "1", Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1", Private: false})
+	expected = append(expected, &Repository{ID: "1", Namespace: "user1", CloneURL: "https://github.com/u/r1", Name: "r1", Private: false})
 
 	if !reflect.DeepEqual(repos, expected) {
 		t.Errorf("Expected %+v, Got %+v", expected, repos)
 	}
 }
 
+func TestGetGitHubOwnerRepositories(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	mux.HandleFunc("/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"full_name": "org1/r1", "id":1, "ssh_url": "https://github.com/org1/r1", "name": "r1", "private": true, "fork": false}]`)
+	})
+	mux.HandleFunc("/orgs/org1/repos", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("type") != "all" {
+			t.Errorf("Expected type all, got: %v", r.URL.Query().Get("type"))
+		}
+		fmt.Fprint(w, `[
+			{"full_name": "org1/r1", "id":1, "ssh_url": "https://github.com/org1/r1", "name": "r1", "private": true, "fork": false, "visibility": "private"},
+			{"full_name": "org1/r2", "id":2, "ssh_url": "https://github.com/org1/r2", "name": "r2", "private": false, "fork": false, "visibility": "public"},
+			{"full_name": "org1/r3", "id":3, "ssh_url": "https://github.com/org1/r3", "name": "r3", "private": true, "fork": false, "visibility": "internal"},
+			{"full_name": "org1/r4", "id":4, "ssh_url": "https://github.com/org1/r4", "name": "r4", "private": false, "fork": true, "visibility": "public"}
+		]`)
+	})
+	mux.HandleFunc("/users/user1/repos", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[
+			{"full_name": "user1/r1", "id":5, "ssh_url": "https://github.com/user1/r1", "name": "r1", "private": false, "fork": false},
+			{"full_name": "user1/r2", "id":6, "ssh_url": "https://github.com/user1/r2", "name": "r2", "private": false, "fork": true}
+		]`)
+	})
+
+	owners := githubOwnersConfig{
+		Orgs:  []githubOwnerConfig{{Name: "org1", Types: []string{"sources", "private", "public"}}},
+		Users: []githubOwnerConfig{{Name: "user1", Types: []string{"forks"}}},
+	}
+	repos, err := getRepositories(GitHubClient, &appConfig{service: "github", githubRepoType: "all", githubOwners: owners})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var expected []*Repository
+	expected = append(expected, &Repository{ID: "1", Namespace: "org1", CloneURL: "https://github.com/org1/r1", Name: "r1", Private: true})
+	expected = append(expected, &Repository{ID: "2", Namespace: "org1", CloneURL: "https://github.com/org1/r2", Name: "r2", Private: false})
+	expected = append(expected, &Repository{ID: "6", Namespace: "user1", CloneURL: "https://github.com/user1/r2", Name: "r2", Private: false, Fork: true})
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Expected %+v, Got %+v", expected, repos)
+	}
+
+	// Only the repositories of the owners
+	repos, err = getRepositories(GitHubClient, &appConfig{service: "github", githubRepoType: "none", githubOwners: githubOwnersConfig{Orgs: []githubOwnerConfig{{Name: "org1", Types: []string{"internal"}}}}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected = []*Repository{{ID: "3", Namespace: "org1", CloneURL: "https://github.com/org1/r3", Name: "r3", Private: true}}
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Expected %+v, Got %+v", expected, repos)
+	}
+}
+
+func TestGetGitHubRepositoriesOfSeveralTypes(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	var listed []string
+	mux.HandleFunc("/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		listed = append(listed, r.URL.Query().Get("type"))
+		fmt.Fprint(w, `[{"full_name": "test/r1", "id":1, "ssh_url": "https://github.com/test/r1", "name": "r1", "private": false, "fork": false}]`)
+	})
+	mux.HandleFunc("/user/starred", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"repo":{"full_name": "test/r1", "id":1, "ssh_url": "https://github.com/test/r1", "name": "r1", "private": false, "fork": false}},
+			{"repo":{"full_name": "other/r2", "id":2, "ssh_url": "https://github.com/other/r2", "name": "r2", "private": false, "fork": false}}]`)
+	})
+
+	repos, err := getRepositories(GitHubClient, &appConfig{service: "github", githubRepoType: "starred,owner,member"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(listed, []string{"owner", "member"}) {
+		t.Errorf("Expected the owner and member repositories to be listed first, got: %v", listed)
+	}
+	// The owned repository is not backed up as a starred one
+	expected := []*Repository{
+		{ID: "1", Namespace: "test", CloneURL: "https://github.com/test/r1", Name: "r1"},
+		{ID: "2", Namespace: "other", CloneURL: "https://github.com/other/r2", Name: "r2", Starred: true},
+	}
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Expected %+v, Got %+v", expected, repos)
+	}
+}
+
+func TestParseGithubOwners(t *testing.T) {
+	got := parseGithubOwners("org1, org2:sources+public,,user1:forks")
+	expected := []githubOwnerConfig{
+		{Name: "org1"},
+		{Name: "org2", Types: []string{"sources", "public"}},
+		{Name: "user1", Types: []string{"forks"}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %+v, Got %+v", expected, got)
+	}
+
+	errs := validateGithubOwners(githubOwnersConfig{Users: []githubOwnerConfig{{Name: "user1", Types: []string{"archived"}}}})
+	if len(errs) != 1 {
+		t.Errorf("Expected an invalid type error, got: %v", errs)
+	}
+}
+
 func TestGetGitLabRepositories(t *testing.T) {
 	setupRepositoryTests()
 	defer teardownRepositoryTests()
@@ -164,12 +265,12 @@ func TestGetGitLabRepositories(t *testing.T) {
 		fmt.Fprint(w, `[{"path_with_namespace": "test/r1", "id":1, "ssh_url_to_repo": "https://gitlab.com/u/r1", "name": "r1"}]`)
 	})
 
-	repos, err := getRepositories(GitLabClient, "gitlab", "internal", []string{}, "", "", false, "")
+	repos, err := getRepositories(GitLabClient, &appConfig{service: "gitlab", githubRepoType: "internal"})
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test", CloneURL: "https://gitlab.com/u/r1", Name: "r1"})
+	expected = append(expected, &Repository{ID: "1", Namespace: "test", CloneURL: "https://gitlab.com/u/r1", Name: "r1"})
 	if !reflect.DeepEqual(repos, expected) {
 		for i := 0; i < len(repos); i++ {
 			t.Errorf("Expected %+v, Got %+v", expected[i], repos[i])
@@ -177,6 +278,131 @@ func TestGetGitLabRepositories(t *testing.T) {
 	}
 }
 
+func TestGetGitLabNestedRepositories(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	mux.HandleFunc("/api/v4/projects", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"path_with_namespace": "org/team-a/api", "id":1, "ssh_url_to_repo": "git@gitlab.com:org/team-a/api.git", "name": "api"},
+			{"path_with_namespace": "org/team-b/sub/api", "id":2, "ssh_url_to_repo": "git@gitlab.com:org/team-b/sub/api.git", "name": "api"}]`)
+	})
+
+	repos, err := getRepositories(GitLabClient, &appConfig{service: "gitlab", githubRepoType: "internal"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []*Repository{
+		{ID: "1", Namespace: "org/team-a", CloneURL: "git@gitlab.com:org/team-a/api.git", Name: "api", LegacyNamespace: "org"},
+		{ID: "2", Namespace: "org/team-b/sub", CloneURL: "git@gitlab.com:org/team-b/sub/api.git", Name: "api", LegacyNamespace: "org"},
+	}
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Expected %+v, Got %+v", expected, repos)
+	}
+}
+
+func TestGetGitLabRepositoriesPath(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	mux.HandleFunc("/api/v4/projects", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"path_with_namespace": "test/my-project", "id":1, "ssh_url_to_repo": "git@gitlab.com:test/my-project.git", "name": "My Project"}]`)
+	})
+
+	repos, err := getRepositories(GitLabClient, &appConfig{service: "gitlab", gitlabProjectVisibility: "all", gitlabProjectMembershipType: "owner"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// Projects are backed up by their path rather than their display name
+	expected := []*Repository{
+		{ID: "1", Namespace: "test", CloneURL: "git@gitlab.com:test/my-project.git", Name: "my-project", LegacyName: "My Project"},
+	}
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Expected %+v, Got %+v", expected, repos)
+	}
+}
+
+func TestGetGitLabAllMembershipTypes(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	var queries []url.Values
+	mux.HandleFunc("/api/v4/projects", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		queries = append(queries, query)
+		if query.Get("starred") == "true" {
+			fmt.Fprint(w, `[{"path_with_namespace": "test/r1", "id":1, "ssh_url_to_repo": "https://gitlab.com/test/r1", "name": "r1"},
+				{"path_with_namespace": "other/r2", "id":2, "ssh_url_to_repo": "https://gitlab.com/other/r2", "name": "r2"}]`)
+			return
+		}
+		fmt.Fprint(w, `[{"path_with_namespace": "test/r1", "id":1, "ssh_url_to_repo": "https://gitlab.com/test/r1", "name": "r1"}]`)
+	})
+
+	repos, err := getRepositories(GitLabClient, &appConfig{service: "gitlab", gitlabProjectVisibility: "all", gitlabProjectMembershipType: "all"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// The projects of each membership type are listed separately, as GitLab
+	// only returns the projects matching all of the options
+	if len(queries) != 2 {
+		t.Fatalf("Expected 2 listings, got: %v", queries)
+	}
+	if queries[0].Get("membership") != "true" || queries[0].Get("starred") != "" || queries[0].Get("owned") != "" {
+		t.Errorf("Unexpected query: %v", queries[0])
+	}
+	if queries[1].Get("starred") != "true" || queries[1].Get("membership") != "" || queries[1].Get("owned") != "" {
+		t.Errorf("Unexpected query: %v", queries[1])
+	}
+	expected := []*Repository{
+		{ID: "1", Namespace: "test", CloneURL: "https://gitlab.com/test/r1", Name: "r1"},
+		{ID: "2", Namespace: "other", CloneURL: "https://gitlab.com/other/r2", Name: "r2", Starred: true},
+	}
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Expected %+v, Got %+v", expected, repos)
+	}
+}
+
+func TestGetGitLabGroupRepositories(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	projectsListed := false
+	mux.HandleFunc("/api/v4/projects", func(w http.ResponseWriter, r *http.Request) {
+		projectsListed = true
+		fmt.Fprint(w, `[{"path_with_namespace": "platform/api", "id":1, "ssh_url_to_repo": "git@gitlab.com:platform/api.git", "name": "api"}]`)
+	})
+	mux.HandleFunc("/api/v4/groups/platform/projects", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("include_subgroups") != "true" || query.Get("archived") != "false" || query.Get("with_shared") != "" {
+			t.Errorf("Unexpected query: %v", query)
+		}
+		fmt.Fprint(w, `[{"path_with_namespace": "platform/api", "id":1, "ssh_url_to_repo": "git@gitlab.com:platform/api.git", "name": "api"},
+			{"path_with_namespace": "platform/infra/tools", "id":2, "ssh_url_to_repo": "git@gitlab.com:platform/infra/tools.git", "name": "tools"}]`)
+	})
+
+	groups := gitlabGroupsConfig{Groups: []string{"platform"}, IncludeShared: true}
+	repos, err := getRepositories(GitLabClient, &appConfig{service: "gitlab", gitlabProjectVisibility: "all", gitlabProjectMembershipType: "all", gitlabGroups: groups})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []*Repository{
+		{ID: "1", Namespace: "platform", CloneURL: "git@gitlab.com:platform/api.git", Name: "api"},
+		{ID: "2", Namespace: "platform/infra", CloneURL: "git@gitlab.com:platform/infra/tools.git", Name: "tools", LegacyNamespace: "platform"},
+	}
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Expected %+v, Got %+v", expected, repos)
+	}
+
+	// With the membership type none, only the groups are listed
+	projectsListed = false
+	repos, err = getRepositories(GitLabClient, &appConfig{service: "gitlab", gitlabProjectVisibility: "all", gitlabProjectMembershipType: "none", gitlabGroups: groups})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if projectsListed || len(repos) != 2 {
+		t.Errorf("Expected only the group projects to be listed, got: %+v", repos)
+	}
+}
+
 func TestGetGitLabPrivateRepositories(t *testing.T) {
 	setupRepositoryTests()
 	defer teardownRepositoryTests()
@@ -188,13 +414,12 @@ func TestGetGitLabPrivateRepositories(t *testing.T) {
 "visibility": "private"}]`)
 	})
 
-	repos, err := getRepositories(GitLabClient, "gitlab",
-		"private", []string{}, "", "", false, "")
+	repos, err := getRepositories(GitLabClient, &appConfig{service: "gitlab", githubRepoType: "private"})
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test",
+	expected = append(expected, &Repository{ID: "1", Namespace: "test",
 		CloneURL: "https://gitlab.com/u/r1", Name: "r1", Private: true})
 	if !reflect.DeepEqual(repos, expected) {
 		for i := 0; i < len(repos); i++ {
@@ -216,12 +441,12 @@ func TestGetStarredGitLabRepositories(t *testing.T) {
 		fmt.Fprintf(w, `[]`)
 	})
 
-	repos, err := getRepositories(GitLabClient, "gitlab", "", []string{}, "", "starred", false, "")
+	repos, err := getRepositories(GitLabClient, &appConfig{service: "gitlab", gitlabProjectMembershipType: "starred"})
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "test", CloneURL: "https://gitlab.com/u/r1", Name: "starred-repo-r1"})
+	expected = append(expected, &Repository{ID: "1", Starred: true, Namespace: "test", CloneURL: "https://gitlab.com/u/r1", Name: "starred-repo-r1"})
 
 	if !reflect.DeepEqual(repos, expected) {
 		if len(repos) != len(expected) {
@@ -245,7 +470,7 @@ func TestGetBitbucketRepositories(t *testing.T) {
 		fmt.Fprint(w, `{"pagelen": 10, "page": 1, "size": 1, "values": [{"full_name":"abc/def", "slug":"def", "is_private":true, "links":{"clone":[{"name":"https", "href":"https://bbuser@bitbucket.org/abc/def.git"}, {"name":"ssh", "href":"git@bitbucket.org:abc/def.git"}]}}]}`)
 	})
 
-	repos, err := getRepositories(BitbucketClient, "bitbucket", "", []string{}, "", "", false, "")
+	repos, err := getRepositories(BitbucketClient, &appConfig{service: "bitbucket"})
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -266,7 +491,7 @@ func TestGetForgejoRepositories(t *testing.T) {
 		fmt.Fprint(w, `[{"clone_url":"https://codeberg.org/abc/def.git","ssh_url":"git@codeberg.org:abc/def.git","name":"def","owner":{"login":"abc"},"private":true}]`)
 	})
 
-	repos, err := getRepositories(ForgejoClient, "forgejo", "", []string{}, "", "", false, "")
+	repos, err := getRepositories(ForgejoClient, &appConfig{service: "forgejo"})
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -279,6 +504,34 @@ func TestGetForgejoRepositories(t *testing.T) {
 	}
 }
 
+func TestGetForgejoRepositoriesOfSeveralTypes(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	mux.HandleFunc("/api/v1/user", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":1234,"login":"abc"}`)
+	})
+	mux.HandleFunc("/api/v1/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"id":1,"ssh_url":"git@codeberg.org:abc/def.git","name":"def","owner":{"login":"abc"}}]`)
+	})
+	mux.HandleFunc("/api/v1/repos/search", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data":[{"id":1,"ssh_url":"git@codeberg.org:abc/def.git","name":"def","owner":{"login":"abc"}},
+			{"id":2,"ssh_url":"git@codeberg.org:xyz/ghi.git","name":"ghi","owner":{"login":"xyz"}}]}`)
+	})
+
+	repos, err := getRepositories(ForgejoClient, &appConfig{service: "forgejo", forgejoRepoType: "starred,user"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []*Repository{
+		{ID: "1", Namespace: "abc", CloneURL: "git@codeberg.org:abc/def.git", Name: "def"},
+		{ID: "2", Namespace: "xyz", CloneURL: "git@codeberg.org:xyz/ghi.git", Name: "ghi", Starred: true},
+	}
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Expected %+v, Got %+v", expected, repos)
+	}
+}
+
 func TestGetForgejoStarredRepositories(t *testing.T) {
 	setupRepositoryTests()
 	defer teardownRepositoryTests()
@@ -291,15 +544,88 @@ func TestGetForgejoStarredRepositories(t *testing.T) {
 		fmt.Fprint(w, `{"data":[{"clone_url":"https://codeberg.org/abc/def.git","ssh_url":"git@codeberg.org:abc/def.git","name":"def","owner":{"login":"abc"},"private":true}]}`)
 	})
 
-	repos, err := getRepositories(ForgejoClient, "forgejo", "", []string{}, "", "", false, "starred")
+	repos, err := getRepositories(ForgejoClient, &appConfig{service: "forgejo", forgejoRepoType: "starred"})
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 	var expected []*Repository
-	expected = append(expected, &Repository{Namespace: "abc", CloneURL: "git@codeberg.org:abc/def.git", Name: "def", Private: true})
+	expected = append(expected, &Repository{Namespace: "abc", CloneURL: "git@codeberg.org:abc/def.git", Name: "def", Private: true, Starred: true})
 	if !reflect.DeepEqual(repos, expected) {
 		for i := range repos {
 			t.Errorf("Expected %+v, Got %+v", expected[i], repos[i])
 		}
 	}
 }
+
+func TestGetRepositoriesMetadata(t *testing.T) {
+	setupRepositoryTests()
+	defer teardownRepositoryTests()
+
+	pushed := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	mux.HandleFunc("/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"full_name": "test/r1", "id": 1, "ssh_url": "https://github.com/u/r1", "name": "r1", "private": false, "fork": false,
+			"archived": true, "size": 2048, "pushed_at": "2024-05-01T10:00:00Z", "language": "Go", "topics": ["cli"]}]`)
+	})
+	mux.HandleFunc("/api/v4/projects", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("statistics") != "true" {
+			t.Errorf("Expected the statistics to be requested, got: %v", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `[{"id": 7, "path_with_namespace": "test/r1", "name": "r1", "ssh_url_to_repo": "https://gitlab.com/u/r1",
+			"visibility": "public", "archived": true, "last_activity_at": "2024-05-01T10:00:00Z", "topics": ["cli"],
+			"statistics": {"repository_size": 4096}}]`)
+	})
+	mux.HandleFunc("/api/v4/projects/7/languages", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"Shell": 20.5, "Go": 79.5}`)
+	})
+	mux.HandleFunc("/api/v1/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"clone_url": "https://codeberg.org/abc/def.git", "ssh_url": "git@codeberg.org:abc/def.git", "name": "def",
+			"owner": {"login": "abc"}, "archived": true, "size": 4, "updated_at": "2024-05-01T10:00:00Z"}]`)
+	})
+	mux.HandleFunc("/api/v1/repos/abc/def/languages", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"Go": 5000, "Makefile": 100}`)
+	})
+	mux.HandleFunc("/api/v1/repos/abc/def/topics", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"topics": ["cli"]}`)
+	})
+
+	filter := filterConfig{MaxSizeMB: 1, Languages: []string{"go"}, IncludeTopics: []string{"cli"}}
+	tests := []struct {
+		service string
+		client  interface{}
+		want    *Repository
+	}{
+		{"github", GitHubClient, &Repository{ID: "1", Namespace: "test", CloneURL: "https://github.com/u/r1", Name: "r1",
+			Archived: true, Size: 2 << 20, PushedAt: pushed, Language: "Go", Topics: []string{"cli"}}},
+		{"gitlab", GitLabClient, &Repository{ID: "7", Namespace: "test", CloneURL: "https://gitlab.com/u/r1", Name: "r1",
+			Archived: true, Size: 4096, PushedAt: pushed, Language: "Go", Topics: []string{"cli"}}},
+		{"forgejo", ForgejoClient, &Repository{Namespace: "abc", CloneURL: "git@codeberg.org:abc/def.git", Name: "def",
+			Archived: true, Size: 4 << 10, PushedAt: pushed, Language: "Go", Topics: []string{"cli"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			// Filtering on the size drops the GitHub repository
+			repos, err := getRepositories(tt.client, &appConfig{service: tt.service, githubRepoType: "all", gitlabProjectVisibility: "all", gitlabProjectMembershipType: "all", forgejoRepoType: "user", filter: filter})
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if tt.service == "github" {
+				if len(repos) != 0 {
+					t.Errorf("Expected the repository larger than 1 MB to be skipped, got: %+v", repos)
+				}
+				filter := filter
+				filter.MaxSizeMB = 0
+				repos, err = getRepositories(tt.client, &appConfig{service: tt.service, githubRepoType: "all", filter: filter})
+				if err != nil {
+					t.Fatalf("%v", err)
+				}
+			}
+			if len(repos) != 1 {
+				t.Fatalf("Expected 1 repository, got: %+v", repos)
+			}
+			repos[0].PushedAt = repos[0].PushedAt.UTC()
+			if !reflect.DeepEqual(repos[0], tt.want) {
+				t.Errorf("Expected %+v, Got %+v", tt.want, repos[0])
+			}
+		})
+	}
+}
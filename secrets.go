@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Prefixes of secret references in the config file
+const (
+	secretRefFile  = "file:"
+	secretRefExec  = "exec:"
+	secretRefVault = "vault:"
+)
+
+// envReference matches ${NAME} references to environment variables, and
+// $${NAME} which escapes them
+var envReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// vaultConfig configures the Vault compatible KV HTTP backend used for
+// vault: secret references. The address and token default to the
+// VAULT_ADDR and VAULT_TOKEN environment variables.
+type vaultConfig struct {
+	Address   string `yaml:"address,omitempty"`
+	Token     string `yaml:"token,omitempty"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+var vaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// interpolateEnv replaces ${NAME} in the values of the config file with
+// the value of the environment variable NAME. Mapping keys are left alone.
+func interpolateEnv(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, n := range node.Content {
+			if err := interpolateEnv(n); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := interpolateEnv(node.Content[i]); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		value, err := expandEnv(node.Value)
+		if err != nil {
+			return err
+		}
+		if value != node.Value {
+			node.Value = value
+			// Let plain values such as ${PARALLEL} resolve to bools or ints
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+	}
+	return nil
+}
+
+// expandEnv replaces ${NAME} in s with the value of the environment
+// variable NAME, which must be set
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+		name := envReference.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// resolveConfigSecrets replaces the secret references in the secret
+// settings of the config file with the secrets they refer to
+func resolveConfigSecrets(cfg *fileConfig) error {
+	vault := cfg.Vault
+	if vault != nil && vault.Token != "" {
+		if strings.HasPrefix(vault.Token, secretRefVault) {
+			return errors.New("vault.token cannot be a vault: reference")
+		}
+		token, err := resolveSecret(vault.Token, nil)
+		if err != nil {
+			return fmt.Errorf("vault.token: %v", err)
+		}
+		registerSecret(token)
+		vault.Token = token
+	}
+
+	secrets := map[string]*string{}
+	addTarget := func(prefix string, t *targetConfig) {
+		secrets[prefix+"credentials.token"] = &t.Credentials.Token
+		secrets[prefix+"credentials.username"] = &t.Credentials.Username
+		secrets[prefix+"github.app.private_key"] = &t.GitHub.App.PrivateKey
+	}
+	addTarget("", &cfg.targetConfig)
+	for i := range cfg.Targets {
+		addTarget(fmt.Sprintf("targets[%d].", i), &cfg.Targets[i])
+	}
+	if cfg.Notifications.Email != nil {
+		secrets["notifications.email.password"] = &cfg.Notifications.Email.Password
+	}
+	if cfg.Notifications.Webhook != nil {
+		for name, value := range cfg.Notifications.Webhook.Headers {
+			if isSecretReference(value) {
+				resolved, err := resolveSecret(value, vault)
+				if err != nil {
+					return fmt.Errorf("notifications.webhook.headers.%s: %v", name, err)
+				}
+				registerSecret(resolved)
+				cfg.Notifications.Webhook.Headers[name] = resolved
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(secrets) {
+		value := secrets[name]
+		if *value == "" {
+			continue
+		}
+		resolved, err := resolveSecret(*value, vault)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if !strings.HasSuffix(name, ".username") {
+			registerSecret(resolved)
+		}
+		*value = resolved
+	}
+	return nil
+}
+
+// isSecretReference reports whether value refers to a secret stored elsewhere
+func isSecretReference(value string) bool {
+	return strings.HasPrefix(value, secretRefFile) ||
+		strings.HasPrefix(value, secretRefExec) ||
+		strings.HasPrefix(value, secretRefVault)
+}
+
+// resolveSecret returns the secret ref refers to:
+//
+//	file:/run/secrets/token       the contents of the file
+//	exec:pass show gitlab         the output of the command
+//	vault:secret/data/gitbackup#token
+//	                              the key of the secret at the path in Vault
+//
+// Any other value is returned as is. The errors never contain the secret.
+func resolveSecret(ref string, vault *vaultConfig) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, secretRefFile):
+		data, err := os.ReadFile(strings.TrimPrefix(ref, secretRefFile))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(ref, secretRefExec):
+		args := strings.Fields(strings.TrimPrefix(ref, secretRefExec))
+		if len(args) == 0 {
+			return "", errors.New("exec: reference without a command")
+		}
+		// Only stdout is captured, so that the secret is not mixed with
+		// any prompts or warnings of the command
+		cmd := execCommand(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("error running %s: %v", args[0], err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	case strings.HasPrefix(ref, secretRefVault):
+		return readVaultSecret(strings.TrimPrefix(ref, secretRefVault), vault)
+	}
+	return ref, nil
+}
+
+// readVaultSecret reads a key of a secret from a Vault compatible KV
+// store. ref has the form path#key; both version 1 and version 2 of the
+// KV secrets engine are supported.
+func readVaultSecret(ref string, vault *vaultConfig) (string, error) {
+	secretPath, key, ok := strings.Cut(ref, "#")
+	if !ok || secretPath == "" || key == "" {
+		return "", fmt.Errorf("invalid vault reference %q, expected vault:<path>#<key>", ref)
+	}
+
+	var cfg vaultConfig
+	if vault != nil {
+		cfg = *vault
+	}
+	if cfg.Address == "" {
+		cfg.Address = os.Getenv("VAULT_ADDR")
+	}
+	if cfg.Token == "" {
+		cfg.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if cfg.Address == "" {
+		return "", errors.New("vault address not set, set vault.address or VAULT_ADDR")
+	}
+
+	url := strings.TrimRight(cfg.Address, "/") + "/v1/" + strings.TrimLeft(secretPath, "/")
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Token != "" {
+		req.Header.Set("X-Vault-Token", cfg.Token)
+	}
+	if cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", cfg.Namespace)
+	}
+	resp, err := vaultHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error reading %s from vault: %s", secretPath, resp.Status)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("error decoding vault response: %v", err)
+	}
+	data := secret.Data
+	// KV version 2 nests the secret in data.data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, isMetadata := data["metadata"]; isMetadata {
+			data = nested
+		}
+	}
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("key %s not found in vault secret %s", key, secretPath)
+	}
+	return value, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func fakePassCommand(command string, args ...string) (cmd *exec.Cmd) {
+	cs := []string{"-test.run=TestHelperPassProcess", "--", command}
+	cs = append(cs, args...)
+	cmd = exec.Command(os.Args[0], cs...)
+	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
+	return cmd
+}
+
+func TestHelperPassProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	if os.Args[3] != "pass" || os.Args[4] != "show" || os.Args[5] != "gitlab" {
+		fmt.Fprintf(os.Stderr, "Expected pass show gitlab to be executed. Got %v", os.Args[3:])
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stdout, "exectoken")
+	os.Exit(0)
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("GITBACKUP_TEST_DIR", "/data")
+	defer os.Unsetenv("GITBACKUP_TEST_DIR")
+	os.Unsetenv("GITBACKUP_TEST_UNSET")
+
+	var tests = []struct {
+		value    string
+		expected string
+		wantErr  bool
+	}{
+		{"${GITBACKUP_TEST_DIR}/backups", "/data/backups", false},
+		{"no references", "no references", false},
+		{"pa$$word $HOME", "pa$$word $HOME", false},
+		{"$${GITBACKUP_TEST_DIR}", "${GITBACKUP_TEST_DIR}", false},
+		{"${GITBACKUP_TEST_UNSET}", "", true},
+	}
+	for _, tc := range tests {
+		got, err := expandEnv(tc.value)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: expected error: %v, got: %v", tc.value, tc.wantErr, err)
+		}
+		if !tc.wantErr && got != tc.expected {
+			t.Errorf("%s: expected %s, got: %s", tc.value, tc.expected, got)
+		}
+	}
+}
+
+func TestLoadConfigFileInterpolation(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+	os.Setenv("GITBACKUP_TEST_DIR", "/data")
+	os.Setenv("GITBACKUP_TEST_PARALLEL", "true")
+	defer os.Unsetenv("GITBACKUP_TEST_DIR")
+	defer os.Unsetenv("GITBACKUP_TEST_PARALLEL")
+
+	os.WriteFile(configPath, []byte("parallel: ${GITBACKUP_TEST_PARALLEL}\nservice: github\nbackup_dir: ${GITBACKUP_TEST_DIR}/github\n"), 0644)
+	cfg, err := loadConfigFile(configPath)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if cfg.BackupDir != "/data/github" {
+		t.Errorf("Expected backup_dir /data/github, got: %v", cfg.BackupDir)
+	}
+	if !cfg.Parallel {
+		t.Error("Expected parallel to be true")
+	}
+
+	os.WriteFile(configPath, []byte("service: github\nbackup_dir: ${GITBACKUP_TEST_UNSET}\n"), 0644)
+	if _, err := loadConfigFile(configPath); err == nil {
+		t.Error("Expected an error for an unset environment variable")
+	}
+}
+
+func TestLoadConfigFileSecrets(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, defaultConfigFile)
+	secretPath := filepath.Join(tmpDir, "token")
+	os.WriteFile(secretPath, []byte("filetoken\n"), 0600)
+
+	execCommand = fakePassCommand
+	defer func() {
+		execCommand = exec.Command
+	}()
+
+	data := fmt.Sprintf(`targets:
+  - name: personal
+    service: github
+    credentials:
+      token: file:%s
+  - name: work
+    service: gitlab
+    credentials:
+      token: "exec:pass show gitlab"
+`, secretPath)
+	os.WriteFile(configPath, []byte(data), 0644)
+
+	cfg, err := loadConfigFile(configPath)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if cfg.Targets[0].Credentials.Token != "filetoken" {
+		t.Errorf("Expected token from file, got: %v", cfg.Targets[0].Credentials.Token)
+	}
+	if cfg.Targets[1].Credentials.Token != "exectoken" {
+		t.Errorf("Expected token from command, got: %v", cfg.Targets[1].Credentials.Token)
+	}
+
+	os.WriteFile(configPath, []byte("service: github\ncredentials:\n  token: file:"+filepath.Join(tmpDir, "missing")+"\n"), 0644)
+	_, err = loadConfigFile(configPath)
+	if err == nil || !strings.Contains(err.Error(), "credentials.token") {
+		t.Errorf("Expected an error naming the setting, got: %v", err)
+	}
+}
+
+func TestReadVaultSecret(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vaulttoken" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/gitbackup":
+			fmt.Fprint(w, `{"data": {"data": {"gitlab": "kv2token"}, "metadata": {"version": 1}}}`)
+		case "/v1/kv/gitbackup":
+			fmt.Fprint(w, `{"data": {"gitlab": "kv1token"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	vault := &vaultConfig{Address: ts.URL, Token: "vaulttoken"}
+	var tests = []struct {
+		ref      string
+		expected string
+		wantErr  bool
+	}{
+		{"vault:secret/data/gitbackup#gitlab", "kv2token", false},
+		{"vault:kv/gitbackup#gitlab", "kv1token", false},
+		{"vault:kv/gitbackup#github", "", true},
+		{"vault:kv/missing#gitlab", "", true},
+		{"vault:kv/gitbackup", "", true},
+	}
+	for _, tc := range tests {
+		got, err := resolveSecret(tc.ref, vault)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: expected error: %v, got: %v", tc.ref, tc.wantErr, err)
+		}
+		if got != tc.expected {
+			t.Errorf("%s: expected %s, got: %s", tc.ref, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// sshConfig configures the ssh command used by git for SSH clones
+type sshConfig struct {
+	// KeyFile is the private key used instead of the keys of the
+	// ssh-agent and ~/.ssh/config
+	KeyFile string `yaml:"key_file,omitempty"`
+	// KnownHostsFile is used instead of ~/.ssh/known_hosts
+	KnownHostsFile string `yaml:"known_hosts_file,omitempty"`
+	// StrictHostKeyChecking refuses to connect to hosts whose key is not
+	// in the known hosts file
+	StrictHostKeyChecking bool `yaml:"strict_host_key_checking,omitempty"`
+	// TrustOnFirstUse adds the keys of unknown hosts to the known hosts
+	// file, and refuses to connect to known hosts whose key changed
+	TrustOnFirstUse bool `yaml:"trust_on_first_use,omitempty"`
+	// Options are passed to ssh with -o, e.g. "ConnectTimeout=10"
+	Options []string `yaml:"options,omitempty"`
+}
+
+// isZero reports whether no SSH settings are configured, in which case the
+// git processes use the ambient SSH configuration
+func (s sshConfig) isZero() bool {
+	return s.KeyFile == "" && s.KnownHostsFile == "" && !s.StrictHostKeyChecking &&
+		!s.TrustOnFirstUse && len(s.Options) == 0
+}
+
+// validateSSHConfig returns the problems found in the SSH settings of a target
+func validateSSHConfig(s sshConfig) []string {
+	var errors []string
+	if s.StrictHostKeyChecking && s.TrustOnFirstUse {
+		errors = append(errors, "ssh.strict_host_key_checking and ssh.trust_on_first_use cannot both be set")
+	}
+	if s.KeyFile != "" {
+		keyFile, err := homedir.Expand(s.KeyFile)
+		if err == nil {
+			_, err = os.Stat(keyFile)
+		}
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("invalid ssh.key_file: %v", err))
+		}
+	}
+	for _, option := range s.Options {
+		if !strings.Contains(option, "=") {
+			errors = append(errors, fmt.Sprintf("invalid ssh.options value: %q (must be Option=value)", option))
+		}
+	}
+	return errors
+}
+
+// buildSSHCommand returns the value of GIT_SSH_COMMAND for the SSH settings
+// of a target, or an empty string to use the ambient SSH configuration.
+func buildSSHCommand(s sshConfig) (string, error) {
+	if s.isZero() {
+		return "", nil
+	}
+	if s.StrictHostKeyChecking && s.TrustOnFirstUse {
+		return "", errors.New("strict host key checking and trust on first use cannot both be enabled")
+	}
+
+	// Never wait for passphrases or host key confirmations
+	parts := []string{"ssh", "-o", "BatchMode=yes"}
+	if s.KeyFile != "" {
+		keyFile, err := homedir.Expand(s.KeyFile)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, "-i", shellQuote(keyFile), "-o", "IdentitiesOnly=yes")
+	}
+	if s.KnownHostsFile != "" {
+		knownHostsFile, err := homedir.Expand(s.KnownHostsFile)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, "-o", shellQuote("UserKnownHostsFile="+knownHostsFile))
+	}
+	switch {
+	case s.StrictHostKeyChecking:
+		parts = append(parts, "-o", "StrictHostKeyChecking=yes")
+	case s.TrustOnFirstUse:
+		parts = append(parts, "-o", "StrictHostKeyChecking=accept-new")
+	}
+	for _, option := range s.Options {
+		parts = append(parts, "-o", shellQuote(option))
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// knownHostsDir returns the directory of the known hosts file which ssh
+// adds the keys of new hosts to with trust on first use. ssh creates the
+// file, but not its directory, so it is created before running git.
+func knownHostsDir(s sshConfig) string {
+	if !s.TrustOnFirstUse || s.KnownHostsFile == "" {
+		return ""
+	}
+	knownHostsFile, err := homedir.Expand(s.KnownHostsFile)
+	if err != nil {
+		return ""
+	}
+	return filepath.Dir(knownHostsFile)
+}
+
+// shellQuote quotes s for the shell which git runs GIT_SSH_COMMAND with
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildSSHCommand(t *testing.T) {
+	tmpDir := t.TempDir()
+	knownHosts := filepath.Join(tmpDir, "ssh", "known_hosts")
+
+	var tests = []struct {
+		name     string
+		config   sshConfig
+		expected string
+		wantErr  bool
+	}{
+		{"default", sshConfig{}, "", false},
+		{
+			"key and strict known hosts",
+			sshConfig{KeyFile: "/keys/id_ed25519", KnownHostsFile: "/keys/known_hosts", StrictHostKeyChecking: true},
+			"ssh -o BatchMode=yes -i '/keys/id_ed25519' -o IdentitiesOnly=yes -o 'UserKnownHostsFile=/keys/known_hosts' -o StrictHostKeyChecking=yes",
+			false,
+		},
+		{
+			"trust on first use",
+			sshConfig{KnownHostsFile: knownHosts, TrustOnFirstUse: true},
+			"ssh -o BatchMode=yes -o 'UserKnownHostsFile=" + knownHosts + "' -o StrictHostKeyChecking=accept-new",
+			false,
+		},
+		{
+			"options",
+			sshConfig{Options: []string{"ConnectTimeout=10", "ProxyCommand=nc -x proxy:1080 %h %p"}},
+			"ssh -o BatchMode=yes -o 'ConnectTimeout=10' -o 'ProxyCommand=nc -x proxy:1080 %h %p'",
+			false,
+		},
+		{"quoting", sshConfig{KeyFile: "/keys/it's"}, `ssh -o BatchMode=yes -i '/keys/it'\''s' -o IdentitiesOnly=yes`, false},
+		{"conflicting", sshConfig{StrictHostKeyChecking: true, TrustOnFirstUse: true}, "", true},
+	}
+	for _, tc := range tests {
+		got, err := buildSSHCommand(tc.config)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: expected error: %v, got: %v", tc.name, tc.wantErr, err)
+		}
+		if got != tc.expected {
+			t.Errorf("%s: expected %q, got: %q", tc.name, tc.expected, got)
+		}
+	}
+
+	// The directory of the known hosts file is only created before running git
+	if _, err := os.Stat(filepath.Dir(knownHosts)); !os.IsNotExist(err) {
+		t.Errorf("Expected the known hosts directory not to be created yet, got: %v", err)
+	}
+}
+
+func TestCreateKnownHostsDir(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+
+	if dir := knownHostsDir(sshConfig{KnownHostsFile: knownHosts, StrictHostKeyChecking: true}); dir != "" {
+		t.Errorf("Expected no directory without trust on first use, got: %q", dir)
+	}
+	opts := &cloneOptions{knownHostsDir: knownHostsDir(sshConfig{KnownHostsFile: knownHosts, TrustOnFirstUse: true})}
+	if err := opts.createKnownHostsDir(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(knownHosts)); err != nil {
+		t.Errorf("Expected the known hosts directory to be created: %v", err)
+	}
+	var noOpts *cloneOptions
+	if err := noOpts.createKnownHostsDir(); err != nil {
+		t.Errorf("Expected no error without clone options, got: %v", err)
+	}
+}
+
+func TestValidateSSHConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	keyFile := filepath.Join(tmpDir, "id_ed25519")
+	os.WriteFile(keyFile, []byte("key"), 0600)
+
+	if errs := validateSSHConfig(sshConfig{KeyFile: keyFile, Options: []string{"ConnectTimeout=10"}}); len(errs) != 0 {
+		t.Errorf("Expected no errors, got: %v", errs)
+	}
+	errs := validateSSHConfig(sshConfig{
+		KeyFile:               filepath.Join(tmpDir, "missing"),
+		StrictHostKeyChecking: true,
+		TrustOnFirstUse:       true,
+		Options:               []string{"ConnectTimeout"},
+	})
+	if len(errs) != 3 {
+		t.Errorf("Expected 3 errors, got: %v", errs)
+	}
+}
+
+func TestNewGitCommandSSH(t *testing.T) {
+	opts := &cloneOptions{sshCommand: "ssh -o BatchMode=yes"}
+	cmd := newGitCommand(opts, "git@github.com:amitsaha/gitbackup.git", "clone", "git@github.com:amitsaha/gitbackup.git", "/tmp/repo")
+	if !strings.Contains(strings.Join(cmd.Env, "\n"), "GIT_SSH_COMMAND=ssh -o BatchMode=yes") {
+		t.Errorf("Expected GIT_SSH_COMMAND to be set, got: %v", cmd.Env)
+	}
+	if strings.Join(cmd.Args[1:], " ") != "clone git@github.com:amitsaha/gitbackup.git /tmp/repo" {
+		t.Errorf("Expected plain git clone, got: %v", cmd.Args)
+	}
+}
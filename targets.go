@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// targetName returns the name used for a target in logs and metrics
+func targetName(c *appConfig) string {
+	if c.name != "" {
+		return c.name
+	}
+	return c.service
+}
+
+// runTargets backs up every configured target, one after the other or in
+// parallel. A target which fails does not stop the others from being
+// backed up.
+func runTargets(configs []*appConfig, parallel bool) error {
+	reports := make([]*runReport, len(configs))
+	errs := make([]error, len(configs))
+
+	var wg sync.WaitGroup
+	for i, c := range configs {
+		if !parallel {
+			reports[i], errs[i] = runTarget(c)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, c *appConfig) {
+			defer wg.Done()
+			reports[i], errs[i] = runTarget(c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	if len(configs) == 1 {
+		return errs[0]
+	}
+
+	printTargetsSummary(reports, errs)
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d targets failed", failed, len(configs))
+	}
+	return nil
+}
+
+// runTarget backs up a single target and sends its notifications
+func runTarget(c *appConfig) (*runReport, error) {
+	if c.name != "" {
+		log.Printf("Backing up target %s (%s)\n", c.name, c.service)
+	}
+	report := newRunReport(c)
+
+	// A failed pre_run hook fails the run, without its post_run hook
+	err := runHook(hookPreRun, c.hooks.PreRun, c)
+	preRunFailed := err != nil
+
+	// The pre_run hook may mount the backup directory
+	if err == nil {
+		err = setupBackupDir(c)
+	}
+	var client any
+	if err == nil {
+		// newClient may prompt for a login
+		globalSettingsMutex.Lock()
+		client, err = newClient(c)
+		globalSettingsMutex.Unlock()
+	}
+	if err == nil {
+		report.Warnings, err = checkToken(client, c)
+	}
+
+	if err == nil {
+		if c.githubCreateUserMigration {
+			err = handleGithubCreateUserMigration(client, c)
+		} else {
+			err = handleGitRepositoryClone(client, c, report)
+		}
+	}
+	if err != nil && c.name != "" {
+		log.Printf("Error backing up target %s: %v\n", c.name, err)
+	}
+	if c.rateLimit != nil {
+		if status := c.rateLimit.rateLimit(); status != nil {
+			log.Printf("%s API rate limit: %s\n", targetName(c), status)
+			report.RateLimit = status
+		}
+	}
+	report.finish(err)
+
+	if !preRunFailed {
+		if hookErr := runHook(hookPostRun, c.hooks.PostRun, c, runHookEnv(report)...); hookErr != nil {
+			log.Printf("Error: %v\n", hookErr)
+			if err == nil {
+				err = hookErr
+				report.finish(err)
+			}
+		}
+	}
+	if report.Failed() {
+		if hookErr := runHook(hookOnFailure, c.hooks.OnFailure, c, runHookEnv(report)...); hookErr != nil {
+			log.Printf("Error: %v\n", hookErr)
+		}
+	}
+	sendNotifications(c.notifications, report)
+	return report, err
+}
+
+// printTargetsSummary prints the outcome of every target of a run
+func printTargetsSummary(reports []*runReport, errs []error) {
+	fmt.Println("Summary:")
+	for i, r := range reports {
+		status := "ok"
+		if errs[i] != nil {
+			status = "failed: " + errs[i].Error()
+		}
+		fmt.Printf("  %s (%s): %d listed, %d cloned, %d updated, %d unchanged, %d skipped, %d failed - %s\n",
+			r.Target, r.Service, r.Listed, len(r.Cloned()), len(r.Updated()), len(r.Unchanged()),
+			len(r.Skipped()), len(r.FailedRepos()), status)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestTargetName(t *testing.T) {
+	if got := targetName(&appConfig{service: "github"}); got != "github" {
+		t.Errorf("Expected target name github, got: %v", got)
+	}
+	if got := targetName(&appConfig{name: "work", service: "gitlab"}); got != "work" {
+		t.Errorf("Expected target name work, got: %v", got)
+	}
+}
+
+func TestRunTargetsIsolatesFailures(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	os.Unsetenv("UNSET_TOKEN_ONE")
+	os.Unsetenv("UNSET_TOKEN_TWO")
+
+	for _, parallel := range []bool{false, true} {
+		configs := []*appConfig{
+			{name: "one", service: "gitlab", backupDir: "/tmp/one", credentials: credentialsConfig{TokenEnv: "UNSET_TOKEN_ONE"}},
+			{name: "two", service: "gitlab", backupDir: "/tmp/two", credentials: credentialsConfig{TokenEnv: "UNSET_TOKEN_TWO"}},
+		}
+		err := runTargets(configs, parallel)
+		if err == nil || err.Error() != "2 of 2 targets failed" {
+			t.Errorf("Expected both targets to fail (parallel: %v), got: %v", parallel, err)
+		}
+	}
+}
+
+func TestRunTargetsBackupDirError(t *testing.T) {
+	useOsFs(t)
+	os.Unsetenv("UNSET_TOKEN_ONE")
+	os.Unsetenv("UNSET_TOKEN_TWO")
+	// The backup directory of the first target cannot be created
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "file")
+	if err := os.WriteFile(file, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	configs := []*appConfig{
+		{name: "one", service: "gitlab", backupDir: filepath.Join(file, "one"), credentials: credentialsConfig{TokenEnv: "UNSET_TOKEN_ONE"}},
+		{name: "two", service: "gitlab", backupDir: filepath.Join(tmpDir, "two"), credentials: credentialsConfig{TokenEnv: "UNSET_TOKEN_TWO"}},
+	}
+	reports := make([]*runReport, len(configs))
+	errs := make([]error, len(configs))
+	for i, c := range configs {
+		reports[i], errs[i] = runTarget(c)
+	}
+	if errs[0] == nil || !strings.Contains(reports[0].Error, "error creating backup directory") {
+		t.Errorf("Expected the backup directory of the first target not to be created, got: %v", errs[0])
+	}
+	if errs[1] == nil || !strings.Contains(errs[1].Error(), "UNSET_TOKEN_TWO") {
+		t.Errorf("Expected the second target to be backed up, got: %v", errs[1])
+	}
+	if _, err := os.Stat(configs[1].backupDir); err != nil {
+		t.Errorf("Expected the backup directory of the second target to be created: %v", err)
+	}
+}
+
+func TestRunTargetsSingleTargetError(t *testing.T) {
+	appFS = afero.NewMemMapFs()
+	os.Unsetenv("UNSET_TOKEN_ONE")
+
+	configs := []*appConfig{
+		{service: "gitlab", backupDir: "/tmp/one", credentials: credentialsConfig{TokenEnv: "UNSET_TOKEN_ONE"}},
+	}
+	err := runTargets(configs, false)
+	if err == nil || !strings.Contains(err.Error(), "UNSET_TOKEN_ONE") {
+		t.Errorf("Expected the error of the target to be returned, got: %v", err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	forgejo "codeberg.org/mvdkleijn/forgejo-sdk/forgejo/v2"
+	"github.com/google/go-github/v34/github"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// defaultTokenExpiryWarningDays is how many days before a token expires
+// gitbackup starts warning about it
+const defaultTokenExpiryWarningDays = 14
+
+// errTokenRejected is returned when the service does not accept the token
+var errTokenRejected = errors.New("token rejected")
+
+// githubTokenExpirationLayouts are the formats of GitHub's
+// GitHub-Authentication-Token-Expiration header
+var githubTokenExpirationLayouts = []string{
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05 -0700",
+}
+
+// tokenInfo describes the token used to access a service
+type tokenInfo struct {
+	// scopes are the scopes granted to the token, nil if the service
+	// does not report them
+	scopes []string
+	// expiresAt is the zero time if the token does not expire or the
+	// service does not report when it does
+	expiresAt time.Time
+	// missing are the scopes found to be missing by probing the API, for
+	// services which do not report the scopes of a token
+	missing []string
+}
+
+// scopeRequirement is a permission the token needs for the selected mode,
+// granted by any one of the scopes in anyOf
+type scopeRequirement struct {
+	anyOf   []string
+	purpose string
+}
+
+func (r scopeRequirement) String() string {
+	return fmt.Sprintf("%s (to %s)", strings.Join(r.anyOf, " or "), r.purpose)
+}
+
+// requiredTokenScopes returns the scopes the token needs for the mode
+// selected in c. Only GitHub and GitLab report the scopes of a token.
+func requiredTokenScopes(c *appConfig) []scopeRequirement {
+	var required []scopeRequirement
+	switch c.service {
+	case "github":
+		switch {
+		case c.githubCreateUserMigration:
+			required = append(required,
+				scopeRequirement{[]string{"repo"}, "export repositories"},
+				scopeRequirement{[]string{"user"}, "create user migrations"},
+				scopeRequirement{[]string{"admin:org"}, "create organization migrations"},
+			)
+		case c.githubListUserMigrations:
+			required = append(required, scopeRequirement{[]string{"user"}, "list user migrations"})
+		case !c.ignorePrivate:
+			required = append(required, scopeRequirement{[]string{"repo"}, "back up private repositories"})
+		}
+	case "gitlab":
+		required = append(required, scopeRequirement{[]string{"api", "read_api"}, "list projects"})
+		if c.useHTTPSClone {
+			required = append(required, scopeRequirement{[]string{"api", "read_repository"}, "clone over HTTPS"})
+		}
+	}
+	return required
+}
+
+// missingScopes returns the requirements which none of scopes satisfy
+func missingScopes(required []scopeRequirement, scopes []string) []string {
+	var missing []string
+	for _, r := range required {
+		satisfied := false
+		for _, scope := range r.anyOf {
+			if contains(scopes, scope) {
+				satisfied = true
+				break
+			}
+		}
+		if !satisfied {
+			missing = append(missing, r.String())
+		}
+	}
+	return missing
+}
+
+// tokenSettingsURL returns the page of the service where tokens are created
+func tokenSettingsURL(c *appConfig) string {
+	base := "https://" + knownServices[c.service]
+	if c.gitHostURL != "" {
+		if u, err := url.Parse(c.gitHostURL); err == nil && u.Host != "" {
+			base = u.Scheme + "://" + u.Host
+		}
+	}
+	switch c.service {
+	case "github":
+		return base + "/settings/tokens"
+	case "gitlab":
+		return base + "/-/user_settings/personal_access_tokens"
+	case "forgejo":
+		return base + "/user/settings/applications"
+	}
+	return base
+}
+
+// checkToken inspects the token used by client and returns an error if it
+// was rejected, has expired or lacks scopes required for the mode selected
+// in c. Warnings, such as the token expiring soon, are logged and returned.
+func checkToken(client interface{}, c *appConfig) ([]string, error) {
+	warnings, err := tokenProblems(client, c)
+	for _, warning := range warnings {
+		log.Printf("Warning: %s\n", warning)
+	}
+	return warnings, err
+}
+
+// tokenProblems returns the warnings and the error checkToken reports
+func tokenProblems(client interface{}, c *appConfig) ([]string, error) {
+	// GitHub App installation tokens are renewed by gitbackup
+	if c.service == "github" && c.githubApp.configured() {
+		return nil, nil
+	}
+	if c.anonymous.Enabled {
+		return nil, nil
+	}
+
+	var info *tokenInfo
+	var err error
+	switch client := client.(type) {
+	case *github.Client:
+		info, err = inspectGitHubToken(client)
+	case *gitlab.Client:
+		info, err = inspectGitLabToken(client)
+	case *forgejo.Client:
+		info, err = inspectForgejoToken(client)
+	default:
+		return nil, nil
+	}
+	settingsURL := tokenSettingsURL(c)
+	if err == errTokenRejected {
+		return nil, fmt.Errorf("the %s token was rejected, it may have expired or been revoked. Create a new token at %s", c.service, settingsURL)
+	}
+	if err != nil {
+		return []string{fmt.Sprintf("could not inspect the %s token: %v", c.service, err)}, nil
+	}
+
+	missing := info.missing
+	if info.scopes != nil {
+		missing = missingScopes(requiredTokenScopes(c), info.scopes)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("the %s token is missing required scopes: %s. Add them to the token at %s",
+			c.service, strings.Join(missing, ", "), settingsURL)
+	}
+
+	if info.expiresAt.IsZero() {
+		return nil, nil
+	}
+	expiresIn := time.Until(info.expiresAt)
+	if expiresIn <= 0 {
+		return nil, fmt.Errorf("the %s token expired on %s. Create a new token at %s",
+			c.service, info.expiresAt.Format("2006-01-02"), settingsURL)
+	}
+	days := int(expiresIn.Hours() / 24)
+	if days >= c.credentials.expiryWarningDays() {
+		return nil, nil
+	}
+	return []string{fmt.Sprintf("the %s token expires on %s (in %d days). Create a new token at %s",
+		c.service, info.expiresAt.Format("2006-01-02"), days, settingsURL)}, nil
+}
+
+// inspectGitHubToken reads the scopes and expiry of the token from the
+// headers GitHub adds to API responses. Fine-grained tokens do not report
+// their scopes.
+func inspectGitHubToken(client *github.Client) (*tokenInfo, error) {
+	_, resp, err := client.Users.Get(context.Background(), "")
+	if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+		return nil, errTokenRejected
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := &tokenInfo{}
+	if _, ok := resp.Header["X-Oauth-Scopes"]; ok {
+		info.scopes = []string{}
+		for _, scope := range strings.Split(resp.Header.Get("X-OAuth-Scopes"), ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				info.scopes = append(info.scopes, scope)
+			}
+		}
+	}
+	if v := resp.Header.Get("GitHub-Authentication-Token-Expiration"); v != "" {
+		for _, layout := range githubTokenExpirationLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				info.expiresAt = t
+				break
+			}
+		}
+	}
+	return info, nil
+}
+
+// inspectGitLabToken reads the scopes and expiry of a personal, group or
+// project access token. OAuth tokens are not inspected.
+func inspectGitLabToken(client *gitlab.Client) (*tokenInfo, error) {
+	pat, resp, err := client.PersonalAccessTokens.GetSinglePersonalAccessToken()
+	if err != nil {
+		if resp == nil || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusNotFound) {
+			return nil, err
+		}
+		// OAuth tokens are not access tokens, check the token is accepted
+		_, resp, err := client.Users.CurrentUser()
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return nil, errTokenRejected
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &tokenInfo{}, nil
+	}
+	if pat.Revoked || !pat.Active {
+		return nil, errTokenRejected
+	}
+
+	info := &tokenInfo{scopes: pat.Scopes}
+	if info.scopes == nil {
+		info.scopes = []string{}
+	}
+	if pat.ExpiresAt != nil {
+		info.expiresAt = time.Time(*pat.ExpiresAt)
+	}
+	return info, nil
+}
+
+// inspectForgejoToken probes the endpoints gitbackup uses, as Forgejo does
+// not report the scopes of a token. Forgejo tokens do not expire.
+func inspectForgejoToken(client *forgejo.Client) (*tokenInfo, error) {
+	info := &tokenInfo{}
+	_, resp, err := client.GetMyUserInfo()
+	if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+		return nil, errTokenRejected
+	}
+	if resp != nil && resp.StatusCode == http.StatusForbidden {
+		info.missing = append(info.missing, "read:user (to read your profile)")
+	} else if err != nil {
+		return nil, err
+	}
+
+	_, resp, err = client.ListMyRepos(forgejo.ListReposOptions{ListOptions: forgejo.ListOptions{Page: 1, PageSize: 1}})
+	if resp != nil && resp.StatusCode == http.StatusForbidden {
+		info.missing = append(info.missing, "read:repository (to list repositories)")
+	} else if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
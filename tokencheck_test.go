@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequiredTokenScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		c      *appConfig
+		scopes []string
+		want   []string
+	}{
+		{"github private repos", &appConfig{service: "github"}, []string{"repo"}, nil},
+		{"github without repo", &appConfig{service: "github"}, []string{"read:user"}, []string{"repo (to back up private repositories)"}},
+		{"github public repos only", &appConfig{service: "github", ignorePrivate: true}, []string{}, nil},
+		{
+			"github migration",
+			&appConfig{service: "github", githubCreateUserMigration: true},
+			[]string{"repo", "user"},
+			[]string{"admin:org (to create organization migrations)"},
+		},
+		{"gitlab read_api", &appConfig{service: "gitlab"}, []string{"read_api"}, nil},
+		{
+			"gitlab https clone",
+			&appConfig{service: "gitlab", useHTTPSClone: true},
+			[]string{"read_api"},
+			[]string{"api or read_repository (to clone over HTTPS)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := missingScopes(requiredTokenScopes(tt.c), tt.scopes)
+			if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("Expected missing scopes %v, got: %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTokenSettingsURL(t *testing.T) {
+	tests := []struct {
+		service, gitHostURL, want string
+	}{
+		{"github", "", "https://github.com/settings/tokens"},
+		{"github", "https://ghe.example.com/api/v3/", "https://ghe.example.com/settings/tokens"},
+		{"gitlab", "http://gitlab.example.com:8080", "http://gitlab.example.com:8080/-/user_settings/personal_access_tokens"},
+		{"forgejo", "", "https://codeberg.org/user/settings/applications"},
+	}
+	for _, tt := range tests {
+		if got := tokenSettingsURL(&appConfig{service: tt.service, gitHostURL: tt.gitHostURL}); got != tt.want {
+			t.Errorf("tokenSettingsURL(%q, %q) = %v, want %v", tt.service, tt.gitHostURL, got, tt.want)
+		}
+	}
+}
+
+// newTokenTestServer returns a server answering every request with status
+// and the given headers and body
+func newTokenTestServer(t *testing.T, status int, headers map[string]string, body string) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestCheckGitHubToken(t *testing.T) {
+	soon := time.Now().Add(3 * 24 * time.Hour).UTC()
+	tests := []struct {
+		name         string
+		c            appConfig
+		status       int
+		headers      map[string]string
+		wantErr      string
+		wantWarnings int
+	}{
+		{
+			name:    "classic token",
+			status:  http.StatusOK,
+			headers: map[string]string{"X-OAuth-Scopes": "repo, read:org"},
+		},
+		{
+			name:    "missing scope",
+			status:  http.StatusOK,
+			headers: map[string]string{"X-OAuth-Scopes": "public_repo"},
+			wantErr: "missing required scopes: repo",
+		},
+		{
+			name:    "migration scopes",
+			c:       appConfig{githubCreateUserMigration: true},
+			status:  http.StatusOK,
+			headers: map[string]string{"X-OAuth-Scopes": "repo"},
+			wantErr: "user (to create user migrations), admin:org",
+		},
+		{
+			name:    "fine-grained token",
+			status:  http.StatusOK,
+			headers: map[string]string{},
+		},
+		{
+			name:         "expires soon",
+			status:       http.StatusOK,
+			headers:      map[string]string{"GitHub-Authentication-Token-Expiration": soon.Format("2006-01-02 15:04:05 MST")},
+			wantWarnings: 1,
+		},
+		{
+			name:    "expiry warning disabled",
+			c:       appConfig{credentials: credentialsConfig{ExpiryWarningDays: intPtr(0)}},
+			status:  http.StatusOK,
+			headers: map[string]string{"GitHub-Authentication-Token-Expiration": soon.Format("2006-01-02 15:04:05 -0700")},
+		},
+		{
+			name:    "expires later",
+			status:  http.StatusOK,
+			headers: map[string]string{"GitHub-Authentication-Token-Expiration": soon.Add(30 * 24 * time.Hour).Format("2006-01-02 15:04:05 MST")},
+		},
+		{
+			name:    "rejected",
+			status:  http.StatusUnauthorized,
+			wantErr: "token was rejected",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTokenTestServer(t, tt.status, tt.headers, `{"login": "ghuser"}`)
+			c := tt.c
+			c.service = "github"
+			c.gitHostURL = ts.URL + "/"
+			c.credentials.Token = "ghtoken"
+			client, err := newClient(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			warnings, err := checkToken(client, &c)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Expected an error containing %q, got: %v", tt.wantErr, err)
+			}
+			if len(warnings) != tt.wantWarnings {
+				t.Errorf("Expected %d warnings, got: %v", tt.wantWarnings, warnings)
+			}
+		})
+	}
+}
+
+func TestCheckGitLabToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Header.Get("Private-Token") {
+		case "readonly":
+			fmt.Fprint(w, `{"scopes": ["read_user"], "active": true}`)
+		case "expiring":
+			fmt.Fprintf(w, `{"scopes": ["api"], "active": true, "expires_at": %q}`, time.Now().AddDate(0, 0, 5).Format("2006-01-02"))
+		case "expired":
+			fmt.Fprintf(w, `{"scopes": ["api"], "active": false, "expires_at": %q}`, time.Now().AddDate(0, 0, -1).Format("2006-01-02"))
+		case "oauth":
+			if r.URL.Path == "/api/v4/personal_access_tokens/self" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, `{"message": "401 Unauthorized"}`)
+				return
+			}
+			fmt.Fprint(w, `{"username": "gluser"}`)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message": "401 Unauthorized"}`)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		token        string
+		wantErr      string
+		wantWarnings int
+	}{
+		{"readonly", "api or read_api (to list projects)", 0},
+		{"expiring", "", 1},
+		{"expired", "token was rejected", 0},
+		{"oauth", "", 0},
+		{"invalid", "token was rejected", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			c := &appConfig{service: "gitlab", gitHostURL: ts.URL, credentials: credentialsConfig{Token: tt.token}}
+			client, err := newClient(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			warnings, err := checkToken(client, c)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Expected an error containing %q, got: %v", tt.wantErr, err)
+			}
+			if len(warnings) != tt.wantWarnings {
+				t.Errorf("Expected %d warnings, got: %v", tt.wantWarnings, warnings)
+			}
+		})
+	}
+}
+
+func TestCheckForgejoToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/user":
+			fmt.Fprint(w, `{"login": "fjuser"}`)
+		case "/api/v1/user/repos":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message": "token does not have at least one of required scope(s): [read:repository]"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	c := &appConfig{service: "forgejo", gitHostURL: ts.URL, credentials: credentialsConfig{Token: "fjtoken"}}
+	client, err := newClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkToken(client, c)
+	if err == nil || !strings.Contains(err.Error(), "read:repository") || !strings.Contains(err.Error(), ts.URL+"/user/settings/applications") {
+		t.Errorf("Expected an error naming the missing scope, got: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// httpConfig configures the HTTP connections to a self-hosted forge, for
+// both the API clients and HTTPS clones
+type httpConfig struct {
+	// Proxy is the URL of the proxy, instead of the HTTPS_PROXY and
+	// HTTP_PROXY environment variables
+	Proxy string `yaml:"proxy,omitempty"`
+	// CACert is a PEM bundle of certificate authorities which the API
+	// requests trust in addition to the system ones, and git instead of
+	// them
+	CACert string `yaml:"ca_cert,omitempty"`
+	// ClientCert and ClientKey are a PEM certificate and key for mutual TLS
+	ClientCert string `yaml:"client_cert,omitempty"`
+	ClientKey  string `yaml:"client_key,omitempty"`
+	// InsecureSkipVerify disables the verification of server certificates
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+}
+
+// isZero reports whether no HTTP settings are configured
+func (h httpConfig) isZero() bool {
+	return h.Proxy == "" && h.CACert == "" && h.ClientCert == "" && h.ClientKey == "" && !h.InsecureSkipVerify
+}
+
+// validateHTTPConfig returns the problems found in the HTTP settings of a target
+func validateHTTPConfig(h httpConfig) []string {
+	var errors []string
+	if h.Proxy != "" {
+		if _, err := parseProxyURL(h.Proxy); err != nil {
+			errors = append(errors, fmt.Sprintf("invalid http.proxy: %v", err))
+		}
+	}
+	if h.CACert != "" {
+		if _, err := loadCACertPool(h.CACert); err != nil {
+			errors = append(errors, fmt.Sprintf("invalid http.ca_cert: %v", err))
+		}
+	}
+	if (h.ClientCert == "") != (h.ClientKey == "") {
+		errors = append(errors, "http.client_cert and http.client_key must be set together")
+	} else if h.ClientCert != "" {
+		if _, err := loadClientCertificate(h.ClientCert, h.ClientKey); err != nil {
+			errors = append(errors, fmt.Sprintf("invalid http.client_cert or http.client_key: %v", err))
+		}
+	}
+	return errors
+}
+
+// newHTTPTransport returns the transport used by the API clients and for
+// downloads, or nil to use http.DefaultTransport
+func newHTTPTransport(h httpConfig) (http.RoundTripper, error) {
+	if h.isZero() {
+		return nil, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if h.Proxy != "" {
+		proxyURL, err := parseProxyURL(h.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: h.InsecureSkipVerify}
+	if h.CACert != "" {
+		pool, err := loadCACertPool(h.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if h.ClientCert != "" || h.ClientKey != "" {
+		cert, err := loadClientCertificate(h.ClientCert, h.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// gitHTTPEnv returns the environment variables which apply the HTTP
+// settings to git. git trusts only the certificate authorities of the CA
+// bundle, rather than adding them to the system ones.
+func gitHTTPEnv(h httpConfig) ([]string, error) {
+	var env []string
+	if h.Proxy != "" {
+		// git honours the lowercase variables of curl
+		env = append(env, "http_proxy="+h.Proxy, "https_proxy="+h.Proxy)
+	}
+	files := []struct {
+		name, path string
+	}{
+		{"GIT_SSL_CAINFO", h.CACert},
+		{"GIT_SSL_CERT", h.ClientCert},
+		{"GIT_SSL_KEY", h.ClientKey},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		path, err := homedir.Expand(f.path)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, f.name+"="+path)
+	}
+	if h.InsecureSkipVerify {
+		env = append(env, "GIT_SSL_NO_VERIFY=true")
+	}
+	return env, nil
+}
+
+func parseProxyURL(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "" || proxyURL.Host == "" {
+		return nil, fmt.Errorf("%q is not an absolute URL", proxy)
+	}
+	return proxyURL, nil
+}
+
+// loadCACertPool returns the system certificate pool with the certificates
+// of the PEM bundle at path added
+func loadCACertPool(path string) (*x509.CertPool, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return pool, nil
+}
+
+func loadClientCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	certFile, err := homedir.Expand(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyFile, err = homedir.Expand(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
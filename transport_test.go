@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeServerCA writes the certificate of a TLS test server as a CA bundle
+func writeServerCA(t *testing.T, ts *httptest.Server) string {
+	t.Helper()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return caFile
+}
+
+func TestNewHTTPTransportTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	var tests = []struct {
+		name    string
+		config  httpConfig
+		wantErr bool
+	}{
+		{"untrusted", httpConfig{}, true},
+		{"ca bundle", httpConfig{CACert: writeServerCA(t, ts)}, false},
+		{"insecure", httpConfig{InsecureSkipVerify: true}, false},
+	}
+	for _, tc := range tests {
+		transport, err := newHTTPTransport(tc.config)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got: %v", tc.name, err)
+		}
+		client := &http.Client{Transport: transport}
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: expected error: %v, got: %v", tc.name, tc.wantErr, err)
+		}
+	}
+
+	if transport, err := newHTTPTransport(httpConfig{}); transport != nil || err != nil {
+		t.Errorf("Expected the default transport without settings, got: %v, %v", transport, err)
+	}
+}
+
+func TestNewHTTPTransportProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		fmt.Fprint(w, "ok")
+	}))
+	defer proxy.Close()
+
+	transport, err := newHTTPTransport(httpConfig{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("http://gitlab.example.com/api/v4/projects")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	resp.Body.Close()
+	if proxied != "http://gitlab.example.com/api/v4/projects" {
+		t.Errorf("Expected the request to go through the proxy, got: %q", proxied)
+	}
+}
+
+func TestValidateHTTPConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	notPEM := filepath.Join(tmpDir, "ca.pem")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0644)
+
+	if errs := validateHTTPConfig(httpConfig{Proxy: "http://proxy.example.com:3128"}); len(errs) != 0 {
+		t.Errorf("Expected no errors, got: %v", errs)
+	}
+	var tests = []httpConfig{
+		{Proxy: "proxy.example.com"},
+		{CACert: notPEM},
+		{CACert: filepath.Join(tmpDir, "missing.pem")},
+		{ClientCert: filepath.Join(tmpDir, "client.pem")},
+		{ClientCert: notPEM, ClientKey: notPEM},
+	}
+	for _, tc := range tests {
+		if errs := validateHTTPConfig(tc); len(errs) != 1 {
+			t.Errorf("%+v: expected an error, got: %v", tc, errs)
+		}
+	}
+}
+
+func TestGitHTTPEnv(t *testing.T) {
+	env, err := gitHTTPEnv(httpConfig{
+		Proxy:              "http://proxy.example.com:3128",
+		CACert:             "/certs/ca.pem",
+		ClientCert:         "/certs/client.pem",
+		ClientKey:          "/certs/client.key",
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expected := []string{
+		"http_proxy=http://proxy.example.com:3128",
+		"https_proxy=http://proxy.example.com:3128",
+		"GIT_SSL_CAINFO=/certs/ca.pem",
+		"GIT_SSL_CERT=/certs/client.pem",
+		"GIT_SSL_KEY=/certs/client.key",
+		"GIT_SSL_NO_VERIFY=true",
+	}
+	if strings.Join(env, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected %v, got: %v", expected, env)
+	}
+
+	cmd := newGitCommand(&cloneOptions{httpEnv: env}, "https://gitlab.example.com/x/y", "clone", "https://gitlab.example.com/x/y", "/tmp/y")
+	if !strings.Contains(strings.Join(cmd.Env, "\n"), "GIT_SSL_CAINFO=/certs/ca.pem") {
+		t.Errorf("Expected the HTTP settings in the environment of git, got: %v", cmd.Env)
+	}
+}
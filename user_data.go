@@ -7,13 +7,13 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"path"
 	"strings"
 	"time"
 
 	"github.com/google/go-github/v34/github"
+	"golang.org/x/oauth2"
 )
 
 // Using vars insted of const, since we cannot take & of a const
@@ -114,7 +114,7 @@ func downloadGithubUserMigrationData(
 				return err
 			}
 			archiveFilepath := getLocalMigrationFilepath(backupDir, *ms.ID)
-			return downloadMigrationArchive(archiveURL, archiveFilepath)
+			return downloadMigrationArchive(ctx, archiveURL, archiveFilepath)
 		default:
 			log.Printf("Waiting for migration state to be exported: %s\n", *ms.State)
 			time.Sleep(migrationStatePollingDuration)
@@ -147,7 +147,7 @@ func downloadGithubOrgMigrationData(
 			}
 
 			archiveFilepath := getLocalOrgMigrationFilepath(backupDir, org, *ms.ID)
-			return downloadMigrationArchive(archiveURL, archiveFilepath)
+			return downloadMigrationArchive(ctx, archiveURL, archiveFilepath)
 		default:
 			log.Printf("Waiting for migration state to be exported: %s\n", *ms.State)
 			time.Sleep(migrationStatePollingDuration)
@@ -159,11 +159,12 @@ func downloadGithubOrgMigrationData(
 	}
 }
 
-// downloadMigrationArchive downloads a migration archive from the given URL to the specified filepath
-func downloadMigrationArchive(archiveURL, archiveFilepath string) error {
+// downloadMigrationArchive downloads a migration archive from the given URL to the specified filepath.
+// The HTTP client of ctx, as set for the oauth2 package, is used if there is one.
+func downloadMigrationArchive(ctx context.Context, archiveURL, archiveFilepath string) error {
 	log.Printf("Downloading file to: %s\n", archiveFilepath)
 
-	resp, err := http.Get(archiveURL)
+	resp, err := oauth2.NewClient(ctx, nil).Get(archiveURL)
 	if err != nil {
 		return fmt.Errorf("error downloading archive:%v", err)
 	}
@@ -225,7 +226,10 @@ type GithubUserMigrationDeleteResult struct {
 
 // DeleteGithubUserMigration deletes an existing migration
 func DeleteGithubUserMigration(id *int64) GithubUserMigrationDeleteResult {
-	client := newClient("github", "https://github.com")
+	client, err := newClient(&appConfig{service: "github", gitHostURL: "https://github.com"})
+	if err != nil {
+		return GithubUserMigrationDeleteResult{GhResponseBody: err.Error()}
+	}
 	ctx := context.Background()
 	response, err := client.(*github.Client).Migrations.DeleteUserMigration(ctx, *id)
 
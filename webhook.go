@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// maxWebhookPayloadSize is the largest webhook request body we accept
+const maxWebhookPayloadSize = 25 << 20
+
+const defaultWebhookDebounce = 30 * time.Second
+
+var errWebhookIgnored = errors.New("event ignored")
+
+// serveFlags returns the CLI flags for the serve command.
+func serveFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "listen",
+			Usage:       "Address to listen on for webhook and metrics requests",
+			DefaultText: ":8080",
+			Value:       ":8080",
+		},
+		&cli.StringFlag{
+			Name:    "webhook.secret",
+			Usage:   "Secret used to validate webhook signatures/tokens",
+			EnvVars: []string{"GITBACKUP_WEBHOOK_SECRET"},
+		},
+		&cli.DurationFlag{
+			Name:        "webhook.debounce",
+			Usage:       "Time to wait for further pushes before backing up a repository",
+			DefaultText: "30s",
+			Value:       defaultWebhookDebounce,
+		},
+	}
+}
+
+// webhookServer receives push webhooks and backs up the affected repositories
+type webhookServer struct {
+	config   *appConfig
+	secret   string
+	debounce time.Duration
+	opts     *cloneOptions
+
+	// gitHost is the host name of the service, without the port of its
+	// web interface which SSH clone URLs do not carry
+	gitHost string
+
+	// backup is called to back up a single repository, overridden in tests
+	backup func(repo *Repository) error
+
+	mutex   sync.Mutex
+	pending map[string]*pendingBackup
+	tokens  chan bool
+	wg      sync.WaitGroup
+}
+
+// pendingBackup tracks the debounce timer and run state of a repository
+type pendingBackup struct {
+	repo    *Repository
+	timer   *time.Timer
+	running bool
+	rerun   bool
+}
+
+func newWebhookServer(c *appConfig, secret string, debounce time.Duration) *webhookServer {
+	// buildConfigs has rejected invalid githost URLs
+	gitHost, _ := getGitHost(c.service, c.gitHostURL)
+	s := &webhookServer{
+		config:   c,
+		secret:   secret,
+		debounce: debounce,
+		gitHost:  (&url.URL{Host: gitHost}).Hostname(),
+		pending:  make(map[string]*pendingBackup),
+		tokens:   make(chan bool, MaxConcurrentClones),
+	}
+	s.backup = func(repo *Repository) error {
+		assignRepoDirs(c, []*Repository{repo})
+		_, _, stdoutStderr, err := backUpRepository(c, repo, s.opts)
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, stdoutStderr)
+		}
+		return nil
+	}
+	return s
+}
+
+// handleServe runs the webhook receiver until it is interrupted
+func handleServe(client any, c *appConfig, listenAddr, secret string, debounce time.Duration) error {
+	if err := checkGitAvailability(); err != nil {
+		return err
+	}
+	if secret == "" {
+		return errors.New("a webhook secret is required, set --webhook.secret or GITBACKUP_WEBHOOK_SECRET")
+	}
+	registerSecret(secret)
+
+	useHTTPSClone = &c.useHTTPSClone
+	username, err := getCloneUsername(client, c)
+	if err != nil {
+		return err
+	}
+
+	s := newWebhookServer(c, secret, debounce)
+	s.opts, err = newCloneOptions(c, username)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/webhook", s)
+	mux.Handle("/metrics", metrics)
+	metrics.enable()
+
+	server := &http.Server{
+		Addr:              listenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down webhook receiver")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Listening for %s webhooks on %s/webhook\n", c.service, listenAddr)
+	err = server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	s.wait()
+	return nil
+}
+
+// ServeHTTP validates an incoming webhook and queues a backup of the pushed repository
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookPayloadSize))
+	if err != nil {
+		http.Error(w, "error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	service := detectWebhookService(r.Header)
+	if service == "" {
+		http.Error(w, "unrecognized webhook", http.StatusBadRequest)
+		return
+	}
+	if service != s.config.service {
+		http.Error(w, fmt.Sprintf("not accepting %s webhooks", service), http.StatusBadRequest)
+		return
+	}
+
+	if !validateWebhookRequest(service, r.Header, body, s.secret) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	repo, err := parseWebhookPayload(service, r.Header, body)
+	if errors.Is(err, errWebhookIgnored) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.checkRepository(repo); err != nil {
+		log.Printf("Ignoring webhook for %s/%s: %v\n", repo.Namespace, repo.Name, err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	s.schedule(repo)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// checkRepository ensures that a repository from a webhook belongs to the
+// configured git host and is not excluded by the configuration
+func (s *webhookServer) checkRepository(repo *Repository) error {
+	if !strings.EqualFold(getCloneURLHost(repo.CloneURL), s.gitHost) {
+		return fmt.Errorf("repository is not hosted on %s", s.gitHost)
+	}
+	if repo.Private && s.config.ignorePrivate {
+		return errors.New("private repositories are ignored")
+	}
+	if repo.Fork && s.config.ignoreFork {
+		return errors.New("forks are ignored")
+	}
+	if s.config.service == "github" && len(s.config.githubNamespaceWhitelist) > 0 &&
+		!contains(s.config.githubNamespaceWhitelist, repo.Namespace) {
+		return errors.New("namespace is not whitelisted")
+	}
+	filter := webhookFilter(s.config.service, s.config.filter)
+	selected, err := filterRepositories([]*Repository{repo}, filter, s.config.explain)
+	if err != nil {
+		return err
+	}
+	if len(selected) == 0 {
+		return errors.New("excluded by the filters")
+	}
+	return nil
+}
+
+// schedule queues a backup of the repository once no further pushes
+// have been received for the debounce period
+func (s *webhookServer) schedule(repo *Repository) {
+	key := repo.Namespace + "/" + repo.Name
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, ok := s.pending[key]
+	if !ok {
+		p = &pendingBackup{}
+		s.pending[key] = p
+	}
+	p.repo = repo
+
+	if p.running {
+		p.rerun = true
+		return
+	}
+	if p.timer != nil {
+		// If the timer has already fired, run is about to pick up this push
+		if p.timer.Stop() {
+			p.timer = time.AfterFunc(s.debounce, func() { s.run(key) })
+		}
+		return
+	}
+	log.Printf("Received push for %s, backing up in %v\n", key, s.debounce)
+	s.wg.Add(1)
+	p.timer = time.AfterFunc(s.debounce, func() { s.run(key) })
+}
+
+// run backs up the repository identified by key, repeating the backup
+// if further pushes were received while it was running
+func (s *webhookServer) run(key string) {
+	defer s.wg.Done()
+
+	for {
+		s.mutex.Lock()
+		p := s.pending[key]
+		p.timer = nil
+		p.running = true
+		p.rerun = false
+		repo := p.repo
+		s.mutex.Unlock()
+
+		s.tokens <- true
+		err := s.backup(repo)
+		<-s.tokens
+		if err != nil {
+			log.Printf("Error backing up %s: %v\n", key, err)
+		}
+
+		s.mutex.Lock()
+		p.running = false
+		if !p.rerun {
+			delete(s.pending, key)
+			s.mutex.Unlock()
+			return
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// wait blocks until all queued and running backups have completed
+func (s *webhookServer) wait() {
+	s.wg.Wait()
+}
+
+// detectWebhookService returns the git service which sent a webhook
+// based on its event header
+func detectWebhookService(header http.Header) string {
+	switch {
+	case header.Get("X-GitHub-Event") != "":
+		return "github"
+	case header.Get("X-Gitlab-Event") != "":
+		return "gitlab"
+	case header.Get("X-Forgejo-Event") != "", header.Get("X-Gitea-Event") != "":
+		return "forgejo"
+	case header.Get("X-Event-Key") != "":
+		return "bitbucket"
+	}
+	return ""
+}
+
+// validateWebhookRequest checks the signature or secret token of a webhook
+func validateWebhookRequest(service string, header http.Header, body []byte, secret string) bool {
+	switch service {
+	case "github", "bitbucket":
+		signature, ok := strings.CutPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok {
+			signature, ok = strings.CutPrefix(header.Get("X-Hub-Signature"), "sha256=")
+		}
+		return ok && validHMACSignature(body, secret, signature)
+	case "gitlab":
+		token := header.Get("X-Gitlab-Token")
+		return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	case "forgejo":
+		signature := header.Get("X-Forgejo-Signature")
+		if signature == "" {
+			signature = header.Get("X-Gitea-Signature")
+		}
+		return signature != "" && validHMACSignature(body, secret, signature)
+	}
+	return false
+}
+
+// validHMACSignature checks a hex encoded HMAC-SHA256 signature of the body
+func validHMACSignature(body []byte, secret, signature string) bool {
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// webhookRepository holds the repository fields shared by the GitHub and
+// Forgejo push payloads
+type webhookRepository struct {
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	CloneURL string `json:"clone_url"`
+	SSHURL   string `json:"ssh_url"`
+	Private  bool   `json:"private"`
+
+	// The metadata used by the filters. Forgejo reports neither the
+	// language and topics nor when the repository was pushed to, only
+	// when it was last updated.
+	Fork      bool        `json:"fork"`
+	Archived  bool        `json:"archived"`
+	Disabled  bool        `json:"disabled"`
+	Size      int64       `json:"size"`
+	Language  string      `json:"language"`
+	Topics    []string    `json:"topics"`
+	PushedAt  webhookTime `json:"pushed_at"`
+	UpdatedAt webhookTime `json:"updated_at"`
+}
+
+// webhookTime is a time in a webhook payload, which GitHub push events give
+// as a Unix timestamp and other payloads as an RFC 3339 string
+type webhookTime struct {
+	time.Time
+}
+
+// UnmarshalJSON accepts both a Unix timestamp and an RFC 3339 string
+func (t *webhookTime) UnmarshalJSON(data []byte) error {
+	var seconds int64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		t.Time = time.Unix(seconds, 0).UTC()
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil || s == "" {
+		// The time is only used by the filters, which pass repositories
+		// without one
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		t.Time = parsed
+	}
+	return nil
+}
+
+type githubPushPayload struct {
+	Repository webhookRepository `json:"repository"`
+}
+
+type forgejoPushPayload struct {
+	Repository webhookRepository `json:"repository"`
+}
+
+type gitlabPushPayload struct {
+	Project struct {
+		Name              string `json:"name"`
+		PathWithNamespace string `json:"path_with_namespace"`
+		GitHTTPURL        string `json:"git_http_url"`
+		GitSSHURL         string `json:"git_ssh_url"`
+		VisibilityLevel   int    `json:"visibility_level"`
+	} `json:"project"`
+}
+
+type bitbucketPushPayload struct {
+	Repository struct {
+		FullName  string `json:"full_name"`
+		IsPrivate bool   `json:"is_private"`
+		Links     struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+	} `json:"repository"`
+}
+
+// parseWebhookPayload extracts the pushed repository from a webhook payload.
+// errWebhookIgnored is returned for events which are not pushes.
+func parseWebhookPayload(service string, header http.Header, body []byte) (*Repository, error) {
+	switch service {
+	case "github":
+		if header.Get("X-GitHub-Event") != "push" {
+			return nil, errWebhookIgnored
+		}
+		var payload githubPushPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("error parsing payload: %v", err)
+		}
+		return webhookRepositoryToRepository(payload.Repository)
+	case "forgejo":
+		event := header.Get("X-Forgejo-Event")
+		if event == "" {
+			event = header.Get("X-Gitea-Event")
+		}
+		if event != "push" {
+			return nil, errWebhookIgnored
+		}
+		var payload forgejoPushPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("error parsing payload: %v", err)
+		}
+		return webhookRepositoryToRepository(payload.Repository)
+	case "gitlab":
+		event := header.Get("X-Gitlab-Event")
+		if event != "Push Hook" && event != "Tag Push Hook" {
+			return nil, errWebhookIgnored
+		}
+		var payload gitlabPushPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("error parsing payload: %v", err)
+		}
+		p := payload.Project
+		if p.PathWithNamespace == "" || p.Name == "" {
+			return nil, errors.New("payload does not contain a project")
+		}
+		namespace, legacyNamespace := gitlabNamespaces(p.PathWithNamespace)
+		name, legacyName := gitlabName(p.PathWithNamespace, p.Name)
+		return &Repository{
+			CloneURL:  getCloneURL(p.GitHTTPURL, p.GitSSHURL),
+			Name:      name,
+			Namespace: namespace,
+			// GitLab uses 0 for private, 10 for internal and 20 for public
+			Private:         p.VisibilityLevel == 0,
+			LegacyNamespace: legacyNamespace,
+			LegacyName:      legacyName,
+		}, nil
+	case "bitbucket":
+		if header.Get("X-Event-Key") != "repo:push" {
+			return nil, errWebhookIgnored
+		}
+		var payload bitbucketPushPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("error parsing payload: %v", err)
+		}
+		namespace, slug, ok := strings.Cut(payload.Repository.FullName, "/")
+		if !ok {
+			return nil, errors.New("payload does not contain a repository")
+		}
+		host := knownServices["bitbucket"]
+		if u, err := url.Parse(payload.Repository.Links.HTML.Href); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		// Push payloads don't include clone links, so we build them
+		httpsURL := fmt.Sprintf("https://%s/%s/%s.git", host, namespace, slug)
+		sshURL := fmt.Sprintf("git@%s:%s/%s.git", host, namespace, slug)
+		return &Repository{
+			CloneURL:  getCloneURL(httpsURL, sshURL),
+			Name:      slug,
+			Namespace: namespace,
+			Private:   payload.Repository.IsPrivate,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported service: %s", service)
+}
+
+func webhookRepositoryToRepository(r webhookRepository) (*Repository, error) {
+	namespace, _, ok := strings.Cut(r.FullName, "/")
+	if !ok || r.Name == "" {
+		return nil, errors.New("payload does not contain a repository")
+	}
+	pushedAt := r.PushedAt.Time
+	if pushedAt.IsZero() {
+		pushedAt = r.UpdatedAt.Time
+	}
+	return &Repository{
+		CloneURL:  getCloneURL(r.CloneURL, r.SSHURL),
+		Name:      r.Name,
+		Namespace: namespace,
+		Private:   r.Private,
+		Fork:      r.Fork,
+		Archived:  r.Archived || r.Disabled,
+		// GitHub and Forgejo report the size in kilobytes
+		Size:     r.Size << 10,
+		PushedAt: pushedAt,
+		Language: r.Language,
+		Topics:   r.Topics,
+	}, nil
+}
+
+// webhookFilter returns the filters of f which can be applied to the
+// repositories of push payloads of service. Only GitHub payloads report the
+// language and topics; repositories are not rejected for metadata which
+// the payload does not report, such as forks on GitLab and Bitbucket.
+func webhookFilter(service string, f filterConfig) filterConfig {
+	if service != "github" {
+		f.Languages = nil
+		f.IncludeTopics = nil
+		f.ExcludeTopics = nil
+	}
+	return f
+}
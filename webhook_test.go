@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func signWebhookBody(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidateWebhookRequest(t *testing.T) {
+	body := `{"ref":"refs/heads/main"}`
+	secret := "s3cret"
+	signature := signWebhookBody(body, secret)
+
+	tests := []struct {
+		name    string
+		service string
+		header  map[string]string
+		want    bool
+	}{
+		{"github valid", "github", map[string]string{"X-Hub-Signature-256": "sha256=" + signature}, true},
+		{"github invalid", "github", map[string]string{"X-Hub-Signature-256": "sha256=" + signWebhookBody(body, "wrong")}, false},
+		{"github missing", "github", map[string]string{}, false},
+		{"bitbucket valid", "bitbucket", map[string]string{"X-Hub-Signature": "sha256=" + signature}, true},
+		{"gitlab valid", "gitlab", map[string]string{"X-Gitlab-Token": secret}, true},
+		{"gitlab invalid", "gitlab", map[string]string{"X-Gitlab-Token": "wrong"}, false},
+		{"forgejo valid", "forgejo", map[string]string{"X-Forgejo-Signature": signature}, true},
+		{"gitea valid", "forgejo", map[string]string{"X-Gitea-Signature": signature}, true},
+		{"forgejo invalid", "forgejo", map[string]string{"X-Forgejo-Signature": "not-hex"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for k, v := range tt.header {
+				header.Set(k, v)
+			}
+			if got := validateWebhookRequest(tt.service, header, []byte(body), secret); got != tt.want {
+				t.Errorf("validateWebhookRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWebhookPayload(t *testing.T) {
+	useHTTPSClone = nil
+
+	tests := []struct {
+		name    string
+		service string
+		header  map[string]string
+		body    string
+		want    *Repository
+	}{
+		{
+			"github",
+			"github",
+			map[string]string{"X-GitHub-Event": "push"},
+			`{"repository":{"name":"r1","full_name":"test/r1","clone_url":"https://github.com/test/r1.git","ssh_url":"git@github.com:test/r1.git","private":true}}`,
+			&Repository{Namespace: "test", Name: "r1", CloneURL: "git@github.com:test/r1.git", Private: true},
+		},
+		{
+			"github metadata",
+			"github",
+			map[string]string{"X-GitHub-Event": "push"},
+			`{"repository":{"name":"r1","full_name":"test/r1","ssh_url":"git@github.com:test/r1.git","fork":true,"archived":true,"size":2048,"pushed_at":1772618400,"language":"Go","topics":["cli"]}}`,
+			&Repository{Namespace: "test", Name: "r1", CloneURL: "git@github.com:test/r1.git", Fork: true, Archived: true,
+				Size: 2 << 20, PushedAt: time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC), Language: "Go", Topics: []string{"cli"}},
+		},
+		{
+			"forgejo",
+			"forgejo",
+			map[string]string{"X-Forgejo-Event": "push"},
+			`{"repository":{"name":"def","full_name":"abc/def","clone_url":"https://codeberg.org/abc/def.git","ssh_url":"git@codeberg.org:abc/def.git","private":false}}`,
+			&Repository{Namespace: "abc", Name: "def", CloneURL: "git@codeberg.org:abc/def.git"},
+		},
+		{
+			"gitlab",
+			"gitlab",
+			map[string]string{"X-Gitlab-Event": "Push Hook"},
+			`{"project":{"name":"r1","path_with_namespace":"test/r1","git_http_url":"https://gitlab.com/test/r1.git","git_ssh_url":"git@gitlab.com:test/r1.git","visibility_level":0}}`,
+			&Repository{Namespace: "test", Name: "r1", CloneURL: "git@gitlab.com:test/r1.git", Private: true},
+		},
+		{
+			"gitlab subgroup",
+			"gitlab",
+			map[string]string{"X-Gitlab-Event": "Push Hook"},
+			`{"project":{"name":"api","path_with_namespace":"org/team-a/api","git_http_url":"https://gitlab.com/org/team-a/api.git","git_ssh_url":"git@gitlab.com:org/team-a/api.git","visibility_level":20}}`,
+			&Repository{Namespace: "org/team-a", Name: "api", CloneURL: "git@gitlab.com:org/team-a/api.git", LegacyNamespace: "org"},
+		},
+		{
+			"bitbucket",
+			"bitbucket",
+			map[string]string{"X-Event-Key": "repo:push"},
+			`{"repository":{"full_name":"abc/def","is_private":true,"links":{"html":{"href":"https://bitbucket.org/abc/def"}}}}`,
+			&Repository{Namespace: "abc", Name: "def", CloneURL: "git@bitbucket.org:abc/def.git", Private: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for k, v := range tt.header {
+				header.Set(k, v)
+			}
+			got, err := parseWebhookPayload(tt.service, header, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %+v, Got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseWebhookPayloadIgnoresOtherEvents(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-GitHub-Event", "ping")
+	_, err := parseWebhookPayload("github", header, []byte(`{"zen":"hello"}`))
+	if err != errWebhookIgnored {
+		t.Errorf("Expected errWebhookIgnored, got: %v", err)
+	}
+}
+
+func TestWebhookServerDebounce(t *testing.T) {
+	useHTTPSClone = nil
+	c := &appConfig{service: "github"}
+	s := newWebhookServer(c, "s3cret", 50*time.Millisecond)
+
+	var mutex sync.Mutex
+	var backedUp []string
+	s.backup = func(repo *Repository) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		backedUp = append(backedUp, repo.Namespace+"/"+repo.Name)
+		return nil
+	}
+
+	body := `{"repository":{"name":"r1","full_name":"test/r1","clone_url":"https://github.com/test/r1.git","ssh_url":"git@github.com:test/r1.git"}}`
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", "sha256="+signWebhookBody(body, "s3cret"))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("Expected status %d, got: %d", http.StatusAccepted, w.Code)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	s.wait()
+
+	if !reflect.DeepEqual(backedUp, []string{"test/r1"}) {
+		t.Errorf("Expected a single backup of test/r1, got: %v", backedUp)
+	}
+}
+
+func TestWebhookServerRejectsInvalidRequests(t *testing.T) {
+	useHTTPSClone = nil
+	c := &appConfig{service: "github"}
+	s := newWebhookServer(c, "s3cret", time.Millisecond)
+	s.backup = func(repo *Repository) error {
+		t.Errorf("Unexpected backup of %s", repo.Name)
+		return nil
+	}
+
+	githubBody := `{"repository":{"name":"r1","full_name":"test/r1","clone_url":"https://github.com/test/r1.git","ssh_url":"git@github.com:test/r1.git"}}`
+	otherHostBody := `{"repository":{"name":"r1","full_name":"test/r1","clone_url":"https://evil.example.com/test/r1.git","ssh_url":"git@evil.example.com:test/r1.git"}}`
+
+	tests := []struct {
+		name       string
+		header     map[string]string
+		body       string
+		wantStatus int
+	}{
+		{"bad signature", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=00"}, githubBody, http.StatusUnauthorized},
+		{"other service", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "s3cret"}, githubBody, http.StatusBadRequest},
+		{"unknown sender", map[string]string{}, githubBody, http.StatusBadRequest},
+		{"other host", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signWebhookBody(otherHostBody, "s3cret")}, otherHostBody, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(tt.body))
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got: %d", tt.wantStatus, w.Code)
+			}
+		})
+	}
+	s.wait()
+}
+
+func TestWebhookServerAcceptsHostWithPort(t *testing.T) {
+	useHTTPSClone = nil
+	c := &appConfig{service: "gitlab", gitHostURL: "https://gitlab.example.com:8443"}
+	s := newWebhookServer(c, "s3cret", time.Millisecond)
+
+	for _, cloneURL := range []string{"git@gitlab.example.com:test/r1.git", "https://gitlab.example.com:8443/test/r1.git"} {
+		if err := s.checkRepository(&Repository{Namespace: "test", Name: "r1", CloneURL: cloneURL}); err != nil {
+			t.Errorf("Expected %s to be accepted, got: %v", cloneURL, err)
+		}
+	}
+	if err := s.checkRepository(&Repository{Namespace: "test", Name: "r1", CloneURL: "git@evil.example.com:test/r1.git"}); err == nil {
+		t.Error("Expected a repository on another host to be rejected")
+	}
+}
+
+func TestWebhookServerAppliesFilters(t *testing.T) {
+	useHTTPSClone = nil
+	c := &appConfig{service: "github", filter: filterConfig{Include: []string{"test/*"}, Exclude: []string{"*/old-*"}}}
+	s := newWebhookServer(c, "s3cret", time.Millisecond)
+
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"r1", false},
+		{"old-r1", true},
+	}
+	for _, tt := range tests {
+		repo := &Repository{Namespace: "test", Name: tt.name, CloneURL: "git@github.com:test/" + tt.name + ".git"}
+		if err := s.checkRepository(repo); (err != nil) != tt.wantErr {
+			t.Errorf("checkRepository(%s): got %v, want error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+	if err := s.checkRepository(&Repository{Namespace: "other", Name: "r1", CloneURL: "git@github.com:other/r1.git"}); err == nil {
+		t.Error("Expected a repository matching no include rule to be rejected")
+	}
+}
+
+func TestWebhookServerAppliesMetadataFilters(t *testing.T) {
+	useHTTPSClone = nil
+	c := &appConfig{service: "github", ignoreFork: true, filter: filterConfig{SkipArchived: true, MaxSizeMB: 1, Languages: []string{"go"}}}
+	s := newWebhookServer(c, "s3cret", time.Millisecond)
+
+	tests := []struct {
+		name    string
+		repo    Repository
+		wantErr bool
+	}{
+		{"selected", Repository{Language: "Go", Size: 1 << 10}, false},
+		{"fork", Repository{Language: "Go", Fork: true}, true},
+		{"archived", Repository{Language: "Go", Archived: true}, true},
+		{"too large", Repository{Language: "Go", Size: 2 << 20}, true},
+		{"language", Repository{Language: "C"}, true},
+	}
+	for _, tt := range tests {
+		repo := tt.repo
+		repo.Namespace, repo.Name, repo.CloneURL = "test", "r1", "git@github.com:test/r1.git"
+		if err := s.checkRepository(&repo); (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %v, want error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// GitLab push payloads report no language, which does not reject the
+	// repository
+	c = &appConfig{service: "gitlab", filter: filterConfig{Languages: []string{"go"}}}
+	s = newWebhookServer(c, "s3cret", time.Millisecond)
+	if err := s.checkRepository(&Repository{Namespace: "test", Name: "r1", CloneURL: "git@gitlab.com:test/r1.git"}); err != nil {
+		t.Errorf("Expected the repository to be accepted, got: %v", err)
+	}
+}